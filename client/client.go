@@ -0,0 +1,195 @@
+// Package client implements the host side of the U2FHID protocol, to talk to U2F and CTAP HID devices like fidati.
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gsora/fidati/u2fhid"
+)
+
+// DeviceInfo describes a device, as reported in its cmdInit response.
+type DeviceInfo struct {
+	ProtocolVersion uint8
+	MajorVersion    uint8
+	MinorVersion    uint8
+	BuildVersion    uint8
+	Capabilities    uint8
+}
+
+// Wink returns true if the device handles cmdWink.
+func (d DeviceInfo) Wink() bool {
+	return d.Capabilities&u2fhid.CapabilityWink != 0
+}
+
+// CBOR returns true if the device handles CBOR messages.
+func (d DeviceInfo) CBOR() bool {
+	return d.Capabilities&u2fhid.CapabilityCbor != 0
+}
+
+// Msg returns true if the device handles U2F messages.
+func (d DeviceInfo) Msg() bool {
+	return d.Capabilities&u2fhid.CapabilityNmsg == 0
+}
+
+// Device is a U2FHID device, reached over a channel allocated to the Device.
+// Device isn't safe for concurrent use.
+type Device struct {
+	rw      io.ReadWriter
+	channel uint32
+	info    DeviceInfo
+}
+
+// Open allocates a channel on the device reachable through rw, and returns a Device using it.
+// Each Read from rw must return a single report sent by the device, and each Write must send buf to the device as
+// a single report: reports are always 64 bytes long.
+func Open(rw io.ReadWriter) (*Device, error) {
+	if rw == nil {
+		return nil, errors.New("device is nil")
+	}
+
+	d := &Device{
+		rw:      rw,
+		channel: u2fhid.BroadcastChannel,
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce, %w", err)
+	}
+
+	if err := d.send(u2fhid.CmdInit, nonce); err != nil {
+		return nil, err
+	}
+
+	// other hosts may be allocating channels at the same time, skip responses to other nonces
+	for {
+		resp, err := d.receive(u2fhid.CmdInit)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp) < 17 {
+			return nil, fmt.Errorf("init response is %d bytes long, expected at least 17", len(resp))
+		}
+
+		if !bytes.Equal(resp[:8], nonce) {
+			continue
+		}
+
+		d.channel = binary.BigEndian.Uint32(resp[8:12])
+		d.info = DeviceInfo{
+			ProtocolVersion: resp[12],
+			MajorVersion:    resp[13],
+			MinorVersion:    resp[14],
+			BuildVersion:    resp[15],
+			Capabilities:    resp[16],
+		}
+
+		return d, nil
+	}
+}
+
+// Channel returns the channel allocated to d.
+func (d *Device) Channel() uint32 {
+	return d.channel
+}
+
+// Info returns the DeviceInfo sent by the device when d channel was allocated.
+func (d *Device) Info() DeviceInfo {
+	return d.info
+}
+
+// Ping sends data to the device, which echoes it back.
+func (d *Device) Ping(data []byte) ([]byte, error) {
+	return d.transact(u2fhid.CmdPing, data)
+}
+
+// Wink asks the device to identify itself to the user.
+func (d *Device) Wink() error {
+	if !d.info.Wink() {
+		return errors.New("device doesn't support wink")
+	}
+
+	_, err := d.transact(u2fhid.CmdWink, nil)
+	return err
+}
+
+// Message sends apdu to the device with a cmdMsg message, and returns the raw response.
+func (d *Device) Message(apdu []byte) ([]byte, error) {
+	return d.transact(u2fhid.CmdMsg, apdu)
+}
+
+// transact sends data to the device with a cmd message, and returns the payload of its response.
+func (d *Device) transact(cmd u2fhid.Command, data []byte) ([]byte, error) {
+	if err := d.send(cmd, data); err != nil {
+		return nil, err
+	}
+
+	return d.receive(cmd)
+}
+
+// send sends data to the device with a cmd message on d channel.
+func (d *Device) send(cmd u2fhid.Command, data []byte) error {
+	pkts, err := u2fhid.Fragment(d.channel, cmd, data)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pkts {
+		if _, err := d.rw.Write(p); err != nil {
+			return fmt.Errorf("cannot write to device, %w", err)
+		}
+	}
+
+	return nil
+}
+
+// receive reads the response to a cmd message on d channel, and returns its payload.
+// Keepalives, and packets sent on other channels, are skipped.
+// A CmdError response is returned as a u2fhid.Error.
+func (d *Device) receive(cmd u2fhid.Command) ([]byte, error) {
+	var m u2fhid.Message
+
+	buf := make([]byte, u2fhid.ReportLen)
+
+	for {
+		if _, err := io.ReadFull(d.rw, buf); err != nil {
+			return nil, fmt.Errorf("cannot read from device, %w", err)
+		}
+
+		if binary.BigEndian.Uint32(buf) != d.channel {
+			continue
+		}
+
+		if u2fhid.Command(buf[4]) == u2fhid.CmdKeepalive {
+			continue
+		}
+
+		done, err := m.Add(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if !done {
+			continue
+		}
+
+		switch m.Command() {
+		case cmd:
+			return m.Data(), nil
+		case u2fhid.CmdError:
+			if len(m.Data()) != 1 {
+				return nil, fmt.Errorf("error response is %d bytes long, expected 1", len(m.Data()))
+			}
+
+			return nil, u2fhid.Error(m.Data()[0])
+		default:
+			return nil, fmt.Errorf("expected response to command 0x%X, found 0x%X", uint8(cmd), uint8(m.Command()))
+		}
+	}
+}
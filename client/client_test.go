@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsora/fidati/u2fhid"
+)
+
+type test struct {
+	name string
+	f    func(t *testing.T)
+}
+
+// fakeDevice is a device which answers each message written to it with respond.
+type fakeDevice struct {
+	respond func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte
+
+	msgs    map[uint32]*u2fhid.Message
+	reports [][]byte
+	written [][]byte
+}
+
+// newFakeDevice returns a fakeDevice which allocates channel 0x01020304 and answers every other message with
+// respond.
+func newFakeDevice(respond func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte) *fakeDevice {
+	return &fakeDevice{
+		respond: func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+			if cmd != u2fhid.CmdInit {
+				return respond(channel, cmd, data)
+			}
+
+			resp := append(data, 1, 2, 3, 4, 2, 4, 2, 0, u2fhid.CapabilityWink)
+			return mustFragment(channel, u2fhid.CmdInit, resp)
+		},
+		msgs: map[uint32]*u2fhid.Message{},
+	}
+}
+
+func (f *fakeDevice) Write(b []byte) (int, error) {
+	if len(b) != u2fhid.ReportLen {
+		return 0, errors.New("wrong report length")
+	}
+
+	f.written = append(f.written, b)
+
+	channel := binary.BigEndian.Uint32(b)
+	m, ok := f.msgs[channel]
+	if !ok {
+		m = &u2fhid.Message{}
+		f.msgs[channel] = m
+	}
+
+	done, err := m.Add(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if done {
+		delete(f.msgs, channel)
+		f.reports = append(f.reports, f.respond(channel, m.Command(), m.Data())...)
+	}
+
+	return len(b), nil
+}
+
+func (f *fakeDevice) Read(b []byte) (int, error) {
+	if len(f.reports) == 0 {
+		return 0, errors.New("no reports to read")
+	}
+
+	n := copy(b, f.reports[0])
+	f.reports = f.reports[1:]
+
+	return n, nil
+}
+
+// echo responds to every message with its own data.
+func echo(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+	return mustFragment(channel, cmd, data)
+}
+
+func mustFragment(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+	pkts, err := u2fhid.Fragment(channel, cmd, data)
+	if err != nil {
+		panic(err)
+	}
+
+	return pkts
+}
+
+func TestOpen(t *testing.T) {
+	tests := []test{
+		{
+			"nil device",
+			func(t *testing.T) {
+				d, err := Open(nil)
+				require.Error(t, err)
+				require.Nil(t, d)
+			},
+		},
+		{
+			"channel is allocated",
+			func(t *testing.T) {
+				f := newFakeDevice(echo)
+
+				d, err := Open(f)
+				require.NoError(t, err)
+
+				require.Equal(t, uint32(0x01020304), d.Channel())
+				require.Equal(t, DeviceInfo{
+					ProtocolVersion: 2,
+					MajorVersion:    4,
+					MinorVersion:    2,
+					BuildVersion:    0,
+					Capabilities:    u2fhid.CapabilityWink,
+				}, d.Info())
+
+				require.Len(t, f.written, 1)
+				require.Equal(t, []byte{255, 255, 255, 255, uint8(u2fhid.CmdInit), 0, 8}, f.written[0][:7])
+			},
+		},
+		{
+			"responses to other nonces are skipped",
+			func(t *testing.T) {
+				f := newFakeDevice(echo)
+				f.reports = mustFragment(u2fhid.BroadcastChannel, u2fhid.CmdInit, bytes.Repeat([]byte{0}, 17))
+
+				d, err := Open(f)
+				require.NoError(t, err)
+				require.Equal(t, uint32(0x01020304), d.Channel())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestDevice_Ping(t *testing.T) {
+	tests := []test{
+		{
+			"long messages are fragmented and reassembled",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(echo))
+				require.NoError(t, err)
+
+				data := bytes.Repeat([]byte{42}, 1000)
+
+				resp, err := d.Ping(data)
+				require.NoError(t, err)
+				require.Equal(t, data, resp)
+			},
+		},
+		{
+			"keepalives and other channels are skipped",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+					ret := mustFragment(channel, u2fhid.CmdKeepalive, []byte{1})
+					ret = append(ret, mustFragment(channel+1, cmd, []byte{1, 2, 3})...)
+					return append(ret, mustFragment(channel, cmd, data)...)
+				}))
+				require.NoError(t, err)
+
+				resp, err := d.Ping([]byte{42})
+				require.NoError(t, err)
+				require.Equal(t, []byte{42}, resp)
+			},
+		},
+		{
+			"errors are decoded",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+					return mustFragment(channel, u2fhid.CmdError, []byte{uint8(u2fhid.ErrChannelBusy)})
+				}))
+				require.NoError(t, err)
+
+				_, err = d.Ping([]byte{42})
+				require.True(t, errors.Is(err, u2fhid.ErrChannelBusy))
+				require.Contains(t, err.Error(), "ErrChannelBusy")
+			},
+		},
+		{
+			"response to another command",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+					return mustFragment(channel, u2fhid.CmdMsg, data)
+				}))
+				require.NoError(t, err)
+
+				_, err = d.Ping([]byte{42})
+				require.Error(t, err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestDevice_Wink(t *testing.T) {
+	d, err := Open(newFakeDevice(echo))
+	require.NoError(t, err)
+	require.NoError(t, d.Wink())
+
+	d.info.Capabilities = 0
+	require.Error(t, d.Wink())
+}
+
+func TestHIDRaw_Write(t *testing.T) {
+	b := &bytes.Buffer{}
+
+	n, err := HIDRaw{b}.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, []byte{0, 1, 2, 3}, b.Bytes())
+}
@@ -0,0 +1,34 @@
+package client
+
+import "fmt"
+
+// StatusError is a U2F status word other than the one signaling success, returned by the device in response to
+// an APDU.
+//go:generate stringer -type=StatusError
+type StatusError uint16
+
+const (
+	// statusNoError is the status word of successful responses.
+	statusNoError StatusError = 0x9000
+
+	// ErrConditionNotSatisfied means the request requires user presence, which hasn't been confirmed yet.
+	// It is also the response to a check-only authentication with a valid key handle.
+	ErrConditionNotSatisfied StatusError = 0x6985
+
+	// ErrWrongData means the request contained an invalid key handle.
+	ErrWrongData StatusError = 0x6A80
+
+	// ErrWrongLength means the request length was invalid.
+	ErrWrongLength StatusError = 0x6700
+
+	// ErrClaNotSupported means the class byte of the request isn't supported.
+	ErrClaNotSupported StatusError = 0x6E00
+
+	// ErrInsNotSupported means the instruction of the request isn't supported.
+	ErrInsNotSupported StatusError = 0x6D00
+)
+
+// Error implements the error interface.
+func (e StatusError) Error() string {
+	return fmt.Sprintf("status word 0x%04X %s", uint16(e), e.String())
+}
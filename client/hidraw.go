@@ -0,0 +1,19 @@
+package client
+
+import "io"
+
+// HIDRaw wraps a Linux hidraw device, like /dev/hidraw0, so that it can be used with Open.
+// hidraw expects each written report to be prefixed by its report number, U2FHID devices use none.
+type HIDRaw struct {
+	io.ReadWriter
+}
+
+// Write implements the io.Writer interface, prefixing b with the zero report number.
+func (h HIDRaw) Write(b []byte) (int, error) {
+	n, err := h.ReadWriter.Write(append([]byte{0}, b...))
+	if n > 0 {
+		n--
+	}
+
+	return n, err
+}
@@ -0,0 +1,299 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// U2F instructions.
+// See https://fidoalliance.org/specs/fido-u2f-v1.2-ps-20170411/fido-u2f-raw-message-formats-v1.2-ps-20170411.pdf for
+// more details.
+const (
+	insRegister     = 0x01
+	insAuthenticate = 0x02
+	insVersion      = 0x03
+	insGetResponse  = 0xc0
+)
+
+// Authenticate control bytes.
+const (
+	controlEnforceUserPresence = 0x03
+	controlCheckOnly           = 0x07
+)
+
+const (
+	// swBytesRemaining is the first byte of status words telling that more response data is available, to be
+	// fetched with a GET RESPONSE request.
+	swBytesRemaining = 0x61
+
+	// parameterLen is the length of the challenge and application parameters.
+	parameterLen = 32
+
+	// presencePollInterval is the amount of time between two requests, while waiting for the user to confirm
+	// presence.
+	presencePollInterval = 200 * time.Millisecond
+)
+
+// APDU builds an extended length APDU with ins, p1, p2 and data, sends it to the device with a cmdMsg message and
+// returns the response data.
+// Chained responses are fetched with GET RESPONSE requests until the device sends all of them.
+// A status word other than the one signaling success is returned as a StatusError.
+func (d *Device) APDU(ins, p1, p2 uint8, data []byte) ([]byte, error) {
+	apdu := buildAPDU(ins, p1, p2, data)
+
+	var ret []byte
+	for {
+		resp, err := d.Message(apdu)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp) < 2 {
+			return nil, fmt.Errorf("response is %d bytes long, expected at least 2", len(resp))
+		}
+
+		ret = append(ret, resp[:len(resp)-2]...)
+
+		sw := StatusError(binary.BigEndian.Uint16(resp[len(resp)-2:]))
+		switch {
+		case sw == statusNoError:
+			return ret, nil
+		case sw>>8 == swBytesRemaining:
+			apdu = buildAPDU(insGetResponse, 0, 0, nil)
+		default:
+			return nil, sw
+		}
+	}
+}
+
+// buildAPDU returns an extended length APDU with ins, p1, p2 and data, with the maximum expected response length.
+func buildAPDU(ins, p1, p2 uint8, data []byte) []byte {
+	b := []byte{0, ins, p1, p2, 0}
+
+	if len(data) > 0 {
+		b = append(b, uint8(len(data)>>8), uint8(len(data)))
+		b = append(b, data...)
+	}
+
+	return append(b, 0, 0)
+}
+
+// Version returns the U2F protocol version implemented by the device.
+func (d *Device) Version() (string, error) {
+	resp, err := d.APDU(insVersion, 0, 0, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(resp), nil
+}
+
+// Registration is the response to a registration request.
+type Registration struct {
+	// PublicKey is the uncompressed P-256 public key of the new credential.
+	PublicKey []byte
+
+	// KeyHandle identifies the new credential.
+	KeyHandle []byte
+
+	// AttestationCertificate is the DER-encoded attestation certificate of the device.
+	AttestationCertificate []byte
+
+	// Signature is the attestation signature of the registration.
+	Signature []byte
+}
+
+// Register registers a new credential for application, signing challenge with the attestation key of the device.
+// The user must confirm presence: requests are repeated until then, or until ctx is done.
+func (d *Device) Register(ctx context.Context, challenge, application []byte) (*Registration, error) {
+	if len(challenge) != parameterLen || len(application) != parameterLen {
+		return nil, fmt.Errorf("challenge and application must be %d bytes long", parameterLen)
+	}
+
+	resp, err := d.withPresence(ctx, insRegister, 0, append(append([]byte{}, challenge...), application...))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRegistration(resp)
+}
+
+// parseRegistration parses b as the response data to a registration request.
+func parseRegistration(b []byte) (*Registration, error) {
+	// reserved byte, public key, key handle length
+	if len(b) < 67 || b[0] != 0x05 {
+		return nil, errors.New("malformed registration response")
+	}
+
+	khLen := int(b[66])
+	if len(b) < 67+khLen {
+		return nil, errors.New("registration response too short for its key handle")
+	}
+
+	r := &Registration{
+		PublicKey: b[1:66],
+		KeyHandle: b[67 : 67+khLen],
+	}
+
+	rest := b[67+khLen:]
+	sig, err := asn1.Unmarshal(rest, &asn1.RawValue{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse attestation certificate, %w", err)
+	}
+
+	r.AttestationCertificate = rest[:len(rest)-len(sig)]
+	r.Signature = sig
+
+	return r, nil
+}
+
+// Verify checks r signature over challenge and application against the attestation certificate.
+// The certificate itself isn't verified.
+func (r *Registration) Verify(challenge, application []byte) error {
+	cert, err := x509.ParseCertificate(r.AttestationCertificate)
+	if err != nil {
+		return fmt.Errorf("cannot parse attestation certificate, %w", err)
+	}
+
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("attestation certificate key isn't an ECDSA key")
+	}
+
+	p := new(bytes.Buffer)
+	p.WriteByte(0x00)
+	p.Write(application)
+	p.Write(challenge)
+	p.Write(r.KeyHandle)
+	p.Write(r.PublicKey)
+
+	return verify(key, p.Bytes(), r.Signature)
+}
+
+// Assertion is the response to an authentication request.
+type Assertion struct {
+	// UserPresence is the user presence byte, bit 0 is set if the user confirmed presence.
+	UserPresence uint8
+
+	// Counter is the signature counter of the device.
+	Counter uint32
+
+	// Signature is the signature of the assertion, made with the credential key.
+	Signature []byte
+}
+
+// Authenticate signs challenge with the credential of application identified by keyHandle.
+// The user must confirm presence: requests are repeated until then, or until ctx is done.
+func (d *Device) Authenticate(ctx context.Context, challenge, application, keyHandle []byte) (*Assertion, error) {
+	data, err := authenticateData(challenge, application, keyHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.withPresence(ctx, insAuthenticate, controlEnforceUserPresence, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < 5 {
+		return nil, errors.New("malformed authentication response")
+	}
+
+	return &Assertion{
+		UserPresence: resp[0],
+		Counter:      binary.BigEndian.Uint32(resp[1:5]),
+		Signature:    resp[5:],
+	}, nil
+}
+
+// CheckKeyHandle returns true if keyHandle identifies a credential of application created by the device, without
+// requiring user presence nor signing anything.
+func (d *Device) CheckKeyHandle(challenge, application, keyHandle []byte) (bool, error) {
+	data, err := authenticateData(challenge, application, keyHandle)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.APDU(insAuthenticate, controlCheckOnly, 0, data)
+	switch {
+	case errors.Is(err, ErrConditionNotSatisfied):
+		return true, nil
+	case errors.Is(err, ErrWrongData):
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return false, errors.New("device signed a check-only authentication request")
+	}
+}
+
+// authenticateData returns the data of an authentication request.
+func authenticateData(challenge, application, keyHandle []byte) ([]byte, error) {
+	if len(challenge) != parameterLen || len(application) != parameterLen {
+		return nil, fmt.Errorf("challenge and application must be %d bytes long", parameterLen)
+	}
+
+	if len(keyHandle) > 255 {
+		return nil, fmt.Errorf("key handle is %d bytes long, maximum is 255", len(keyHandle))
+	}
+
+	data := append(append([]byte{}, challenge...), application...)
+	data = append(data, uint8(len(keyHandle)))
+
+	return append(data, keyHandle...), nil
+}
+
+// Verify checks a signature over challenge and application against publicKey, an uncompressed P-256 public key as
+// found in Registration.
+func (a *Assertion) Verify(publicKey, challenge, application []byte) error {
+	x, y := elliptic.Unmarshal(elliptic.P256(), publicKey)
+	if x == nil {
+		return errors.New("malformed public key")
+	}
+
+	p := new(bytes.Buffer)
+	p.Write(application)
+	p.WriteByte(a.UserPresence)
+	binary.Write(p, binary.BigEndian, a.Counter)
+	p.Write(challenge)
+
+	return verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, p.Bytes(), a.Signature)
+}
+
+// verify checks the ASN.1 encoded ECDSA signature sig of the SHA-256 hash of payload against key.
+func verify(key *ecdsa.PublicKey, payload, sig []byte) error {
+	h := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(key, h[:], sig) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// withPresence sends an APDU with ins, p1 and data until the device stops asking for user presence, or ctx is done.
+func (d *Device) withPresence(ctx context.Context, ins, p1 uint8, data []byte) ([]byte, error) {
+	ticker := time.NewTicker(presencePollInterval)
+	defer ticker.Stop()
+
+	for {
+		resp, err := d.APDU(ins, p1, 0, data)
+		if !errors.Is(err, ErrConditionNotSatisfied) {
+			return resp, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("user presence not confirmed, %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gsora/fidati/u2fhid"
+)
+
+// u2fDevice is a minimal U2F device, which requires presence to be requested once before each registration and
+// authentication succeeds.
+type u2fDevice struct {
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+
+	key       *ecdsa.PrivateKey
+	keyHandle []byte
+
+	asked   bool
+	counter uint32
+}
+
+func newU2FDevice(t *testing.T) *u2fDevice {
+	attKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "test"}}, &attKey.PublicKey, attKey)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &u2fDevice{
+		attestationKey:  attKey,
+		attestationCert: cert,
+		key:             key,
+		keyHandle:       []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+}
+
+func (u *u2fDevice) respond(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+	resp, sw := u.handle(data)
+
+	var sb [2]byte
+	binary.BigEndian.PutUint16(sb[:], uint16(sw))
+
+	return mustFragment(channel, cmd, append(resp, sb[:]...))
+}
+
+func (u *u2fDevice) handle(apdu []byte) ([]byte, StatusError) {
+	if apdu[0] != 0 {
+		return nil, ErrClaNotSupported
+	}
+
+	var data []byte
+	if len(apdu) > 7 {
+		data = apdu[7 : 7+binary.BigEndian.Uint16(apdu[5:7])]
+	}
+
+	sign := func(key *ecdsa.PrivateKey, payload []byte) []byte {
+		h := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+		if err != nil {
+			panic(err)
+		}
+
+		return sig
+	}
+
+	switch apdu[1] {
+	case insVersion:
+		return []byte("U2F_V2"), statusNoError
+	case insRegister:
+		if !u.asked {
+			u.asked = true
+			return nil, ErrConditionNotSatisfied
+		}
+
+		pub := elliptic.Marshal(elliptic.P256(), u.key.X, u.key.Y)
+
+		resp := append([]byte{0x05}, pub...)
+		resp = append(resp, uint8(len(u.keyHandle)))
+		resp = append(resp, u.keyHandle...)
+		resp = append(resp, u.attestationCert...)
+
+		payload := append([]byte{0}, data[32:]...)
+		payload = append(payload, data[:32]...)
+		payload = append(payload, u.keyHandle...)
+		payload = append(payload, pub...)
+
+		return append(resp, sign(u.attestationKey, payload)...), statusNoError
+	case insAuthenticate:
+		if !bytes.Equal(data[65:], u.keyHandle) {
+			return nil, ErrWrongData
+		}
+
+		if apdu[2] == controlCheckOnly || !u.asked {
+			u.asked = true
+			return nil, ErrConditionNotSatisfied
+		}
+
+		u.counter++
+
+		resp := []byte{1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(resp[1:], u.counter)
+
+		payload := append(append([]byte{}, data[32:64]...), resp...)
+		payload = append(payload, data[:32]...)
+
+		return append(resp, sign(u.key, payload)...), statusNoError
+	default:
+		return nil, ErrInsNotSupported
+	}
+}
+
+func Test_buildAPDU(t *testing.T) {
+	require.Equal(t, []byte{0, 3, 0, 0, 0, 0, 0}, buildAPDU(insVersion, 0, 0, nil))
+	require.Equal(t, []byte{0, 2, 7, 0, 0, 0, 2, 42, 43, 0, 0}, buildAPDU(insAuthenticate, 7, 0, []byte{42, 43}))
+}
+
+func TestDevice_APDU(t *testing.T) {
+	d, err := Open(newFakeDevice(newU2FDevice(t).respond))
+	require.NoError(t, err)
+
+	v, err := d.Version()
+	require.NoError(t, err)
+	require.Equal(t, "U2F_V2", v)
+
+	_, err = d.APDU(0x42, 0, 0, nil)
+	require.True(t, errors.Is(err, ErrInsNotSupported))
+	require.Contains(t, err.Error(), "0x6D00")
+
+	// responses sent two bytes at a time, the rest fetched with GET RESPONSE
+	rest := []byte("U2F_V2")
+	chained := func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+		if data[1] != insVersion && data[1] != insGetResponse {
+			return mustFragment(channel, cmd, []byte{0x6D, 0x00})
+		}
+
+		resp := append([]byte{}, rest[:2]...)
+		rest = rest[2:]
+
+		if len(rest) == 0 {
+			return mustFragment(channel, cmd, append(resp, 0x90, 0x00))
+		}
+
+		return mustFragment(channel, cmd, append(resp, swBytesRemaining, uint8(len(rest))))
+	}
+
+	d, err = Open(newFakeDevice(chained))
+	require.NoError(t, err)
+
+	v, err = d.Version()
+	require.NoError(t, err)
+	require.Equal(t, "U2F_V2", v)
+}
+
+func TestDevice_RegisterAuthenticate(t *testing.T) {
+	u := newU2FDevice(t)
+
+	d, err := Open(newFakeDevice(u.respond))
+	require.NoError(t, err)
+
+	challenge := bytes.Repeat([]byte{1}, 32)
+	application := bytes.Repeat([]byte{2}, 32)
+
+	reg, err := d.Register(context.Background(), challenge, application)
+	require.NoError(t, err)
+	require.Equal(t, u.keyHandle, reg.KeyHandle)
+	require.Equal(t, u.attestationCert, reg.AttestationCertificate)
+	require.NoError(t, reg.Verify(challenge, application))
+	require.Error(t, reg.Verify(application, challenge))
+
+	ok, err := d.CheckKeyHandle(challenge, application, reg.KeyHandle)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = d.CheckKeyHandle(challenge, application, []byte{42})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	u.asked = false
+
+	a, err := d.Authenticate(context.Background(), challenge, application, reg.KeyHandle)
+	require.NoError(t, err)
+	require.Equal(t, uint8(1), a.UserPresence)
+	require.Equal(t, uint32(1), a.Counter)
+	require.NoError(t, a.Verify(reg.PublicKey, challenge, application))
+	require.Error(t, a.Verify(reg.PublicKey, application, challenge))
+
+	_, err = d.Authenticate(context.Background(), challenge, application, []byte{42})
+	require.True(t, errors.Is(err, ErrWrongData))
+}
+
+func TestDevice_Register(t *testing.T) {
+	tests := []test{
+		{
+			"wrong parameter length",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(newU2FDevice(t).respond))
+				require.NoError(t, err)
+
+				_, err = d.Register(context.Background(), []byte{1}, make([]byte, 32))
+				require.Error(t, err)
+			},
+		},
+		{
+			"presence never confirmed",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+					return mustFragment(channel, cmd, []byte{0x69, 0x85})
+				}))
+				require.NoError(t, err)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 3*presencePollInterval)
+				defer cancel()
+
+				_, err = d.Register(ctx, make([]byte, 32), make([]byte, 32))
+				require.True(t, errors.Is(err, context.DeadlineExceeded))
+			},
+		},
+		{
+			"malformed response",
+			func(t *testing.T) {
+				d, err := Open(newFakeDevice(func(channel uint32, cmd u2fhid.Command, data []byte) [][]byte {
+					return mustFragment(channel, cmd, []byte{0x05, 1, 2, 3, 0x90, 0x00})
+				}))
+				require.NoError(t, err)
+
+				_, err = d.Register(context.Background(), make([]byte, 32), make([]byte, 32))
+				require.Error(t, err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
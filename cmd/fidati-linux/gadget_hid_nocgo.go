@@ -0,0 +1,16 @@
+// +build !cgo
+
+package main
+
+import "errors"
+
+// errNoGadget is returned by the gadget backend when fidati-linux is built without cgo, which libusbgx requires.
+var errNoGadget = errors.New("gadget backend unavailable, fidati-linux was built without cgo")
+
+func configureHidg(_ string) error {
+	return errNoGadget
+}
+
+func cleanupHidg(_ string) error {
+	return errNoGadget
+}
@@ -5,14 +5,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/gsora/fidati/counter"
+	"github.com/gsora/fidati/ctap2"
 	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+	"github.com/gsora/fidati/storage"
 	"github.com/gsora/fidati/u2fhid"
 	"github.com/gsora/fidati/u2ftoken"
 	"github.com/rakyll/statik/fs"
@@ -20,7 +24,20 @@ import (
 	_ "github.com/gsora/fidati/cmd/fidati-linux/certs"
 )
 
+// counters disk image geometry: a journal of 8 slots, 4 blocks each
+const (
+	countersBlockSize  = 512
+	countersBlocks     = 32
+	countersSlotBlocks = 4
+)
+
 var (
+	// Build is a string which contains build user, host and date.
+	Build string
+
+	// Revision contains the git revision (last hash and/or tag).
+	Revision string
+
 	// X.509 attestation certificate, sent along in registration requests
 	attestationCertificate []byte
 
@@ -28,55 +45,105 @@ var (
 	attestationPrivkey []byte
 )
 
-func cliArgs() (hidg, configfsPath string, mustClean bool) {
-	flag.StringVar(&hidg, "hidg", "/dev/hidg0", "/dev/hidgX file descriptor path")
-	flag.StringVar(&configfsPath, "configfs-path", "/sys/kernel/config", "configfs path")
-	flag.BoolVar(&mustClean, "clean", false, "clean existing hidg descriptors and exit")
+// args holds the command line arguments.
+type args struct {
+	backend         string
+	hidg            string
+	uhid            string
+	configfsPath    string
+	credentialsPath string
+	pinPath         string
+	countersPath    string
+	globalCounter   bool
+	presence        string
+	presenceCommand string
+	winkCommand     string
+	mustClean       bool
+}
+
+func cliArgs() args {
+	var a args
+
+	flag.StringVar(&a.backend, "backend", "gadget", "HID device backend: gadget, a USB gadget created with configfs, or uhid, a virtual device created with /dev/uhid")
+	flag.StringVar(&a.hidg, "hidg", "/dev/hidg0", "/dev/hidgX file descriptor path")
+	flag.StringVar(&a.uhid, "uhid", "/dev/uhid", "UHID character device path, used with -backend=uhid")
+	flag.StringVar(&a.configfsPath, "configfs-path", "/sys/kernel/config", "configfs path")
+	flag.StringVar(&a.credentialsPath, "credentials", "", "resident credentials file path, resident credentials are disabled if empty")
+	flag.StringVar(&a.pinPath, "pin", "", "client PIN state file path, client PIN is disabled if empty")
+	flag.StringVar(&a.countersPath, "counters", "", "signature counters disk image path, counters are kept in memory if empty")
+	flag.BoolVar(&a.globalCounter, "global-counter", false, "use a single signature counter for all credentials")
+	flag.StringVar(&a.presence, "presence", "terminal", "user presence test: terminal, command or always")
+	flag.StringVar(&a.presenceCommand, "presence-command", "", "shell command confirming user presence when it exits successfully, used with -presence=command")
+	flag.StringVar(&a.winkCommand, "wink-command", "", "shell command run when the host asks the token to identify itself, a message is logged if empty")
+	flag.BoolVar(&a.mustClean, "clean", false, "clean existing hidg descriptors and exit")
 	flag.Parse()
 
-	return
+	return a
 }
 
 func main() {
-	hidg, configfsPath, mustClean := cliArgs()
+	a := cliArgs()
 
-	if mustClean {
-		if err := cleanupHidg(configfsPath); err != nil {
+	if a.mustClean {
+		if err := cleanupHidg(a.configfsPath); err != nil {
 			panic(err)
 		}
 
 		return
 	}
 
-	if err := configureHidg(configfsPath); err != nil {
-		panic(err)
-	}
+	log.Printf("fidati-linux %s %s", Revision, Build)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	readCertPrivkey()
 
-	hidRx, err := os.OpenFile(hidg, os.O_RDWR, 0666)
+	hidRx, cleanup, err := openDevice(a)
+	notErr(err)
+
+	log.Println("UHID device opened")
+	c, err := newCounters(a.countersPath, a.globalCounter)
 	notErr(err)
 
-	log.Println("done, polling...")
-	d := &dumbCounter{}
-	k := genKeyring(attestationPrivkey, d)
+	k := genKeyring(attestationPrivkey, c)
+
+	if a.credentialsPath != "" {
+		credentials, err := keyring.NewCredentialStore(&fileStorage{path: a.credentialsPath})
+		notErr(err)
+
+		k.Credentials = credentials
+	}
+
+	up, err := userPresence(a.presence, a.presenceCommand)
+	notErr(err)
 
-	token, err := u2ftoken.New(k, attestationCertificate, attestationPrivkey)
+	token, err := u2ftoken.New(k, up, attestationCertificate, attestationPrivkey)
 	notErr(err)
 
-	hid, err := u2fhid.NewHandler(token)
+	var ctapOpts []ctap2.Option
+	if a.pinPath != "" {
+		ctapOpts = append(ctapOpts, ctap2.WithPIN(&fileStorage{path: a.pinPath}))
+	}
+
+	authenticator, err := ctap2.New(k, up, attestationCertificate, attestationPrivkey, ctapOpts...)
 	notErr(err)
 
-	// add 50ms delay in both rx and tx
-	// we don't wanna burn laptop cpus :^)
+	hidOpts := []u2fhid.Option{
+		u2fhid.WithCBOR(authenticator),
+		u2fhid.WithWinker(&winker{command: a.winkCommand}),
+	}
+
+	if info, ok := u2fhid.DeviceInfoFromRevision(Revision); ok {
+		hidOpts = append(hidOpts, u2fhid.WithDeviceInfo(info))
+	}
 
-	// rx
+	hid, err := u2fhid.NewHandler(token, hidOpts...)
+	notErr(err)
+
+	// rx, reads block until the host sends a report
 	go func() {
 		for {
-			time.Sleep(50 * time.Millisecond)
 			buf := make([]byte, 64)
 			_, err := hidRx.Read(buf)
 			notErr(err)
@@ -89,20 +156,10 @@ func main() {
 		}
 	}()
 
+	// tx, responses are written as soon as they're ready
 	go func() {
-		for {
-			time.Sleep(50 * time.Millisecond)
-			data, err := hid.Tx(nil, nil)
-			if err != nil {
-				log.Println("tx error:", err)
-				continue
-			}
-
-			if data == nil {
-				continue
-			}
-
-			_, err = hidRx.Write(data)
+		for data := range hid.Outbound() {
+			_, err := hidRx.Write(data)
 			notErr(err)
 		}
 	}()
@@ -114,11 +171,43 @@ func main() {
 	fmt.Println()
 	log.Println("cleaning...")
 
-	if err := cleanupHidg(configfsPath); err != nil {
+	hid.Close()
+
+	if err := cleanup(); err != nil {
 		panic(err)
 	}
 }
 
+// openDevice opens the HID device of the backend selected by a, and returns it along with the function which
+// tears it down.
+func openDevice(a args) (io.ReadWriter, func() error, error) {
+	switch a.backend {
+	case "gadget":
+		if err := configureHidg(a.configfsPath); err != nil {
+			return nil, nil, err
+		}
+
+		f, err := os.OpenFile(a.hidg, os.O_RDWR, 0666)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return f, func() error {
+			f.Close()
+			return cleanupHidg(a.configfsPath)
+		}, nil
+	case "uhid":
+		d, err := newUHIDDevice(a.uhid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return d, d.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown backend %q", a.backend)
+	}
+}
+
 func genKeyring(secret []byte, counter keyring.Counter) *keyring.Keyring {
 	return keyring.New(secret, counter)
 }
@@ -150,15 +239,47 @@ func notErr(e error) {
 	}
 }
 
-type dumbCounter struct {
-	i uint32
-}
+// newCounters returns counters persisted in a journal held by the disk image at path,
+// or in memory if path is empty.
+func newCounters(path string, global bool) (*counter.Counters, error) {
+	var s keyring.Storage = &memStorage{}
+	if path != "" {
+		img, err := storage.OpenFile(path, countersBlockSize, countersBlocks)
+		if err != nil {
+			return nil, err
+		}
+
+		j, err := storage.NewJournal(img, 0, countersBlocks, countersSlotBlocks)
+		if err != nil {
+			return nil, err
+		}
+
+		s = j
+	}
+
+	var opts []counter.Option
+	if global {
+		opts = append(opts, counter.Global())
+	}
 
-func (d *dumbCounter) Increment(appID []byte, challenge []byte, keyHandle []byte) (uint32, error) {
-	d.i++
-	return d.i, nil
+	return counter.New(s, opts...)
 }
 
-func (d *dumbCounter) UserPresence() bool {
-	return true
+// userPresence returns the presence.Provider selected by mode.
+func userPresence(mode, command string) (presence.Provider, error) {
+	switch mode {
+	case "terminal":
+		return newTerminalPresence(os.Stdin), nil
+	case "command":
+		if command == "" {
+			return nil, fmt.Errorf("-presence-command is required with -presence=command")
+		}
+
+		return &commandPresence{command: command}, nil
+	case "always":
+		log.Println("WARNING: user presence is always confirmed, any local process can use the token")
+		return presence.Always, nil
+	default:
+		return nil, fmt.Errorf("unknown presence mode %q", mode)
+	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+
+	"github.com/gsora/fidati/presence"
+)
+
+// terminalPresence confirms user presence when enter is pressed on the terminal.
+type terminalPresence struct {
+	signal *presence.Signal
+}
+
+func newTerminalPresence(in io.Reader) *terminalPresence {
+	t := &terminalPresence{
+		signal: presence.NewSignal(),
+	}
+
+	go func() {
+		s := bufio.NewScanner(in)
+		for s.Scan() {
+			t.signal.Confirm()
+		}
+	}()
+
+	return t
+}
+
+// Wait implements the presence.Provider interface.
+func (t *terminalPresence) Wait(ctx context.Context) error {
+	log.Println("user presence requested, press enter to confirm")
+	return t.signal.Wait(ctx)
+}
+
+// commandPresence confirms user presence by running a shell command, like a desktop notification helper:
+// presence is confirmed if the command exits successfully.
+type commandPresence struct {
+	command string
+}
+
+// Wait implements the presence.Provider interface.
+func (c *commandPresence) Wait(ctx context.Context) error {
+	err := exec.CommandContext(ctx, "/bin/sh", "-c", c.command).Run()
+
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		return fmt.Errorf("%w, presence command failed: %v", presence.ErrDenied, err)
+	default:
+		return nil
+	}
+}
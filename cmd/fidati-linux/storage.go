@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// fileStorage is a keyring.Storage backed by a file.
+type fileStorage struct {
+	path string
+}
+
+func (f *fileStorage) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+func (f *fileStorage) Store(b []byte) error {
+	// write to a temporary file first, so that a crash never leaves a half-written store behind
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, f.path)
+}
+
+// memStorage is a keyring.Storage which holds data in memory.
+type memStorage struct {
+	data []byte
+}
+
+func (m *memStorage) Load() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *memStorage) Store(b []byte) error {
+	m.data = append([]byte{}, b...)
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/gsora/fidati/u2fhid"
+)
+
+// UHID event types, as defined in linux/uhid.h.
+const (
+	uhidDestroy        uint32 = 1
+	uhidStart          uint32 = 2
+	uhidStop           uint32 = 3
+	uhidOpen           uint32 = 4
+	uhidClose          uint32 = 5
+	uhidOutput         uint32 = 6
+	uhidGetReport      uint32 = 9
+	uhidGetReportReply uint32 = 10
+	uhidCreate2        uint32 = 11
+	uhidInput2         uint32 = 12
+	uhidSetReport      uint32 = 13
+	uhidSetReportReply uint32 = 14
+)
+
+const (
+	// uhidDataMax is the maximum size of reports and report descriptors.
+	uhidDataMax = 4096
+
+	// uhidEventLen is the size of struct uhid_event: the event type, followed by the largest request,
+	// struct uhid_create2_req.
+	uhidEventLen = 4 + 128 + 64 + 64 + 2 + 2 + 4 + 4 + 4 + 4 + uhidDataMax
+
+	// busUSB is the bus type of the virtual device.
+	busUSB = 0x03
+
+	// eio is the error sent back to the kernel for GET_REPORT and SET_REPORT requests, which FIDO devices
+	// don't handle.
+	eio = 5
+
+	// hidReportLen is the length of the reports exchanged with the host.
+	hidReportLen = 64
+)
+
+// uhidCreate2Req is struct uhid_create2_req, which describes the virtual device to the kernel.
+type uhidCreate2Req struct {
+	Name    [128]byte
+	Phys    [64]byte
+	Uniq    [64]byte
+	RDSize  uint16
+	Bus     uint16
+	Vendor  uint32
+	Product uint32
+	Version uint32
+	Country uint32
+	RDData  [uhidDataMax]byte
+}
+
+// uhidDevice is a virtual HID device created through the Linux UHID interface, which reads and writes
+// 64 bytes reports.
+// It doesn't need any USB device controller: the host sees it as a regular hidraw device.
+type uhidDevice struct {
+	f *os.File
+
+	// writeLock serializes event writes, which come from both Read and Write
+	writeLock sync.Mutex
+}
+
+// newUHIDDevice creates a virtual FIDO HID device through the UHID character device at path.
+func newUHIDDevice(path string) (*uhidDevice, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open UHID device, %w", err)
+	}
+
+	req := uhidCreate2Req{
+		RDSize:  uint16(len(u2fhid.DefaultReport)),
+		Bus:     busUSB,
+		Vendor:  0x1209,
+		Product: 0x2702,
+	}
+
+	copy(req.Name[:], "gsora fidati desktop")
+	copy(req.Uniq[:], "4242424242")
+	copy(req.RDData[:], u2fhid.DefaultReport.Bytes())
+
+	u := &uhidDevice{f: f}
+
+	if err := u.write(uhidCreate2, req); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot create UHID device, %w", err)
+	}
+
+	return u, nil
+}
+
+// Read reads the next report sent by the host into b, handling all the other UHID events in the meantime.
+func (u *uhidDevice) Read(b []byte) (int, error) {
+	ev := make([]byte, uhidEventLen)
+
+	for {
+		n, err := u.f.Read(ev)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read UHID event, %w", err)
+		}
+
+		if n < 4 {
+			return 0, fmt.Errorf("UHID event is %d bytes long", n)
+		}
+
+		payload := ev[4:n]
+
+		switch t := binary.LittleEndian.Uint32(ev); t {
+		case uhidStart:
+			log.Println("uhid: device started")
+		case uhidStop:
+			log.Println("uhid: device stopped")
+		case uhidOpen:
+			log.Println("uhid: device opened by the host")
+		case uhidClose:
+			log.Println("uhid: device closed by the host")
+		case uhidOutput:
+			report, err := outputReport(payload)
+			if err != nil {
+				log.Println("uhid:", err)
+				continue
+			}
+
+			return copy(b, report), nil
+		case uhidGetReport:
+			if err := u.replyReport(uhidGetReportReply, payload); err != nil {
+				return 0, err
+			}
+		case uhidSetReport:
+			if err := u.replyReport(uhidSetReportReply, payload); err != nil {
+				return 0, err
+			}
+		default:
+			log.Printf("uhid: ignoring event %d", t)
+		}
+	}
+}
+
+// outputReport returns the report carried by payload, a struct uhid_output_req.
+func outputReport(payload []byte) ([]byte, error) {
+	if len(payload) < uhidDataMax+2 {
+		return nil, errors.New("output event too short")
+	}
+
+	size := int(binary.LittleEndian.Uint16(payload[uhidDataMax:]))
+	if size > uhidDataMax {
+		return nil, fmt.Errorf("output report is %d bytes long", size)
+	}
+
+	report := payload[:size]
+
+	// hidraw writes are prefixed by the report number, zero since the report descriptor defines none
+	if size == hidReportLen+1 {
+		report = report[1:]
+	}
+
+	if len(report) != hidReportLen {
+		return nil, fmt.Errorf("output report is %d bytes long, expected %d", len(report), hidReportLen)
+	}
+
+	return report, nil
+}
+
+// replyReport rejects the GET_REPORT or SET_REPORT request carried by payload with a reply event of type t, so
+// that the kernel doesn't wait for it to time out.
+func (u *uhidDevice) replyReport(t uint32, payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("report request event too short")
+	}
+
+	reply := struct {
+		ID  uint32
+		Err uint16
+	}{
+		ID:  binary.LittleEndian.Uint32(payload),
+		Err: eio,
+	}
+
+	return u.write(t, reply)
+}
+
+// Write sends b to the host as an input report.
+func (u *uhidDevice) Write(b []byte) (int, error) {
+	if len(b) > uhidDataMax {
+		return 0, fmt.Errorf("report is %d bytes long, maximum is %d", len(b), uhidDataMax)
+	}
+
+	req := struct {
+		Size uint16
+		Data [uhidDataMax]byte
+	}{
+		Size: uint16(len(b)),
+	}
+
+	copy(req.Data[:], b)
+
+	if err := u.write(uhidInput2, req); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close destroys the virtual device.
+func (u *uhidDevice) Close() error {
+	err := u.write(uhidDestroy, struct{}{})
+	if cerr := u.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// write writes an event of type t, carrying req.
+// UHID uses the host byte order, which is little endian on all the platforms fidati-linux runs on.
+func (u *uhidDevice) write(t uint32, req interface{}) error {
+	b := new(bytes.Buffer)
+	b.Grow(uhidEventLen)
+
+	if err := binary.Write(b, binary.LittleEndian, t); err != nil {
+		return err
+	}
+
+	if err := binary.Write(b, binary.LittleEndian, req); err != nil {
+		return fmt.Errorf("cannot serialize UHID event, %w", err)
+	}
+
+	ev := make([]byte, uhidEventLen)
+	copy(ev, b.Bytes())
+
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+
+	if _, err := u.f.Write(ev); err != nil {
+		return fmt.Errorf("cannot write UHID event, %w", err)
+	}
+
+	return nil
+}
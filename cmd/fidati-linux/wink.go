@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+)
+
+// winker identifies fidati-linux when the host asks for a wink, by running a shell command or, if there's none,
+// logging a message.
+type winker struct {
+	command string
+}
+
+// Wink implements the u2fhid.Winker interface.
+func (w *winker) Wink() {
+	if w.command == "" {
+		log.Println("wink requested, the host is talking to this token")
+		return
+	}
+
+	go func() {
+		if err := exec.Command("/bin/sh", "-c", w.command).Run(); err != nil {
+			log.Println("wink command failed:", err)
+		}
+	}()
+}
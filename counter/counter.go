@@ -0,0 +1,232 @@
+// Package counter implements persistent signature counters, as required by FIDO U2F and CTAP2.
+//
+// By default an independent counter is kept for each appID and key handle pair, so that counter
+// values can't be used to correlate a user across relying parties.
+// Counters are held in a bounded table: when the table is full the least recently used counter is evicted,
+// and its value becomes the floor from which new counters start, so that no counter ever goes backwards.
+package counter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gsora/fidati/keyring"
+)
+
+// DefaultMaxEntries is the default maximum number of counters held in a Counters table.
+const DefaultMaxEntries = 64
+
+// idLen is the length of a counter identifier, a truncated SHA-256 hash of appID and key handle.
+const idLen = 16
+
+// storedCountersVersion is the current counters serialization format version.
+const storedCountersVersion = 1
+
+// ErrOverflow is returned when a counter reached its maximum value, and can't be incremented anymore.
+var ErrOverflow = errors.New("counter overflow")
+
+// entry is a single counter.
+type entry struct {
+	ID    []byte `cbor:"1,keyasint"`
+	Value uint32 `cbor:"2,keyasint"`
+}
+
+// storedCounters is the on-storage representation of a Counters table.
+// Entries are ordered from the least to the most recently used.
+type storedCounters struct {
+	Version uint    `cbor:"1,keyasint"`
+	Floor   uint32  `cbor:"2,keyasint"`
+	Entries []entry `cbor:"3,keyasint,omitempty"`
+}
+
+// Counters is a table of signature counters, persisted on a keyring.Storage.
+// It implements the Increment method of keyring.Counter.
+type Counters struct {
+	storage    keyring.Storage
+	global     bool
+	maxEntries int
+
+	// floor is the value every new counter starts from.
+	// In global mode it's the only counter.
+	floor   uint32
+	entries []entry
+	lock    sync.Mutex
+}
+
+// Option is a functional option used to configure Counters.
+type Option func(*Counters) error
+
+// Global makes Counters keep a single counter shared by all the credentials, like U2F tokens
+// usually do.
+func Global() Option {
+	return func(c *Counters) error {
+		c.global = true
+		return nil
+	}
+}
+
+// WithMaxEntries sets the maximum number of counters held by Counters.
+func WithMaxEntries(n int) Option {
+	return func(c *Counters) error {
+		if n <= 0 {
+			return fmt.Errorf("maximum number of entries must be positive, got %d", n)
+		}
+
+		c.maxEntries = n
+		return nil
+	}
+}
+
+// WithInitialValue makes new counters start from at least v, useful when migrating from a
+// previous counter implementation whose values must not be reused.
+func WithInitialValue(v uint32) Option {
+	return func(c *Counters) error {
+		if c.floor < v {
+			c.floor = v
+		}
+
+		return nil
+	}
+}
+
+// New returns Counters persisting data on s.
+// Existing counters are loaded from s.
+func New(s keyring.Storage, opts ...Option) (*Counters, error) {
+	if s == nil {
+		return nil, errors.New("storage is nil")
+	}
+
+	data, err := s.Load()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load counters, %w", err)
+	}
+
+	c := &Counters{
+		storage:    s,
+		maxEntries: DefaultMaxEntries,
+	}
+
+	if data != nil {
+		var sc storedCounters
+		if err := cbor.Unmarshal(data, &sc); err != nil {
+			return nil, fmt.Errorf("cannot decode counters, %w", err)
+		}
+
+		if sc.Version != storedCountersVersion {
+			return nil, fmt.Errorf("unsupported counters format version %d", sc.Version)
+		}
+
+		c.floor = sc.Floor
+		c.entries = sc.Entries
+	}
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.global {
+		// switching to global mode must not make any counter go backwards
+		for _, e := range c.entries {
+			if e.Value > c.floor {
+				c.floor = e.Value
+			}
+		}
+
+		c.entries = nil
+	}
+
+	for len(c.entries) > c.maxEntries {
+		c.evict()
+	}
+
+	return c, nil
+}
+
+// Increment increments the counter associated with appID and keyHandle, and returns its new value.
+// challenge is ignored.
+func (c *Counters) Increment(appID, _, keyHandle []byte) (uint32, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.global {
+		if c.floor == math.MaxUint32 {
+			return 0, ErrOverflow
+		}
+
+		c.floor++
+		return c.floor, c.persist()
+	}
+
+	e := entry{
+		ID:    counterID(appID, keyHandle),
+		Value: c.floor,
+	}
+
+	idx := -1
+	for i, ee := range c.entries {
+		if bytes.Equal(ee.ID, e.ID) {
+			idx = i
+			e.Value = ee.Value
+			break
+		}
+	}
+
+	if e.Value == math.MaxUint32 {
+		return 0, ErrOverflow
+	}
+
+	e.Value++
+
+	if idx != -1 {
+		c.entries = append(c.entries[:idx], c.entries[idx+1:]...)
+	}
+
+	// most recently used entries are kept at the end of the table
+	c.entries = append(c.entries, e)
+	for len(c.entries) > c.maxEntries {
+		c.evict()
+	}
+
+	return e.Value, c.persist()
+}
+
+// evict removes the least recently used counter, raising the floor to its value.
+func (c *Counters) evict() {
+	if c.entries[0].Value > c.floor {
+		c.floor = c.entries[0].Value
+	}
+
+	c.entries = c.entries[1:]
+}
+
+// persist saves the counters table.
+func (c *Counters) persist() error {
+	data, err := cbor.Marshal(storedCounters{
+		Version: storedCountersVersion,
+		Floor:   c.floor,
+		Entries: c.entries,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot encode counters, %w", err)
+	}
+
+	return c.storage.Store(data)
+}
+
+// counterID returns the identifier of the counter associated with appID and keyHandle.
+func counterID(appID, keyHandle []byte) []byte {
+	h := sha256.New()
+
+	// appID is always a SHA-256 hash, so there's no ambiguity in the concatenation
+	h.Write(appID)
+	h.Write(keyHandle)
+
+	return h.Sum(nil)[:idLen]
+}
@@ -0,0 +1,196 @@
+package counter_test
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/gsora/fidati/counter"
+	"github.com/stretchr/testify/require"
+)
+
+type memStorage struct {
+	data []byte
+	err  error
+}
+
+func (m *memStorage) Load() ([]byte, error) {
+	return m.data, m.err
+}
+
+func (m *memStorage) Store(b []byte) error {
+	if m.err != nil {
+		return m.err
+	}
+
+	m.data = append([]byte{}, b...)
+	return nil
+}
+
+func appID(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func increment(t *testing.T, c *counter.Counters, app string, kh []byte) uint32 {
+	v, err := c.Increment(appID(app), nil, kh)
+	require.NoError(t, err)
+	return v
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage *memStorage
+		opts    []counter.Option
+		wantErr bool
+	}{
+		{
+			"nil storage",
+			nil,
+			nil,
+			true,
+		},
+		{
+			"empty storage",
+			&memStorage{},
+			nil,
+			false,
+		},
+		{
+			"storage error",
+			&memStorage{err: errors.New("error")},
+			nil,
+			true,
+		},
+		{
+			"garbage in storage",
+			&memStorage{data: []byte{0xff, 0x01}},
+			nil,
+			true,
+		},
+		{
+			"invalid max entries",
+			&memStorage{},
+			[]counter.Option{counter.WithMaxEntries(0)},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.storage == nil {
+				_, err = counter.New(nil, tt.opts...)
+			} else {
+				_, err = counter.New(tt.storage, tt.opts...)
+			}
+
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCounters_Increment(t *testing.T) {
+	t.Run("independent counters", func(t *testing.T) {
+		c, err := counter.New(&memStorage{})
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(1), increment(t, c, "a", []byte{1}))
+		require.Equal(t, uint32(2), increment(t, c, "a", []byte{1}))
+		require.Equal(t, uint32(1), increment(t, c, "b", []byte{1}))
+		require.Equal(t, uint32(1), increment(t, c, "a", []byte{2}))
+		require.Equal(t, uint32(3), increment(t, c, "a", []byte{1}))
+	})
+
+	t.Run("counters are persisted", func(t *testing.T) {
+		s := &memStorage{}
+		c, err := counter.New(s)
+		require.NoError(t, err)
+
+		increment(t, c, "a", []byte{1})
+		increment(t, c, "a", []byte{1})
+		increment(t, c, "b", []byte{1})
+
+		c, err = counter.New(s)
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(3), increment(t, c, "a", []byte{1}))
+		require.Equal(t, uint32(2), increment(t, c, "b", []byte{1}))
+	})
+
+	t.Run("eviction never makes counters go backwards", func(t *testing.T) {
+		c, err := counter.New(&memStorage{}, counter.WithMaxEntries(2))
+		require.NoError(t, err)
+
+		for i := 0; i < 5; i++ {
+			increment(t, c, "a", nil)
+		}
+
+		increment(t, c, "b", nil)
+		increment(t, c, "b", nil)
+
+		// "a" is the least recently used counter, and gets evicted
+		require.Equal(t, uint32(1), increment(t, c, "c", nil))
+		require.Equal(t, uint32(6), increment(t, c, "a", nil))
+
+		// "b" was evicted by "a", new counters start after the highest evicted value
+		require.Equal(t, uint32(6), increment(t, c, "d", nil))
+		require.Equal(t, uint32(6), increment(t, c, "b", nil))
+	})
+
+	t.Run("recently used counters are kept", func(t *testing.T) {
+		c, err := counter.New(&memStorage{}, counter.WithMaxEntries(2))
+		require.NoError(t, err)
+
+		increment(t, c, "a", nil)
+		increment(t, c, "a", nil)
+		increment(t, c, "b", nil)
+		increment(t, c, "a", nil)
+
+		// "b" is evicted
+		increment(t, c, "c", nil)
+		require.Equal(t, uint32(4), increment(t, c, "a", nil))
+	})
+
+	t.Run("global mode", func(t *testing.T) {
+		s := &memStorage{}
+		c, err := counter.New(s)
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			increment(t, c, "a", nil)
+		}
+
+		increment(t, c, "b", nil)
+
+		c, err = counter.New(s, counter.Global())
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(4), increment(t, c, "b", nil))
+		require.Equal(t, uint32(5), increment(t, c, "c", nil))
+	})
+
+	t.Run("initial value", func(t *testing.T) {
+		c, err := counter.New(&memStorage{}, counter.WithInitialValue(41))
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(42), increment(t, c, "a", nil))
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		c, err := counter.New(&memStorage{}, counter.WithInitialValue(math.MaxUint32-1))
+		require.NoError(t, err)
+
+		require.Equal(t, uint32(math.MaxUint32), increment(t, c, "a", nil))
+
+		_, err = c.Increment(appID("a"), nil, nil)
+		require.ErrorIs(t, err, counter.ErrOverflow)
+	})
+}
@@ -0,0 +1,99 @@
+package ctap2
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// flagUserPresent is set in the authenticator data flags when the user was present.
+	flagUserPresent uint8 = 0x01
+
+	// flagUserVerified is set in the authenticator data flags when the user was verified.
+	flagUserVerified uint8 = 0x04
+
+	// flagAttestedCredentialData is set in the authenticator data flags when attested credential
+	// data is included.
+	flagAttestedCredentialData uint8 = 0x40
+)
+
+const (
+	// coseKeyTypeEC2 is the COSE key type for elliptic curve keys with x and y coordinates.
+	coseKeyTypeEC2 = 2
+
+	// coseCurveP256 is the COSE elliptic curve identifier for P-256.
+	coseCurveP256 = 1
+)
+
+// coseKey represents an EC2 public key in COSE_Key format.
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Alg int    `cbor:"3,keyasint"`
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+	Y   []byte `cbor:"-3,keyasint"`
+}
+
+// newCOSEKey returns the COSE_Key representation of the P-256 public key pk.
+func newCOSEKey(pk *ecdsa.PublicKey) coseKey {
+	// elliptic.Marshal returns 0x04 || X || Y, with both coordinates zero-padded to 32 bytes.
+	raw := elliptic.Marshal(elliptic.P256(), pk.X, pk.Y)
+
+	return coseKey{
+		Kty: coseKeyTypeEC2,
+		Alg: algES256,
+		Crv: coseCurveP256,
+		X:   raw[1:33],
+		Y:   raw[33:65],
+	}
+}
+
+// attestedCredentialData returns the attested credential data for a credential with ID credID and
+// public key pk.
+func attestedCredentialData(credID []byte, pk *ecdsa.PublicKey) ([]byte, error) {
+	if len(credID) > 0xffff {
+		return nil, fmt.Errorf("credential ID is %d bytes long, too big", len(credID))
+	}
+
+	key, err := encMode.Marshal(newCOSEKey(pk))
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode credential public key, %w", err)
+	}
+
+	ret := new(bytes.Buffer)
+	ret.Write(AAGUID[:])
+
+	credIDLen := [2]byte{}
+	binary.BigEndian.PutUint16(credIDLen[:], uint16(len(credID)))
+	ret.Write(credIDLen[:])
+
+	ret.Write(credID)
+	ret.Write(key)
+
+	return ret.Bytes(), nil
+}
+
+// authenticatorData returns the authenticator data structure for a given relying party ID hash, flags and
+// signature counter.
+// If attestedCredData is not nil, it is appended to the structure and flagAttestedCredentialData is set.
+func authenticatorData(rpIDHash []byte, flags uint8, counter uint32, attestedCredData []byte) []byte {
+	if attestedCredData != nil {
+		flags |= flagAttestedCredentialData
+	}
+
+	ret := new(bytes.Buffer)
+
+	ret.Write(rpIDHash)
+	ret.WriteByte(flags)
+
+	counterBytes := [4]byte{}
+	binary.BigEndian.PutUint32(counterBytes[:], counter)
+	ret.Write(counterBytes[:])
+
+	ret.Write(attestedCredData)
+
+	return ret.Bytes()
+}
@@ -0,0 +1,464 @@
+package ctap2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/keyring"
+)
+
+const (
+	// maxPinRetries is the number of wrong PIN attempts after which the authenticator is blocked.
+	maxPinRetries = 8
+
+	// maxConsecutiveMismatches is the number of consecutive wrong PIN attempts after which a power cycle
+	// is needed to try again.
+	maxConsecutiveMismatches = 3
+
+	// minPinLength is the minimum PIN length, in Unicode code points.
+	minPinLength = 4
+
+	// maxPinLength is the maximum PIN length, in bytes.
+	maxPinLength = 63
+
+	// paddedPinLength is the length of the padded PIN sent by platforms in setPIN and changePIN.
+	paddedPinLength = 64
+
+	// pinHashLen is the length of the stored PIN hash, LEFT(SHA-256(PIN), 16).
+	pinHashLen = 16
+)
+
+const (
+	// permissionMakeCredential allows a pinUvAuthToken to be used for authenticatorMakeCredential.
+	permissionMakeCredential uint = 0x01
+
+	// permissionGetAssertion allows a pinUvAuthToken to be used for authenticatorGetAssertion.
+	permissionGetAssertion uint = 0x02
+)
+
+// authenticatorClientPIN subcommands.
+const (
+	subcommandGetPINRetries                            = 0x01
+	subcommandGetKeyAgreement                          = 0x02
+	subcommandSetPIN                                   = 0x03
+	subcommandChangePIN                                = 0x04
+	subcommandGetPINToken                              = 0x05
+	subcommandGetPinUvAuthTokenUsingPinWithPermissions = 0x09
+)
+
+// clientPINRequest is the authenticatorClientPIN request structure.
+type clientPINRequest struct {
+	PinUvAuthProtocol uint     `cbor:"1,keyasint"`
+	SubCommand        uint     `cbor:"2,keyasint"`
+	KeyAgreement      *coseKey `cbor:"3,keyasint,omitempty"`
+	PinUvAuthParam    []byte   `cbor:"4,keyasint,omitempty"`
+	NewPinEnc         []byte   `cbor:"5,keyasint,omitempty"`
+	PinHashEnc        []byte   `cbor:"6,keyasint,omitempty"`
+	Permissions       uint     `cbor:"9,keyasint,omitempty"`
+	RPID              string   `cbor:"10,keyasint,omitempty"`
+}
+
+// clientPINResponse is the authenticatorClientPIN response structure.
+type clientPINResponse struct {
+	KeyAgreement   *coseKey `cbor:"1,keyasint,omitempty"`
+	PinUvAuthToken []byte   `cbor:"2,keyasint,omitempty"`
+	PinRetries     *uint    `cbor:"3,keyasint,omitempty"`
+}
+
+// pinState is the persistent state of the client PIN.
+type pinState struct {
+	PINHash []byte `cbor:"1,keyasint,omitempty"`
+	Retries uint   `cbor:"2,keyasint"`
+}
+
+// clientPIN holds the client PIN state, both persistent and volatile.
+type clientPIN struct {
+	storage keyring.Storage
+	state   pinState
+
+	// volatile state, reset at every power cycle
+	keyAgreement          *ecdsa.PrivateKey
+	token                 []byte
+	tokenProtocol         uint
+	permissions           uint
+	permissionsRPID       string
+	consecutiveMismatches int
+}
+
+// newClientPIN returns a clientPIN whose persistent state is held in s.
+func newClientPIN(s keyring.Storage) (*clientPIN, error) {
+	data, err := s.Load()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load pin state, %w", err)
+	}
+
+	cp := &clientPIN{
+		storage: s,
+		state: pinState{
+			Retries: maxPinRetries,
+		},
+	}
+
+	if data != nil {
+		if err := cbor.Unmarshal(data, &cp.state); err != nil {
+			return nil, fmt.Errorf("cannot decode pin state, %w", err)
+		}
+	}
+
+	if err := cp.regenerateKeyAgreement(); err != nil {
+		return nil, err
+	}
+
+	if err := cp.resetToken(); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// isSet returns true if a PIN has been set.
+func (c *clientPIN) isSet() bool {
+	return c.state.PINHash != nil
+}
+
+// persist saves the persistent PIN state.
+func (c *clientPIN) persist() error {
+	data, err := cbor.Marshal(c.state)
+	if err != nil {
+		return fmt.Errorf("cannot encode pin state, %w", err)
+	}
+
+	return c.storage.Store(data)
+}
+
+// regenerateKeyAgreement generates a new key agreement key pair.
+func (c *clientPIN) regenerateKeyAgreement() error {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("cannot generate key agreement key, %w", err)
+	}
+
+	c.keyAgreement = k
+	return nil
+}
+
+// resetToken generates a new pinUvAuthToken with no permissions, invalidating the previous one.
+func (c *clientPIN) resetToken() error {
+	t := make([]byte, pinUvAuthTokenLen)
+	if _, err := rand.Read(t); err != nil {
+		return fmt.Errorf("cannot generate pinUvAuthToken, %w", err)
+	}
+
+	c.token = t
+	c.tokenProtocol = 0
+	c.permissions = 0
+	c.permissionsRPID = ""
+
+	return nil
+}
+
+// sharedSecret returns the shared secret between the authenticator and the platform key agreement key.
+func (c *clientPIN) sharedSecret(p pinProtocol, platformKey *coseKey) ([]byte, error) {
+	if platformKey == nil {
+		return nil, errMissingParameter
+	}
+
+	z, err := ecdh(c.keyAgreement, *platformKey)
+	if err != nil {
+		flog.Logger.Println("cannot compute shared secret:", err)
+		return nil, errInvalidParameter
+	}
+
+	return p.kdf(z), nil
+}
+
+// checkPINHash verifies the encrypted PIN hash sent by the platform, updating retry counters accordingly.
+func (c *clientPIN) checkPINHash(p pinProtocol, secret, pinHashEnc []byte) error {
+	if c.state.Retries == 0 {
+		return errPinBlocked
+	}
+
+	if c.consecutiveMismatches >= maxConsecutiveMismatches {
+		return errPinAuthBlocked
+	}
+
+	// retries are decremented before checking, so that unplugging the token mid-check doesn't give
+	// an attacker free attempts
+	c.state.Retries--
+	if err := c.persist(); err != nil {
+		return err
+	}
+
+	pinHash, err := p.decrypt(secret, pinHashEnc)
+	if err != nil || len(pinHash) < pinHashLen || !hmac.Equal(pinHash[:pinHashLen], c.state.PINHash) {
+		flog.Logger.Println("wrong pin hash,", c.state.Retries, "retries left")
+
+		if err := c.regenerateKeyAgreement(); err != nil {
+			return err
+		}
+
+		c.consecutiveMismatches++
+
+		switch {
+		case c.state.Retries == 0:
+			return errPinBlocked
+		case c.consecutiveMismatches >= maxConsecutiveMismatches:
+			return errPinAuthBlocked
+		default:
+			return errPinInvalid
+		}
+	}
+
+	c.consecutiveMismatches = 0
+	c.state.Retries = maxPinRetries
+
+	return c.persist()
+}
+
+// setPIN decrypts the padded PIN in newPinEnc, validates it against the PIN policy and stores its hash.
+func (c *clientPIN) setPIN(p pinProtocol, secret, newPinEnc []byte) error {
+	paddedPin, err := p.decrypt(secret, newPinEnc)
+	if err != nil || len(paddedPin) != paddedPinLength {
+		return errInvalidParameter
+	}
+
+	pin := paddedPin
+	if i := bytes.IndexByte(paddedPin, 0); i >= 0 {
+		pin = paddedPin[:i]
+	}
+
+	if len(pin) > maxPinLength || utf8.RuneCount(pin) < minPinLength {
+		return errPinPolicyViolation
+	}
+
+	h := sha256.Sum256(pin)
+
+	c.state.PINHash = h[:pinHashLen]
+	c.state.Retries = maxPinRetries
+
+	if err := c.persist(); err != nil {
+		return err
+	}
+
+	return c.resetToken()
+}
+
+// verifyToken checks that pinUvAuthParam is the authentication of clientDataHash with the current pinUvAuthToken
+// under the PIN/UV auth protocol that issued it, and that the token has been granted permission for rpID.
+func (c *clientPIN) verifyToken(protocol uint, p pinProtocol, pinUvAuthParam, clientDataHash []byte, permission uint, rpID string) error {
+	if protocol != c.tokenProtocol {
+		flog.Logger.Println("pinUvAuthToken was issued under pin protocol", c.tokenProtocol)
+		return errPinAuthInvalid
+	}
+
+	if !verify(p, c.token, clientDataHash, pinUvAuthParam) {
+		flog.Logger.Println("pinUvAuthParam verification failed")
+		return errPinAuthInvalid
+	}
+
+	if c.permissions&permission == 0 {
+		flog.Logger.Println("pinUvAuthToken doesn't have the requested permission")
+		return errPinAuthInvalid
+	}
+
+	switch c.permissionsRPID {
+	case "":
+		// tokens obtained with getPINToken are bound to the first rpId they're used with
+		c.permissionsRPID = rpID
+	case rpID:
+	default:
+		flog.Logger.Println("pinUvAuthToken is bound to a different relying party")
+		return errPinAuthInvalid
+	}
+
+	return nil
+}
+
+// userVerification checks the pinUvAuthParam sent along a makeCredential or getAssertion request,
+// and returns true if the user has been verified.
+func (a *Authenticator) userVerification(ctx context.Context, pinUvAuthParam []byte, protocol uint, clientDataHash []byte, permission uint, rpID string) (bool, error) {
+	if pinUvAuthParam == nil {
+		return false, nil
+	}
+
+	pinSet := a.pin != nil && a.pin.isSet()
+
+	if len(pinUvAuthParam) == 0 {
+		// platforms send a zero-length pinUvAuthParam to check whether a PIN is set, after waiting for user presence
+		if err := a.userPresence(ctx); err != nil {
+			return false, err
+		}
+
+		if pinSet {
+			return false, errPinInvalid
+		}
+
+		return false, errPinNotSet
+	}
+
+	if !pinSet {
+		return false, errPinNotSet
+	}
+
+	if protocol == 0 {
+		return false, errMissingParameter
+	}
+
+	p, ok := pinProtocols[protocol]
+	if !ok {
+		return false, errInvalidParameter
+	}
+
+	if err := a.pin.verifyToken(protocol, p, pinUvAuthParam, clientDataHash, permission, rpID); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (a *Authenticator) handleClientPIN(params []byte) (interface{}, error) {
+	if a.pin == nil {
+		return nil, errInvalidCommand
+	}
+
+	var req clientPINRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+
+	if req.PinUvAuthProtocol == 0 || req.SubCommand == 0 {
+		return nil, errMissingParameter
+	}
+
+	p, ok := pinProtocols[req.PinUvAuthProtocol]
+	if !ok {
+		flog.Logger.Println("unsupported pin protocol", req.PinUvAuthProtocol)
+		return nil, errInvalidParameter
+	}
+
+	cp := a.pin
+
+	switch req.SubCommand {
+	case subcommandGetPINRetries:
+		retries := cp.state.Retries
+		return clientPINResponse{
+			PinRetries: &retries,
+		}, nil
+	case subcommandGetKeyAgreement:
+		k := keyAgreementKey(&cp.keyAgreement.PublicKey)
+		return clientPINResponse{
+			KeyAgreement: &k,
+		}, nil
+	case subcommandSetPIN:
+		if req.PinUvAuthParam == nil || req.NewPinEnc == nil {
+			return nil, errMissingParameter
+		}
+
+		if cp.isSet() {
+			return nil, errPinAuthInvalid
+		}
+
+		secret, err := cp.sharedSecret(p, req.KeyAgreement)
+		if err != nil {
+			return nil, err
+		}
+
+		if !verify(p, secret, req.NewPinEnc, req.PinUvAuthParam) {
+			return nil, errPinAuthInvalid
+		}
+
+		return clientPINResponse{}, cp.setPIN(p, secret, req.NewPinEnc)
+	case subcommandChangePIN:
+		if req.PinUvAuthParam == nil || req.NewPinEnc == nil || req.PinHashEnc == nil {
+			return nil, errMissingParameter
+		}
+
+		if !cp.isSet() {
+			return nil, errPinNotSet
+		}
+
+		if cp.state.Retries == 0 {
+			return nil, errPinBlocked
+		}
+
+		secret, err := cp.sharedSecret(p, req.KeyAgreement)
+		if err != nil {
+			return nil, err
+		}
+
+		if !verify(p, secret, append(append([]byte{}, req.NewPinEnc...), req.PinHashEnc...), req.PinUvAuthParam) {
+			return nil, errPinAuthInvalid
+		}
+
+		if err := cp.checkPINHash(p, secret, req.PinHashEnc); err != nil {
+			return nil, err
+		}
+
+		return clientPINResponse{}, cp.setPIN(p, secret, req.NewPinEnc)
+	case subcommandGetPINToken, subcommandGetPinUvAuthTokenUsingPinWithPermissions:
+		if req.PinHashEnc == nil {
+			return nil, errMissingParameter
+		}
+
+		permissions := permissionMakeCredential | permissionGetAssertion
+		if req.SubCommand == subcommandGetPinUvAuthTokenUsingPinWithPermissions {
+			if req.Permissions == 0 {
+				return nil, errMissingParameter
+			}
+
+			if req.Permissions&^(permissionMakeCredential|permissionGetAssertion) != 0 {
+				return nil, errUnauthorizedPermission
+			}
+
+			// all the supported permissions need an rpId
+			if req.RPID == "" {
+				return nil, errMissingParameter
+			}
+
+			permissions = req.Permissions
+		}
+
+		if !cp.isSet() {
+			return nil, errPinNotSet
+		}
+
+		secret, err := cp.sharedSecret(p, req.KeyAgreement)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cp.checkPINHash(p, secret, req.PinHashEnc); err != nil {
+			return nil, err
+		}
+
+		if err := cp.resetToken(); err != nil {
+			return nil, err
+		}
+
+		cp.tokenProtocol = req.PinUvAuthProtocol
+		cp.permissions = permissions
+		if req.SubCommand == subcommandGetPinUvAuthTokenUsingPinWithPermissions {
+			cp.permissionsRPID = req.RPID
+		}
+
+		token, err := p.encrypt(secret, cp.token)
+		if err != nil {
+			return nil, err
+		}
+
+		return clientPINResponse{
+			PinUvAuthToken: token,
+		}, nil
+	default:
+		return nil, errInvalidParameter
+	}
+}
@@ -0,0 +1,447 @@
+package ctap2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// pinPlatform emulates the platform side of a PIN/UV auth protocol.
+type pinPlatform struct {
+	t        *testing.T
+	a        *Authenticator
+	version  uint
+	protocol pinProtocol
+	key      *ecdsa.PrivateKey
+	secret   []byte
+}
+
+func newPinPlatform(t *testing.T, a *Authenticator, version uint) *pinPlatform {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return &pinPlatform{
+		t:        t,
+		a:        a,
+		version:  version,
+		protocol: pinProtocols[version],
+		key:      k,
+	}
+}
+
+func (p *pinPlatform) clientPIN(req clientPINRequest) (statusCode, clientPINResponse) {
+	req.PinUvAuthProtocol = p.version
+
+	resp := p.a.HandleMessage(request(p.t, authenticatorClientPIN, req))
+
+	var cpr clientPINResponse
+	if resp[0] == uint8(statusOk) {
+		require.NoError(p.t, decMode.Unmarshal(resp[1:], &cpr))
+	}
+
+	return statusCode(resp[0]), cpr
+}
+
+// keyAgreement runs getKeyAgreement and derives the shared secret, returning the platform key agreement key.
+func (p *pinPlatform) keyAgreement() *coseKey {
+	sc, resp := p.clientPIN(clientPINRequest{SubCommand: subcommandGetKeyAgreement})
+	require.Equal(p.t, statusOk, sc)
+	require.NotNil(p.t, resp.KeyAgreement)
+	require.Equal(p.t, algECDHESHKDF256, resp.KeyAgreement.Alg)
+
+	z, err := ecdh(p.key, *resp.KeyAgreement)
+	require.NoError(p.t, err)
+
+	p.secret = p.protocol.kdf(z)
+
+	k := keyAgreementKey(&p.key.PublicKey)
+	return &k
+}
+
+func (p *pinPlatform) encrypt(data []byte) []byte {
+	ct, err := p.protocol.encrypt(p.secret, data)
+	require.NoError(p.t, err)
+
+	return ct
+}
+
+func paddedPin(pin string) []byte {
+	ret := make([]byte, paddedPinLength)
+	copy(ret, pin)
+	return ret
+}
+
+func pinHash(pin string) []byte {
+	h := sha256.Sum256([]byte(pin))
+	return h[:pinHashLen]
+}
+
+func (p *pinPlatform) setPIN(pin string) statusCode {
+	ka := p.keyAgreement()
+	newPinEnc := p.encrypt(paddedPin(pin))
+
+	sc, _ := p.clientPIN(clientPINRequest{
+		SubCommand:     subcommandSetPIN,
+		KeyAgreement:   ka,
+		NewPinEnc:      newPinEnc,
+		PinUvAuthParam: p.protocol.authenticate(p.secret, newPinEnc),
+	})
+
+	return sc
+}
+
+func (p *pinPlatform) changePIN(oldPin, newPin string) statusCode {
+	ka := p.keyAgreement()
+	newPinEnc := p.encrypt(paddedPin(newPin))
+	pinHashEnc := p.encrypt(pinHash(oldPin))
+
+	sc, _ := p.clientPIN(clientPINRequest{
+		SubCommand:     subcommandChangePIN,
+		KeyAgreement:   ka,
+		NewPinEnc:      newPinEnc,
+		PinHashEnc:     pinHashEnc,
+		PinUvAuthParam: p.protocol.authenticate(p.secret, append(append([]byte{}, newPinEnc...), pinHashEnc...)),
+	})
+
+	return sc
+}
+
+// getPINToken returns the decrypted pinUvAuthToken obtained with pin and permissions.
+// If permissions is zero, the getPINToken subcommand is used.
+func (p *pinPlatform) getPINToken(pin string, permissions uint, rpID string) (statusCode, []byte) {
+	req := clientPINRequest{
+		SubCommand:   subcommandGetPINToken,
+		KeyAgreement: p.keyAgreement(),
+		PinHashEnc:   p.encrypt(pinHash(pin)),
+	}
+
+	if permissions != 0 {
+		req.SubCommand = subcommandGetPinUvAuthTokenUsingPinWithPermissions
+		req.Permissions = permissions
+		req.RPID = rpID
+	}
+
+	sc, resp := p.clientPIN(req)
+	if sc != statusOk {
+		return sc, nil
+	}
+
+	token, err := p.protocol.decrypt(p.secret, resp.PinUvAuthToken)
+	require.NoError(p.t, err)
+	require.Len(p.t, token, pinUvAuthTokenLen)
+
+	return sc, token
+}
+
+func (p *pinPlatform) retries() uint {
+	sc, resp := p.clientPIN(clientPINRequest{SubCommand: subcommandGetPINRetries})
+	require.Equal(p.t, statusOk, sc)
+	require.NotNil(p.t, resp.PinRetries)
+
+	return *resp.PinRetries
+}
+
+func newPinTestAuthenticator(t *testing.T, s *memStorage) *Authenticator {
+	a := newTestAuthenticator(t, &testCounter{userPresent: true})
+	require.NoError(t, WithPIN(s)(a))
+
+	return a
+}
+
+func TestAuthenticator_clientPIN(t *testing.T) {
+	for _, version := range supportedPinProtocols {
+		version := version
+
+		tests := []test{
+			{
+				"client pin disabled",
+				func(t *testing.T) {
+					a := newTestAuthenticator(t, &testCounter{userPresent: true})
+					resp := a.HandleMessage(request(t, authenticatorClientPIN, clientPINRequest{
+						PinUvAuthProtocol: version,
+						SubCommand:        subcommandGetPINRetries,
+					}))
+					require.Equal(t, errInvalidCommand.Bytes(), resp)
+				},
+			},
+			{
+				"unsupported protocol",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					resp := a.HandleMessage(request(t, authenticatorClientPIN, clientPINRequest{
+						PinUvAuthProtocol: 42,
+						SubCommand:        subcommandGetPINRetries,
+					}))
+					require.Equal(t, errInvalidParameter.Bytes(), resp)
+				},
+			},
+			{
+				"getInfo advertises client pin",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+
+					gir := func() getInfoResponse {
+						resp := a.HandleMessage([]byte{uint8(authenticatorGetInfo)})
+						require.Equal(t, uint8(statusOk), resp[0])
+
+						var gir getInfoResponse
+						require.NoError(t, decMode.Unmarshal(resp[1:], &gir))
+						return gir
+					}
+
+					info := gir()
+					require.Equal(t, []string{"FIDO_2_1", "FIDO_2_0", "U2F_V2"}, info.Versions)
+					require.True(t, info.Options["pinUvAuthToken"])
+					require.Equal(t, supportedPinProtocols, info.PinProtocols)
+					require.False(t, info.Options["clientPin"])
+
+					require.Equal(t, statusOk, p.setPIN("1234"))
+					require.True(t, gir().Options["clientPin"])
+				},
+			},
+			{
+				"set pin, get token and make a verified credential",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+
+					require.Equal(t, maxPinRetries, int(p.retries()))
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					// setting the pin again is not allowed
+					require.Equal(t, errPinAuthInvalid, p.setPIN("5678"))
+
+					// a pin is now required to make credentials
+					resp := a.HandleMessage(request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+					require.Equal(t, errPinRequired.Bytes(), resp)
+
+					sc, token := p.getPINToken("1234", 0, "")
+					require.Equal(t, statusOk, sc)
+
+					req := defaultMakeCredentialRequest()
+					req.PinAuth = p.protocol.authenticate(token, req.ClientDataHash)
+					req.PinProtocol = version
+
+					resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, uint8(statusOk), resp[0])
+
+					var mcr makeCredentialResponse
+					require.NoError(t, decMode.Unmarshal(resp[1:], &mcr))
+					require.Equal(t, flagUserPresent|flagUserVerified|flagAttestedCredentialData, mcr.AuthData[32])
+
+					// wrong pinUvAuthParam
+					req.PinAuth = p.protocol.authenticate(token, []byte("wrong"))
+					resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinAuthInvalid.Bytes(), resp)
+				},
+			},
+			{
+				"zero-length pinUvAuthParam probe",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+
+					// pinAuth would be omitted from a makeCredentialRequest, since it's empty
+					mc := defaultMakeCredentialRequest()
+					req := map[int]interface{}{
+						1: mc.ClientDataHash,
+						2: mc.RP,
+						3: mc.User,
+						4: mc.PubKeyCredParams,
+						8: []byte{},
+					}
+
+					resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinNotSet.Bytes(), resp)
+
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinInvalid.Bytes(), resp)
+				},
+			},
+			{
+				"pin policy",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+
+					require.Equal(t, errPinPolicyViolation, p.setPIN("123"))
+					require.Equal(t, errPinPolicyViolation, p.setPIN(""))
+
+					// four code points, more than four bytes
+					require.Equal(t, statusOk, p.setPIN("ñañá"))
+				},
+			},
+			{
+				"change pin",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+
+					require.Equal(t, errPinNotSet, p.changePIN("1234", "5678"))
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					require.Equal(t, errPinInvalid, p.changePIN("0000", "5678"))
+					require.Equal(t, statusOk, p.changePIN("1234", "5678"))
+
+					sc, _ := p.getPINToken("1234", 0, "")
+					require.Equal(t, errPinInvalid, sc)
+
+					sc, _ = p.getPINToken("5678", 0, "")
+					require.Equal(t, statusOk, sc)
+				},
+			},
+			{
+				"token permissions and relying party binding",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					sc, _ := p.getPINToken("1234", 0x04, "")
+					require.Equal(t, errUnauthorizedPermission, sc)
+
+					sc, token := p.getPINToken("1234", permissionGetAssertion, "example.com")
+					require.Equal(t, statusOk, sc)
+
+					// token can't be used to make credentials
+					req := defaultMakeCredentialRequest()
+					req.PinAuth = p.protocol.authenticate(token, req.ClientDataHash)
+					req.PinProtocol = version
+
+					resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinAuthInvalid.Bytes(), resp)
+
+					sc, token = p.getPINToken("1234", permissionMakeCredential, "other.com")
+					require.Equal(t, statusOk, sc)
+
+					req.PinAuth = p.protocol.authenticate(token, req.ClientDataHash)
+					resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinAuthInvalid.Bytes(), resp)
+				},
+			},
+			{
+				"permissions need an rpId",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					sc, _ := p.getPINToken("1234", permissionMakeCredential, "")
+					require.Equal(t, errMissingParameter, sc)
+
+					sc, _ = p.getPINToken("1234", permissionGetAssertion, "")
+					require.Equal(t, errMissingParameter, sc)
+
+					// no retry has been consumed
+					require.Equal(t, maxPinRetries, int(p.retries()))
+				},
+			},
+			{
+				"token is bound to its pin protocol",
+				func(t *testing.T) {
+					a := newPinTestAuthenticator(t, &memStorage{})
+					p := newPinPlatform(t, a, version)
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					sc, token := p.getPINToken("1234", permissionMakeCredential, defaultMakeCredentialRequest().RP.ID)
+					require.Equal(t, statusOk, sc)
+
+					other := uint(1)
+					if version == 1 {
+						other = 2
+					}
+
+					req := defaultMakeCredentialRequest()
+					req.PinAuth = pinProtocols[other].authenticate(token, req.ClientDataHash)
+					req.PinProtocol = other
+
+					resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, errPinAuthInvalid.Bytes(), resp)
+
+					req.PinAuth = p.protocol.authenticate(token, req.ClientDataHash)
+					req.PinProtocol = version
+
+					resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+					require.Equal(t, uint8(statusOk), resp[0])
+				},
+			},
+			{
+				"retries and lockout",
+				func(t *testing.T) {
+					s := &memStorage{}
+					a := newPinTestAuthenticator(t, s)
+					p := newPinPlatform(t, a, version)
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					for i := 0; i < maxConsecutiveMismatches-1; i++ {
+						sc, _ := p.getPINToken("0000", 0, "")
+						require.Equal(t, errPinInvalid, sc)
+					}
+
+					sc, _ := p.getPINToken("0000", 0, "")
+					require.Equal(t, errPinAuthBlocked, sc)
+
+					// even the right pin is refused until power cycle
+					sc, _ = p.getPINToken("1234", 0, "")
+					require.Equal(t, errPinAuthBlocked, sc)
+					require.Equal(t, maxPinRetries-maxConsecutiveMismatches, int(p.retries()))
+
+					// power cycle: retries are persisted
+					a = newPinTestAuthenticator(t, s)
+					p = newPinPlatform(t, a, version)
+					require.Equal(t, maxPinRetries-maxConsecutiveMismatches, int(p.retries()))
+
+					sc, _ = p.getPINToken("1234", 0, "")
+					require.Equal(t, statusOk, sc)
+					require.Equal(t, maxPinRetries, int(p.retries()))
+
+					// exhaust all the retries
+					for i := 0; i < maxPinRetries; i++ {
+						if i%maxConsecutiveMismatches == 0 {
+							a = newPinTestAuthenticator(t, s)
+							p = newPinPlatform(t, a, version)
+						}
+
+						sc, _ = p.getPINToken("0000", 0, "")
+						require.NotEqual(t, statusOk, sc)
+					}
+
+					require.Equal(t, errPinBlocked, sc)
+
+					a = newPinTestAuthenticator(t, s)
+					p = newPinPlatform(t, a, version)
+					require.Zero(t, p.retries())
+
+					sc, _ = p.getPINToken("1234", 0, "")
+					require.Equal(t, errPinBlocked, sc)
+				},
+			},
+			{
+				"persisted pin state",
+				func(t *testing.T) {
+					s := &memStorage{}
+					p := newPinPlatform(t, newPinTestAuthenticator(t, s), version)
+					require.Equal(t, statusOk, p.setPIN("1234"))
+
+					var st pinState
+					require.NoError(t, cbor.Unmarshal(s.data, &st))
+					require.Equal(t, pinHash("1234"), st.PINHash)
+					require.Equal(t, uint(maxPinRetries), st.Retries)
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s, protocol %d", tt.name, version), tt.f)
+		}
+	}
+}
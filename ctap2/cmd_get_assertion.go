@@ -0,0 +1,267 @@
+package ctap2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/keyring"
+)
+
+// nextAssertionTimeout is the amount of time the platform has to retrieve the remaining assertions
+// with authenticatorGetNextAssertion.
+const nextAssertionTimeout = 30 * time.Second
+
+// getAssertionRequest is the authenticatorGetAssertion request structure.
+type getAssertionRequest struct {
+	RPID           string                 `cbor:"1,keyasint"`
+	ClientDataHash []byte                 `cbor:"2,keyasint"`
+	AllowList      []credentialDescriptor `cbor:"3,keyasint,omitempty"`
+	Extensions     map[string]interface{} `cbor:"4,keyasint,omitempty"`
+	Options        map[string]bool        `cbor:"5,keyasint,omitempty"`
+	PinAuth        []byte                 `cbor:"6,keyasint,omitempty"`
+	PinProtocol    uint                   `cbor:"7,keyasint,omitempty"`
+}
+
+// getAssertionResponse is the authenticatorGetAssertion response structure.
+type getAssertionResponse struct {
+	Credential          credentialDescriptor `cbor:"1,keyasint"`
+	AuthData            []byte               `cbor:"2,keyasint"`
+	Signature           []byte               `cbor:"3,keyasint"`
+	User                *userEntity          `cbor:"4,keyasint,omitempty"`
+	NumberOfCredentials int                  `cbor:"5,keyasint,omitempty"`
+}
+
+// assertionCredential is a credential selected to build an assertion.
+// resident is nil for key-wrapped credentials.
+type assertionCredential struct {
+	id       []byte
+	resident *keyring.Credential
+}
+
+// pendingAssertions holds the state needed by authenticatorGetNextAssertion.
+type pendingAssertions struct {
+	rpIDHash       []byte
+	clientDataHash []byte
+	flags          uint8
+	credentials    []keyring.Credential
+	expiration     time.Time
+}
+
+func (a *Authenticator) handleGetAssertion(ctx context.Context, params []byte) (interface{}, error) {
+	var req getAssertionRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case req.RPID == "", req.ClientDataHash == nil:
+		return nil, errMissingParameter
+	case len(req.ClientDataHash) != sha256.Size:
+		return nil, errInvalidParameter
+	}
+
+	requireUserPresence := true
+	for option, value := range req.Options {
+		switch option {
+		case "rk":
+			return nil, errInvalidOption
+		case "uv":
+			if value {
+				flog.Logger.Println("unsupported option requested:", option)
+				return nil, errUnsupportedOption
+			}
+		case "up":
+			requireUserPresence = value
+		}
+	}
+
+	userVerified, err := a.userVerification(ctx, req.PinAuth, req.PinProtocol, req.ClientDataHash, permissionGetAssertion, req.RPID)
+	if err != nil {
+		return nil, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(req.RPID))
+
+	var creds []assertionCredential
+	if len(req.AllowList) == 0 {
+		residents, err := a.keyring.ResidentCredentials(req.RPID)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range residents {
+			creds = append(creds, assertionCredential{
+				id:       residents[i].ID,
+				resident: &residents[i],
+			})
+		}
+	} else {
+		cred, found, err := a.findCredential(req.RPID, rpIDHash[:], req.AllowList)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			creds = append(creds, cred)
+		}
+	}
+
+	if len(creds) == 0 {
+		flog.Logger.Println("no valid credential found for relying party", req.RPID)
+		return nil, errNoCredentials
+	}
+
+	var flags uint8
+	if requireUserPresence {
+		if err := a.userPresence(ctx); err != nil {
+			flog.Logger.Println("user presence was requested, but it wasn't present")
+			return nil, err
+		}
+
+		flags |= flagUserPresent
+	}
+
+	if userVerified {
+		flags |= flagUserVerified
+	}
+
+	resp, err := a.assert(rpIDHash[:], req.ClientDataHash, flags, creds[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(creds) > 1 {
+		resp.NumberOfCredentials = len(creds)
+
+		// with more than one account, the platform needs user details to let the user choose, but they
+		// identify the user and can only be returned once verified
+		resp.User = residentUser(*creds[0].resident, flags&flagUserVerified != 0)
+
+		next := &pendingAssertions{
+			rpIDHash:       rpIDHash[:],
+			clientDataHash: req.ClientDataHash,
+			flags:          flags,
+			expiration:     time.Now().Add(nextAssertionTimeout),
+		}
+
+		for _, c := range creds[1:] {
+			next.credentials = append(next.credentials, *c.resident)
+		}
+
+		a.nextAssertions = next
+	}
+
+	return resp, nil
+}
+
+func (a *Authenticator) handleGetNextAssertion() (interface{}, error) {
+	next := a.nextAssertions
+	if next == nil || len(next.credentials) == 0 {
+		return nil, errNotAllowed
+	}
+
+	if time.Now().After(next.expiration) {
+		a.nextAssertions = nil
+		return nil, errNotAllowed
+	}
+
+	c := next.credentials[0]
+	next.credentials = next.credentials[1:]
+
+	resp, err := a.assert(next.rpIDHash, next.clientDataHash, next.flags, assertionCredential{
+		id:       c.ID,
+		resident: &c,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp.User = residentUser(c, next.flags&flagUserVerified != 0)
+
+	return resp, nil
+}
+
+// findCredential returns the first credential in allowList which belongs to the relying party.
+func (a *Authenticator) findCredential(rpID string, rpIDHash []byte, allowList []credentialDescriptor) (assertionCredential, bool, error) {
+	for _, cred := range allowList {
+		if cred.Type != publicKeyCredentialType {
+			continue
+		}
+
+		if a.keyring.KeyHandleValid(rpIDHash, cred.ID) {
+			return assertionCredential{id: cred.ID}, true, nil
+		}
+
+		resident, found, err := a.keyring.ResidentCredential(cred.ID)
+		if err != nil {
+			return assertionCredential{}, false, err
+		}
+
+		if found && resident.RPID == rpID {
+			return assertionCredential{id: cred.ID, resident: &resident}, true, nil
+		}
+	}
+
+	return assertionCredential{}, false, nil
+}
+
+// assert builds an assertion response for cred.
+func (a *Authenticator) assert(rpIDHash, clientDataHash []byte, flags uint8, cred assertionCredential) (getAssertionResponse, error) {
+	count, err := a.keyring.Counter.Increment(rpIDHash, clientDataHash, cred.id)
+	if err != nil {
+		return getAssertionResponse{}, err
+	}
+
+	authData := authenticatorData(rpIDHash, flags, count, nil)
+
+	sigPayload := new(bytes.Buffer)
+	sigPayload.Write(authData)
+	sigPayload.Write(clientDataHash)
+
+	var sign []byte
+	if cred.resident != nil {
+		sign, err = a.keyring.SignWithCredential(*cred.resident, sigPayload.Bytes())
+	} else {
+		sign, err = a.keyring.Sign(rpIDHash, cred.id, sigPayload.Bytes())
+	}
+
+	if err != nil {
+		return getAssertionResponse{}, err
+	}
+
+	flog.Logger.Println("asserted credential ID:", hex.EncodeToString(cred.id))
+
+	resp := getAssertionResponse{
+		Credential: credentialDescriptor{
+			Type: publicKeyCredentialType,
+			ID:   cred.id,
+		},
+		AuthData:  authData,
+		Signature: sign,
+	}
+
+	if cred.resident != nil {
+		resp.User = residentUser(*cred.resident, false)
+	}
+
+	return resp, nil
+}
+
+// residentUser returns the user entity for c.
+// User name and display name are only included if details is true.
+func residentUser(c keyring.Credential, details bool) *userEntity {
+	u := &userEntity{
+		ID: c.UserHandle,
+	}
+
+	if details {
+		u.Name = c.UserName
+		u.DisplayName = c.UserDisplayName
+	}
+
+	return u
+}
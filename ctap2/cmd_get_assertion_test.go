@@ -0,0 +1,208 @@
+package ctap2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeResidentCredential registers a new resident credential for userID, and returns its ID.
+func makeResidentCredential(t *testing.T, a *Authenticator, userID []byte, userName string) []byte {
+	req := defaultMakeCredentialRequest()
+	req.User = userEntity{
+		ID:   userID,
+		Name: userName,
+	}
+	req.Options = map[string]bool{
+		"rk": true,
+	}
+
+	resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+	require.Equal(t, uint8(statusOk), resp[0])
+
+	var mcr makeCredentialResponse
+	require.NoError(t, decMode.Unmarshal(resp[1:], &mcr))
+
+	credID, _ := parseAttestedCredential(t, mcr.AuthData)
+	return credID
+}
+
+func getAssertion(t *testing.T, a *Authenticator, cmd command, params interface{}) getAssertionResponse {
+	var resp []byte
+	if params == nil {
+		resp = a.HandleMessage([]byte{uint8(cmd)})
+	} else {
+		resp = a.HandleMessage(request(t, cmd, params))
+	}
+
+	require.Equal(t, uint8(statusOk), resp[0])
+
+	var gar getAssertionResponse
+	require.NoError(t, decMode.Unmarshal(resp[1:], &gar))
+
+	return gar
+}
+
+func TestAuthenticator_residentCredentials(t *testing.T) {
+	tests := []test{
+		{
+			"resident key without credential store",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				req := defaultMakeCredentialRequest()
+				req.Options = map[string]bool{
+					"rk": true,
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errUnsupportedOption.Bytes(), resp)
+			},
+		},
+		{
+			"getInfo advertises resident keys",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+				resp := a.HandleMessage([]byte{uint8(authenticatorGetInfo)})
+				require.Equal(t, uint8(statusOk), resp[0])
+
+				var gir getInfoResponse
+				require.NoError(t, decMode.Unmarshal(resp[1:], &gir))
+				require.True(t, gir.Options["rk"])
+			},
+		},
+		{
+			"single resident credential is discovered without allow list",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+				credID := makeResidentCredential(t, a, []byte{1}, "user")
+
+				gar := getAssertion(t, a, authenticatorGetAssertion, getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+				})
+
+				require.Equal(t, credID, gar.Credential.ID)
+				require.NotNil(t, gar.User)
+				require.Equal(t, []byte{1}, gar.User.ID)
+				require.Empty(t, gar.User.Name)
+				require.Zero(t, gar.NumberOfCredentials)
+			},
+		},
+		{
+			"resident credential is found through allow list",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+				credID := makeResidentCredential(t, a, []byte{1}, "user")
+
+				gar := getAssertion(t, a, authenticatorGetAssertion, getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+					AllowList: []credentialDescriptor{
+						{
+							Type: publicKeyCredentialType,
+							ID:   credID,
+						},
+					},
+				})
+
+				require.Equal(t, credID, gar.Credential.ID)
+			},
+		},
+		{
+			"resident credential is excluded",
+			func(t *testing.T) {
+				c := &testCounter{userPresent: true}
+				a := newResidentTestAuthenticator(t, c)
+				credID := makeResidentCredential(t, a, []byte{1}, "user")
+
+				req := defaultMakeCredentialRequest()
+				req.ExcludeList = []credentialDescriptor{
+					{
+						Type: publicKeyCredentialType,
+						ID:   credID,
+					},
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errCredentialExcluded.Bytes(), resp)
+
+				// excluded credentials can't be probed without user presence
+				c.userPresent = false
+				resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errOperationDenied.Bytes(), resp)
+			},
+		},
+		{
+			"multiple resident credentials are returned with getNextAssertion",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+				first := makeResidentCredential(t, a, []byte{1}, "first")
+				second := makeResidentCredential(t, a, []byte{2}, "second")
+
+				gar := getAssertion(t, a, authenticatorGetAssertion, getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+				})
+
+				require.Equal(t, 2, gar.NumberOfCredentials)
+				require.Equal(t, second, gar.Credential.ID)
+				require.Equal(t, []byte{2}, gar.User.ID)
+
+				// user details are not returned without user verification
+				require.Empty(t, gar.User.Name)
+
+				gar = getAssertion(t, a, authenticatorGetNextAssertion, nil)
+				require.Equal(t, first, gar.Credential.ID)
+				require.Equal(t, []byte{1}, gar.User.ID)
+				require.Empty(t, gar.User.Name)
+
+				resp := a.HandleMessage([]byte{uint8(authenticatorGetNextAssertion)})
+				require.Equal(t, errNotAllowed.Bytes(), resp)
+			},
+		},
+		{
+			"multiple resident credentials return user details once verified",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+				first := makeResidentCredential(t, a, []byte{1}, "first")
+				second := makeResidentCredential(t, a, []byte{2}, "second")
+
+				require.NoError(t, WithPIN(&memStorage{})(a))
+				p := newPinPlatform(t, a, 2)
+				require.Equal(t, statusOk, p.setPIN("1234"))
+
+				sc, token := p.getPINToken("1234", permissionGetAssertion, rpID)
+				require.Equal(t, statusOk, sc)
+
+				gar := getAssertion(t, a, authenticatorGetAssertion, getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+					PinAuth:        p.protocol.authenticate(token, clientDataHash),
+					PinProtocol:    2,
+				})
+
+				require.Equal(t, 2, gar.NumberOfCredentials)
+				require.Equal(t, second, gar.Credential.ID)
+				require.Equal(t, "second", gar.User.Name)
+
+				gar = getAssertion(t, a, authenticatorGetNextAssertion, nil)
+				require.Equal(t, first, gar.Credential.ID)
+				require.Equal(t, "first", gar.User.Name)
+			},
+		},
+		{
+			"getNextAssertion without a previous getAssertion",
+			func(t *testing.T) {
+				a := newResidentTestAuthenticator(t, &testCounter{userPresent: true})
+
+				resp := a.HandleMessage([]byte{uint8(authenticatorGetNextAssertion)})
+				require.Equal(t, errNotAllowed.Bytes(), resp)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
@@ -0,0 +1,34 @@
+package ctap2
+
+// getInfoResponse is the authenticatorGetInfo response structure.
+type getInfoResponse struct {
+	Versions     []string        `cbor:"1,keyasint"`
+	Extensions   []string        `cbor:"2,keyasint,omitempty"`
+	AAGUID       []byte          `cbor:"3,keyasint"`
+	Options      map[string]bool `cbor:"4,keyasint,omitempty"`
+	MaxMsgSize   uint            `cbor:"5,keyasint,omitempty"`
+	PinProtocols []uint          `cbor:"6,keyasint,omitempty"`
+}
+
+func (a *Authenticator) handleGetInfo() (interface{}, error) {
+	resp := getInfoResponse{
+		Versions: []string{"FIDO_2_0", "U2F_V2"},
+		AAGUID:   AAGUID[:],
+		Options: map[string]bool{
+			"plat": false,
+			"rk":   a.keyring.Credentials != nil,
+			"up":   true,
+		},
+		MaxMsgSize: maxMsgSize,
+	}
+
+	// pinUvAuthToken and PIN/UV auth protocol two are CTAP 2.1 features
+	if a.pin != nil {
+		resp.Versions = append([]string{"FIDO_2_1"}, resp.Versions...)
+		resp.Options["clientPin"] = a.pin.isSet()
+		resp.Options["pinUvAuthToken"] = true
+		resp.PinProtocols = supportedPinProtocols
+	}
+
+	return resp, nil
+}
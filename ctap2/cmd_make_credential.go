@@ -0,0 +1,172 @@
+package ctap2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/keyring"
+)
+
+// makeCredentialRequest is the authenticatorMakeCredential request structure.
+type makeCredentialRequest struct {
+	ClientDataHash   []byte                 `cbor:"1,keyasint"`
+	RP               rpEntity               `cbor:"2,keyasint"`
+	User             userEntity             `cbor:"3,keyasint"`
+	PubKeyCredParams []credentialParameters `cbor:"4,keyasint"`
+	ExcludeList      []credentialDescriptor `cbor:"5,keyasint,omitempty"`
+	Extensions       map[string]interface{} `cbor:"6,keyasint,omitempty"`
+	Options          map[string]bool        `cbor:"7,keyasint,omitempty"`
+	PinAuth          []byte                 `cbor:"8,keyasint,omitempty"`
+	PinProtocol      uint                   `cbor:"9,keyasint,omitempty"`
+}
+
+// packedAttestation is the attestation statement for the "packed" attestation format.
+type packedAttestation struct {
+	Alg int      `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5c [][]byte `cbor:"x5c"`
+}
+
+// makeCredentialResponse is the authenticatorMakeCredential response structure.
+type makeCredentialResponse struct {
+	Fmt      string            `cbor:"1,keyasint"`
+	AuthData []byte            `cbor:"2,keyasint"`
+	AttStmt  packedAttestation `cbor:"3,keyasint"`
+}
+
+func (a *Authenticator) handleMakeCredential(ctx context.Context, params []byte) (interface{}, error) {
+	var req makeCredentialRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case req.ClientDataHash == nil, req.RP.ID == "", req.User.ID == nil, req.PubKeyCredParams == nil:
+		return nil, errMissingParameter
+	case len(req.ClientDataHash) != sha256.Size:
+		return nil, errInvalidParameter
+	}
+
+	if !supportsES256(req.PubKeyCredParams) {
+		flog.Logger.Println("no supported algorithm found in pubKeyCredParams")
+		return nil, errUnsupportedAlgorithm
+	}
+
+	residentKey := false
+	for option, value := range req.Options {
+		switch option {
+		case "rk":
+			if value && a.keyring.Credentials == nil {
+				flog.Logger.Println("resident key requested, but no credential store is available")
+				return nil, errUnsupportedOption
+			}
+
+			residentKey = value
+		case "uv":
+			if value {
+				flog.Logger.Println("unsupported option requested:", option)
+				return nil, errUnsupportedOption
+			}
+		case "up":
+			// user presence is always required to make credentials
+			if !value {
+				flog.Logger.Println("invalid option requested:", option)
+				return nil, errInvalidOption
+			}
+		}
+	}
+
+	userVerified, err := a.userVerification(ctx, req.PinAuth, req.PinProtocol, req.ClientDataHash, permissionMakeCredential, req.RP.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !userVerified && a.pin != nil && a.pin.isSet() {
+		flog.Logger.Println("a pin is set, but no pinUvAuthParam was provided")
+		return nil, errPinRequired
+	}
+
+	rpIDHash := sha256.Sum256([]byte(req.RP.ID))
+
+	_, excluded, err := a.findCredential(req.RP.ID, rpIDHash[:], req.ExcludeList)
+	if err != nil {
+		return nil, err
+	}
+
+	// user presence is required even for excluded credentials, so that their existence can't be probed silently
+	if err := a.userPresence(ctx); err != nil {
+		flog.Logger.Println("user presence during credential creation is required")
+		return nil, err
+	}
+
+	if excluded {
+		flog.Logger.Println("found excluded credential for relying party", req.RP.ID)
+		return nil, errCredentialExcluded
+	}
+
+	flags := flagUserPresent
+	if userVerified {
+		flags |= flagUserVerified
+	}
+
+	var pubKey *ecdsa.PublicKey
+	var credID []byte
+
+	if residentKey {
+		var cred keyring.Credential
+		pubKey, cred, err = a.keyring.CreateResident(req.RP.ID, req.User.ID, req.User.Name, req.User.DisplayName)
+		credID = cred.ID
+	} else {
+		pubKey, credID, err = a.keyring.Register(rpIDHash[:], nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	acd, err := attestedCredentialData(credID, pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	authData := authenticatorData(rpIDHash[:], flags, 0, acd)
+
+	sigPayload := new(bytes.Buffer)
+	sigPayload.Write(authData)
+	sigPayload.Write(req.ClientDataHash)
+
+	sph := sha256.Sum256(sigPayload.Bytes())
+	sign, err := ecdsa.SignASN1(rand.Reader, a.attestationPrivkey, sph[:])
+	if err != nil {
+		return nil, err
+	}
+
+	flog.Logger.Println("registered rpID:", req.RP.ID)
+	flog.Logger.Println("registered credential ID:", hex.EncodeToString(credID))
+
+	return makeCredentialResponse{
+		Fmt:      "packed",
+		AuthData: authData,
+		AttStmt: packedAttestation{
+			Alg: algES256,
+			Sig: sign,
+			X5c: [][]byte{a.attestationCertificate},
+		},
+	}, nil
+}
+
+// supportsES256 returns true if params contains a public key credential type with the ES256 algorithm.
+func supportsES256(params []credentialParameters) bool {
+	for _, p := range params {
+		if p.Type == publicKeyCredentialType && p.Alg == algES256 {
+			return true
+		}
+	}
+
+	return false
+}
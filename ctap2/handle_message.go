@@ -0,0 +1,89 @@
+package ctap2
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/keyring"
+)
+
+// HandleMessage handles a cmdCbor payload, and returns a response byte slice.
+// The response is made of a status code byte, followed by the CBOR-encoded response
+// parameters if the command succeeded.
+func (a *Authenticator) HandleMessage(data []byte) []byte {
+	return a.HandleMessageContext(context.Background(), data)
+}
+
+// HandleMessageContext is like HandleMessage, but user presence tests are bound to ctx.
+func (a *Authenticator) HandleMessageContext(ctx context.Context, data []byte) []byte {
+	if len(data) == 0 {
+		flog.Logger.Println("empty cbor request")
+		return errInvalidLength.Bytes()
+	}
+
+	cmd := command(data[0])
+	params := data[1:]
+
+	flog.Logger.Printf("ctap2 command: %s, %d bytes of parameters", cmd, len(params))
+
+	var resp interface{}
+	var handleErr error
+
+	if cmd != authenticatorGetNextAssertion {
+		// any command other than authenticatorGetNextAssertion invalidates pending assertions
+		a.nextAssertions = nil
+	}
+
+	switch cmd {
+	case authenticatorGetInfo:
+		resp, handleErr = a.handleGetInfo()
+	case authenticatorMakeCredential:
+		resp, handleErr = a.handleMakeCredential(ctx, params)
+	case authenticatorGetAssertion:
+		resp, handleErr = a.handleGetAssertion(ctx, params)
+	case authenticatorGetNextAssertion:
+		resp, handleErr = a.handleGetNextAssertion()
+	case authenticatorClientPIN:
+		resp, handleErr = a.handleClientPIN(params)
+	default:
+		return errInvalidCommand.Bytes()
+	}
+
+	if errors.Is(handleErr, keyring.ErrStoreFull) {
+		handleErr = errKeyStoreFull
+	}
+
+	if handleErr != nil {
+		var sc statusCode
+		if !errors.As(handleErr, &sc) {
+			flog.Logger.Println("non-ctap2 error detected:", handleErr)
+			return errOther.Bytes()
+		}
+
+		return sc.Bytes()
+	}
+
+	respBytes, err := encMode.Marshal(resp)
+	if err != nil {
+		flog.Logger.Println("cannot build response:", err)
+		return errOther.Bytes()
+	}
+
+	return append(statusOk.Bytes(), respBytes...)
+}
+
+// decodeParams decodes params into v, returning errInvalidCbor if params isn't valid CBOR
+// or doesn't match v.
+func decodeParams(params []byte, v interface{}) error {
+	if len(params) == 0 {
+		return errMissingParameter
+	}
+
+	if err := decMode.Unmarshal(params, v); err != nil {
+		flog.Logger.Println("cannot decode cbor parameters:", err)
+		return errInvalidCbor
+	}
+
+	return nil
+}
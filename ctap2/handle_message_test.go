@@ -0,0 +1,298 @@
+package ctap2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	clientDataHash = bytes.Repeat([]byte{42}, 32)
+	rpID           = "fidati.example"
+)
+
+func defaultMakeCredentialRequest() makeCredentialRequest {
+	return makeCredentialRequest{
+		ClientDataHash: clientDataHash,
+		RP: rpEntity{
+			ID: rpID,
+		},
+		User: userEntity{
+			ID:   []byte{1, 2, 3, 4},
+			Name: "user",
+		},
+		PubKeyCredParams: []credentialParameters{
+			{
+				Type: publicKeyCredentialType,
+				Alg:  algES256,
+			},
+		},
+	}
+}
+
+// makeCredential registers a new credential, and returns its response.
+func makeCredential(t *testing.T, a *Authenticator) makeCredentialResponse {
+	resp := a.HandleMessage(request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+	require.Equal(t, uint8(statusOk), resp[0])
+
+	var mcr makeCredentialResponse
+	require.NoError(t, decMode.Unmarshal(resp[1:], &mcr))
+
+	return mcr
+}
+
+// parseAttestedCredential returns the credential ID and public key contained in authData.
+func parseAttestedCredential(t *testing.T, authData []byte) ([]byte, *ecdsa.PublicKey) {
+	require.True(t, len(authData) > 37+16+2)
+
+	acd := authData[37:]
+	require.Equal(t, AAGUID[:], acd[:16])
+
+	credIDLen := binary.BigEndian.Uint16(acd[16:18])
+	credID := acd[18 : 18+credIDLen]
+
+	var key coseKey
+	require.NoError(t, decMode.Unmarshal(acd[18+credIDLen:], &key))
+	require.Equal(t, coseKeyTypeEC2, key.Kty)
+	require.Equal(t, algES256, key.Alg)
+	require.Equal(t, coseCurveP256, key.Crv)
+
+	return credID, &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(key.X),
+		Y:     new(big.Int).SetBytes(key.Y),
+	}
+}
+
+func TestAuthenticator_HandleMessage(t *testing.T) {
+	tests := []test{
+		{
+			"empty request",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				require.Equal(t, errInvalidLength.Bytes(), a.HandleMessage(nil))
+			},
+		},
+		{
+			"unknown command",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				require.Equal(t, errInvalidCommand.Bytes(), a.HandleMessage([]byte{0x42}))
+			},
+		},
+		{
+			"invalid cbor parameters",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				resp := a.HandleMessage([]byte{uint8(authenticatorMakeCredential), 0xff, 0xff})
+				require.Equal(t, errInvalidCbor.Bytes(), resp)
+			},
+		},
+		{
+			"getInfo",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				resp := a.HandleMessage([]byte{uint8(authenticatorGetInfo)})
+				require.Equal(t, uint8(statusOk), resp[0])
+
+				var gir getInfoResponse
+				require.NoError(t, decMode.Unmarshal(resp[1:], &gir))
+				require.Contains(t, gir.Versions, "FIDO_2_0")
+				require.Contains(t, gir.Versions, "U2F_V2")
+				require.NotContains(t, gir.Versions, "FIDO_2_1")
+				require.Equal(t, AAGUID[:], gir.AAGUID)
+				require.True(t, gir.Options["up"])
+				require.Equal(t, uint(maxMsgSize), gir.MaxMsgSize)
+			},
+		},
+		{
+			"makeCredential returns a valid packed attestation",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				mcr := makeCredential(t, a)
+
+				require.Equal(t, "packed", mcr.Fmt)
+
+				rpIDHash := sha256.Sum256([]byte(rpID))
+				require.Equal(t, rpIDHash[:], mcr.AuthData[:32])
+				require.Equal(t, flagUserPresent|flagAttestedCredentialData, mcr.AuthData[32])
+
+				credID, _ := parseAttestedCredential(t, mcr.AuthData)
+				require.True(t, a.keyring.KeyHandleValid(rpIDHash[:], credID))
+
+				require.Len(t, mcr.AttStmt.X5c, 1)
+				cert, err := x509.ParseCertificate(mcr.AttStmt.X5c[0])
+				require.NoError(t, err)
+
+				payload := sha256.Sum256(append(mcr.AuthData, clientDataHash...))
+				require.True(t, ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), payload[:], mcr.AttStmt.Sig))
+			},
+		},
+		{
+			"makeCredential with unsupported algorithm",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				req := defaultMakeCredentialRequest()
+				req.PubKeyCredParams[0].Alg = -257
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errUnsupportedAlgorithm.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential with the up option",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				req := defaultMakeCredentialRequest()
+				req.Options = map[string]bool{
+					"up": true,
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, uint8(statusOk), resp[0])
+
+				req.Options["up"] = false
+
+				resp = a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errInvalidOption.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential with missing parameters",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				req := defaultMakeCredentialRequest()
+				req.RP.ID = ""
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errMissingParameter.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential without user presence",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: false})
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+				require.Equal(t, errOperationDenied.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential with user presence timeout",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{presenceErr: context.DeadlineExceeded})
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+				require.Equal(t, errUserActionTimeout.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential cancelled while waiting for user presence",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{presenceErr: context.Canceled})
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+				require.Equal(t, errKeepaliveCancel.Bytes(), resp)
+			},
+		},
+		{
+			"makeCredential notifies the presence wait",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				var calls []bool
+				ctx := presence.WithNotifier(context.Background(), func(waiting bool) {
+					calls = append(calls, waiting)
+				})
+
+				resp := a.HandleMessageContext(ctx, request(t, authenticatorMakeCredential, defaultMakeCredentialRequest()))
+				require.Equal(t, statusOk.Bytes(), resp[:1])
+				require.Equal(t, []bool{true, false}, calls)
+			},
+		},
+		{
+			"makeCredential with an excluded credential",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				credID, _ := parseAttestedCredential(t, makeCredential(t, a).AuthData)
+
+				req := defaultMakeCredentialRequest()
+				req.ExcludeList = []credentialDescriptor{
+					{
+						Type: publicKeyCredentialType,
+						ID:   credID,
+					},
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorMakeCredential, req))
+				require.Equal(t, errCredentialExcluded.Bytes(), resp)
+			},
+		},
+		{
+			"getAssertion returns a valid signature",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+				credID, pubKey := parseAttestedCredential(t, makeCredential(t, a).AuthData)
+
+				req := getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+					AllowList: []credentialDescriptor{
+						{
+							Type: publicKeyCredentialType,
+							ID:   bytes.Repeat([]byte{1}, 64),
+						},
+						{
+							Type: publicKeyCredentialType,
+							ID:   credID,
+						},
+					},
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorGetAssertion, req))
+				require.Equal(t, uint8(statusOk), resp[0])
+
+				var gar getAssertionResponse
+				require.NoError(t, decMode.Unmarshal(resp[1:], &gar))
+
+				require.Equal(t, credID, gar.Credential.ID)
+				require.Len(t, gar.AuthData, 37)
+				require.Equal(t, flagUserPresent, gar.AuthData[32])
+				require.Equal(t, uint32(1), binary.BigEndian.Uint32(gar.AuthData[33:37]))
+
+				payload := sha256.Sum256(append(gar.AuthData, clientDataHash...))
+				require.True(t, ecdsa.VerifyASN1(pubKey, payload[:], gar.Signature))
+			},
+		},
+		{
+			"getAssertion without valid credentials",
+			func(t *testing.T) {
+				a := newTestAuthenticator(t, &testCounter{userPresent: true})
+
+				req := getAssertionRequest{
+					RPID:           rpID,
+					ClientDataHash: clientDataHash,
+				}
+
+				resp := a.HandleMessage(request(t, authenticatorGetAssertion, req))
+				require.Equal(t, errNoCredentials.Bytes(), resp)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
@@ -0,0 +1,205 @@
+package ctap2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const (
+	// algECDHESHKDF256 is the COSE algorithm identifier used for PIN/UV auth protocol key agreement keys.
+	algECDHESHKDF256 = -25
+
+	// pinUvAuthTokenLen is the length of the pinUvAuthToken issued by the authenticator.
+	pinUvAuthTokenLen = 32
+)
+
+var (
+	// hkdfSalt is the salt used by PIN/UV auth protocol two when deriving shared secrets.
+	hkdfSalt = make([]byte, 32)
+
+	// pinProtocolOneIV is the all-zero IV used by PIN/UV auth protocol one.
+	pinProtocolOneIV = make([]byte, aes.BlockSize)
+)
+
+// pinProtocol is a PIN/UV auth protocol, as defined in the CTAP 2.1 specification, section 6.5.
+type pinProtocol interface {
+	// kdf derives the shared secret from the x coordinate of the ECDH shared point.
+	kdf(z []byte) []byte
+
+	// encrypt encrypts plaintext, whose length must be a multiple of the AES block size, with key.
+	encrypt(key, plaintext []byte) ([]byte, error)
+
+	// decrypt decrypts ciphertext with key.
+	decrypt(key, ciphertext []byte) ([]byte, error)
+
+	// authenticate returns the MAC of message with key.
+	authenticate(key, message []byte) []byte
+}
+
+// pinProtocols holds all the supported PIN/UV auth protocols, by version number.
+var pinProtocols = map[uint]pinProtocol{
+	1: pinProtocolOne{},
+	2: pinProtocolTwo{},
+}
+
+// supportedPinProtocols lists the supported PIN/UV auth protocols, in order of preference.
+var supportedPinProtocols = []uint{2, 1}
+
+// pinProtocolOne is PIN/UV auth protocol one.
+type pinProtocolOne struct{}
+
+func (pinProtocolOne) kdf(z []byte) []byte {
+	h := sha256.Sum256(z)
+	return h[:]
+}
+
+func (pinProtocolOne) encrypt(key, plaintext []byte) ([]byte, error) {
+	return aesCBCEncrypt(key, pinProtocolOneIV, plaintext)
+}
+
+func (pinProtocolOne) decrypt(key, ciphertext []byte) ([]byte, error) {
+	return aesCBCDecrypt(key, pinProtocolOneIV, ciphertext)
+}
+
+func (pinProtocolOne) authenticate(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)[:16]
+}
+
+// pinProtocolTwo is PIN/UV auth protocol two.
+// Its shared secret is made of a 32 bytes HMAC key followed by a 32 bytes AES key.
+type pinProtocolTwo struct{}
+
+func (pinProtocolTwo) kdf(z []byte) []byte {
+	return append(
+		hkdfSHA256(z, hkdfSalt, []byte("CTAP2 HMAC key")),
+		hkdfSHA256(z, hkdfSalt, []byte("CTAP2 AES key"))...,
+	)
+}
+
+// aesKey returns the AES key part of key, which might be either a shared secret or a pinUvAuthToken.
+func (pinProtocolTwo) aesKey(key []byte) []byte {
+	if len(key) == 64 {
+		return key[32:]
+	}
+
+	return key
+}
+
+func (p pinProtocolTwo) encrypt(key, plaintext []byte) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	ct, err := aesCBCEncrypt(p.aesKey(key), iv, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(iv, ct...), nil
+}
+
+func (p pinProtocolTwo) decrypt(key, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("ciphertext is shorter than the IV")
+	}
+
+	return aesCBCDecrypt(p.aesKey(key), ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:])
+}
+
+func (pinProtocolTwo) authenticate(key, message []byte) []byte {
+	// the HMAC key is the first half of a shared secret, or a whole pinUvAuthToken
+	mac := hmac.New(sha256.New, key[:32])
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// verify returns true if signature is the authentication of message with key, under protocol p.
+func verify(p pinProtocol, key, message, signature []byte) bool {
+	return hmac.Equal(p.authenticate(key, message), signature)
+}
+
+// hkdfSHA256 returns 32 bytes of HKDF-SHA-256 output keying material, as described by RFC 5869.
+func hkdfSHA256(ikm, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	// the output length is equal to the hash length, a single expansion round is enough
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+
+	return expand.Sum(nil)
+}
+
+func aesCBCEncrypt(key, iv, plaintext []byte) ([]byte, error) {
+	if len(plaintext)%aes.BlockSize != 0 {
+		return nil, errors.New("plaintext is not a multiple of the block size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ct, plaintext)
+
+	return ct, nil
+}
+
+func aesCBCDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ciphertext)
+
+	return pt, nil
+}
+
+// keyAgreementKey returns the COSE_Key representation of the public part of a key agreement key.
+func keyAgreementKey(pk *ecdsa.PublicKey) coseKey {
+	k := newCOSEKey(pk)
+	k.Alg = algECDHESHKDF256
+
+	return k
+}
+
+// ecdh returns the x coordinate of the ECDH shared point between priv and the platform public key.
+func ecdh(priv *ecdsa.PrivateKey, platformKey coseKey) ([]byte, error) {
+	if platformKey.Kty != coseKeyTypeEC2 || platformKey.Crv != coseCurveP256 {
+		return nil, errors.New("unsupported key agreement key type")
+	}
+
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(platformKey.X)
+	y := new(big.Int).SetBytes(platformKey.Y)
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("key agreement point is not on curve")
+	}
+
+	sx, _ := curve.ScalarMult(x, y, priv.D.Bytes())
+
+	z := make([]byte, 32)
+	sx.FillBytes(z)
+
+	return z, nil
+}
@@ -0,0 +1,36 @@
+package ctap2
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/presence"
+)
+
+// userPresenceTimeout is the amount of time the user has to confirm presence.
+const userPresenceTimeout = 30 * time.Second
+
+// userPresence waits for the user to confirm presence, for at most userPresenceTimeout or until ctx is done.
+// It returns errUserActionTimeout if the user didn't confirm in time, errKeepaliveCancel if ctx was cancelled,
+// or errOperationDenied if presence couldn't be confirmed.
+func (a *Authenticator) userPresence(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, userPresenceTimeout)
+	defer cancel()
+
+	err := presence.Wait(ctx, a.presence)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		flog.Logger.Println("user presence timed out")
+		return errUserActionTimeout
+	case errors.Is(err, context.Canceled):
+		flog.Logger.Println("user presence cancelled")
+		return errKeepaliveCancel
+	default:
+		flog.Logger.Println("user presence not confirmed:", err)
+		return errOperationDenied
+	}
+}
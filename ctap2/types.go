@@ -0,0 +1,266 @@
+package ctap2
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gsora/fidati/attestation"
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+)
+
+// command represents a CTAP2 authenticator API command.
+// See https://fidoalliance.org/specs/fido-v2.0-ps-20190130/fido-client-to-authenticator-protocol-v2.0-ps-20190130.html
+// for more details.
+//go:generate stringer -type=command
+type command uint8
+
+const (
+	// authenticatorMakeCredential creates a new credential for a relying party.
+	authenticatorMakeCredential command = 0x01
+
+	// authenticatorGetAssertion signs a challenge with a previously created credential.
+	authenticatorGetAssertion command = 0x02
+
+	// authenticatorGetInfo reports the authenticator capabilities.
+	authenticatorGetInfo command = 0x04
+
+	// authenticatorClientPIN manages the client PIN and issues pinUvAuthTokens.
+	authenticatorClientPIN command = 0x06
+
+	// authenticatorGetNextAssertion returns the next assertion for a previous authenticatorGetAssertion.
+	authenticatorGetNextAssertion command = 0x08
+)
+
+// statusCode represents a CTAP2 status code, sent as the first byte of every response.
+//go:generate stringer -type=statusCode
+type statusCode uint8
+
+const (
+	// The command completed successfully without error.
+	statusOk statusCode = 0x00
+
+	// The command is not a valid CTAP command.
+	errInvalidCommand statusCode = 0x01
+
+	// The command included an invalid parameter.
+	errInvalidParameter statusCode = 0x02
+
+	// Invalid message or item length.
+	errInvalidLength statusCode = 0x03
+
+	// Error when parsing CBOR.
+	errInvalidCbor statusCode = 0x12
+
+	// Missing non-optional parameter.
+	errMissingParameter statusCode = 0x14
+
+	// Valid credential found in the exclude list.
+	errCredentialExcluded statusCode = 0x19
+
+	// Authenticator does not support requested algorithm.
+	errUnsupportedAlgorithm statusCode = 0x26
+
+	// Not authorized for requested operation.
+	errOperationDenied statusCode = 0x27
+
+	// Internal key storage is full.
+	errKeyStoreFull statusCode = 0x28
+
+	// Unsupported option.
+	errUnsupportedOption statusCode = 0x2B
+
+	// Not a valid option for current operation.
+	errInvalidOption statusCode = 0x2C
+
+	// Pending keep alive was cancelled.
+	errKeepaliveCancel statusCode = 0x2D
+
+	// No valid credentials provided.
+	errNoCredentials statusCode = 0x2E
+
+	// A user action timeout occurred.
+	errUserActionTimeout statusCode = 0x2F
+
+	// Continuation command, such as authenticatorGetNextAssertion, not allowed.
+	errNotAllowed statusCode = 0x30
+
+	// PIN invalid.
+	errPinInvalid statusCode = 0x31
+
+	// PIN blocked.
+	errPinBlocked statusCode = 0x32
+
+	// PIN authentication, pinUvAuthParam, verification failed.
+	errPinAuthInvalid statusCode = 0x33
+
+	// PIN authentication blocked, requires power cycle to reset.
+	errPinAuthBlocked statusCode = 0x34
+
+	// No PIN has been set.
+	errPinNotSet statusCode = 0x35
+
+	// PIN is required for the selected operation.
+	errPinRequired statusCode = 0x36
+
+	// PIN policy violation, currently only enforces minimum and maximum length.
+	errPinPolicyViolation statusCode = 0x37
+
+	// The permissions parameter contains an unauthorized permission.
+	errUnauthorizedPermission statusCode = 0x40
+
+	// Other unspecified error.
+	errOther statusCode = 0x7F
+)
+
+// Error implements the error interface.
+func (sc statusCode) Error() string {
+	return sc.String()
+}
+
+// Bytes returns the byte slice representation of sc.
+func (sc statusCode) Bytes() []byte {
+	return []byte{uint8(sc)}
+}
+
+const (
+	// publicKeyCredentialType is the only credential type defined by WebAuthn.
+	publicKeyCredentialType = "public-key"
+
+	// algES256 is the COSE algorithm identifier for ECDSA w/ SHA-256 on P-256.
+	algES256 = -7
+
+	// maxMsgSize is the biggest message a U2FHID transport can carry: one init packet and
+	// 128 continuation packets.
+	maxMsgSize = 57 + 128*59
+)
+
+// AAGUID is the Authenticator Attestation GUID reported by fidati.
+var AAGUID = [16]byte{
+	0x66, 0x69, 0x64, 0x61, 0x74, 0x69, 0x4b, 0x65,
+	0xb1, 0x3a, 0x24, 0x5e, 0x0c, 0x8f, 0x7d, 0x21,
+}
+
+var (
+	// encMode encodes CBOR data following the CTAP2 canonical CBOR encoding form.
+	encMode = mustEncMode(cbor.CTAP2EncOptions())
+
+	// decMode decodes CBOR data, rejecting duplicate map keys.
+	decMode = mustDecMode(cbor.DecOptions{DupMapKey: cbor.DupMapKeyEnforcedAPF})
+)
+
+func mustEncMode(opts cbor.EncOptions) cbor.EncMode {
+	em, err := opts.EncMode()
+	if err != nil {
+		panic(fmt.Sprintf("cannot build cbor encoding mode, %v", err))
+	}
+
+	return em
+}
+
+func mustDecMode(opts cbor.DecOptions) cbor.DecMode {
+	dm, err := opts.DecMode()
+	if err != nil {
+		panic(fmt.Sprintf("cannot build cbor decoding mode, %v", err))
+	}
+
+	return dm
+}
+
+// rpEntity represents a WebAuthn PublicKeyCredentialRpEntity.
+type rpEntity struct {
+	ID   string `cbor:"id"`
+	Name string `cbor:"name,omitempty"`
+	Icon string `cbor:"icon,omitempty"`
+}
+
+// userEntity represents a WebAuthn PublicKeyCredentialUserEntity.
+type userEntity struct {
+	ID          []byte `cbor:"id"`
+	Name        string `cbor:"name,omitempty"`
+	DisplayName string `cbor:"displayName,omitempty"`
+	Icon        string `cbor:"icon,omitempty"`
+}
+
+// credentialParameters represents a WebAuthn PublicKeyCredentialParameters.
+type credentialParameters struct {
+	Type string `cbor:"type"`
+	Alg  int    `cbor:"alg"`
+}
+
+// credentialDescriptor represents a WebAuthn PublicKeyCredentialDescriptor.
+type credentialDescriptor struct {
+	Type       string   `cbor:"type"`
+	ID         []byte   `cbor:"id"`
+	Transports []string `cbor:"transports,omitempty"`
+}
+
+// Authenticator represents a CTAP2 authenticator.
+// It handles CBOR request parsing and composition, key storage orchestration.
+type Authenticator struct {
+	keyring                *keyring.Keyring
+	presence               presence.Provider
+	attestationCertificate []byte
+	attestationPrivkey     *ecdsa.PrivateKey
+
+	// assertions left to be returned by authenticatorGetNextAssertion
+	nextAssertions *pendingAssertions
+
+	// client PIN state, nil if client PIN support is disabled
+	pin *clientPIN
+}
+
+// Option is a functional option used to configure an Authenticator.
+type Option func(*Authenticator) error
+
+// WithPIN enables client PIN support, persisting PIN hash and retry counter in s.
+func WithPIN(s keyring.Storage) Option {
+	return func(a *Authenticator) error {
+		if s == nil {
+			return fmt.Errorf("pin storage is nil")
+		}
+
+		cp, err := newClientPIN(s)
+		if err != nil {
+			return err
+		}
+
+		a.pin = cp
+		return nil
+	}
+}
+
+// New returns a new Authenticator instance with k as Keyring, confirming user presence with p.
+// attCert must be a PEM-encoded certificate, while attPrivKey must be a X.509-encoded
+// ECDSA private key.
+func New(k *keyring.Keyring, p presence.Provider, attCert, attPrivKey []byte, opts ...Option) (*Authenticator, error) {
+	if p == nil {
+		return nil, fmt.Errorf("presence provider is nil")
+	}
+
+	cert, _, err := attestation.ParseCertificate(attCert)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse attestation certificate, %w", err)
+	}
+
+	key, err := attestation.ParseKey(attPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse attestation private key, %w", err)
+	}
+
+	a := &Authenticator{
+		keyring:                k,
+		presence:               p,
+		attestationCertificate: cert,
+		attestationPrivkey:     key,
+	}
+
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,88 @@
+package ctap2
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+type test struct {
+	name string
+	f    func(*testing.T)
+}
+
+type testCounter struct {
+	i           uint32
+	userPresent bool
+	presenceErr error
+}
+
+func (t *testCounter) Increment(_ []byte, _ []byte, _ []byte) (uint32, error) {
+	t.i++
+	return t.i, nil
+}
+
+// Wait implements presence.Provider, confirming presence if userPresent is true.
+// If presenceErr is not nil, it's returned instead.
+func (t *testCounter) Wait(_ context.Context) error {
+	if t.presenceErr != nil {
+		return t.presenceErr
+	}
+
+	if !t.userPresent {
+		return presence.ErrDenied
+	}
+
+	return nil
+}
+
+// newTestAuthenticator returns an Authenticator backed by the repository attestation certificate and key.
+func newTestAuthenticator(t *testing.T, c *testCounter) *Authenticator {
+	cert, err := ioutil.ReadFile("../certs/attestation_certificate.pem")
+	require.NoError(t, err)
+
+	key, err := ioutil.ReadFile("../certs/ecdsa_privkey.pem")
+	require.NoError(t, err)
+
+	a, err := New(keyring.New([]byte("key"), c), c, cert, key)
+	require.NoError(t, err)
+
+	return a
+}
+
+type memStorage struct {
+	data []byte
+}
+
+func (m *memStorage) Load() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *memStorage) Store(b []byte) error {
+	m.data = append([]byte{}, b...)
+	return nil
+}
+
+// newResidentTestAuthenticator returns an Authenticator able to store resident credentials in memory.
+func newResidentTestAuthenticator(t *testing.T, c *testCounter) *Authenticator {
+	a := newTestAuthenticator(t, c)
+
+	cs, err := keyring.NewCredentialStore(&memStorage{})
+	require.NoError(t, err)
+
+	a.keyring.Credentials = cs
+
+	return a
+}
+
+// request builds a cmdCbor payload for cmd, with params encoded as CBOR.
+func request(t *testing.T, cmd command, params interface{}) []byte {
+	p, err := encMode.Marshal(params)
+	require.NoError(t, err)
+
+	return append([]byte{uint8(cmd)}, p...)
+}
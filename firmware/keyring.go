@@ -2,6 +2,9 @@ package main
 
 import "github.com/gsora/fidati/keyring"
 
-func genKeyring(secret []byte, counter keyring.Counter) *keyring.Keyring {
-	return keyring.New(secret, counter)
+func genKeyring(secret []byte, counter keyring.Counter, credentials keyring.CredentialStore) *keyring.Keyring {
+	k := keyring.New(secret, counter)
+	k.Credentials = credentials
+
+	return k
 }
@@ -5,20 +5,52 @@ package leds
 import (
 	"context"
 	"runtime"
+	"sync"
 	"time"
 
 	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
 )
 
-// cancelFuncs holds references to the functions needed to stop
-// the LED blink.
-var cancelFuncs []context.CancelFunc
+const (
+	// winkFlashes is the number of times both LEDs flash during a wink.
+	winkFlashes = 5
+
+	// winkPeriod is the amount of time LEDs stay on, and off, during a wink.
+	winkPeriod = 100 * time.Millisecond
+)
+
+var (
+	// lock protects all the variables below.
+	lock sync.Mutex
+
+	// cancelFuncs holds references to the functions needed to stop
+	// the LED blink.
+	cancelFuncs []context.CancelFunc
+
+	// blinkers tracks the running blink goroutines.
+	blinkers sync.WaitGroup
+
+	// winking is true while a wink is in progress.
+	winking bool
+
+	// panicked is true once Panic has been called, after that LEDs never change.
+	panicked bool
+)
 
 // StartBlink starts the white and blue LED blinking.
 func StartBlink() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	startBlink()
+}
+
+func startBlink() {
 	whiteCtx, whiteCancel := context.WithCancel(context.Background())
 	blueCtx, blueCancel := context.WithCancel(context.Background())
 
+	blinkers.Add(2)
+
 	go func() { // start led blinking in a goroutine, don't block the main thread
 		go blink(whiteCtx, "white")
 
@@ -36,6 +68,13 @@ func StartBlink() {
 
 // StopBlink stops the blinking, and turns both LEDs off.
 func StopBlink() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	stopBlink()
+}
+
+func stopBlink() {
 	for _, cf := range cancelFuncs {
 		cf()
 	}
@@ -45,12 +84,66 @@ func StopBlink() {
 
 // Panic stops blinking, turns both LEDs on.
 func Panic() {
-	StopBlink()
+	lock.Lock()
+	panicked = true
+	stopBlink()
+	lock.Unlock()
+
+	// blinking LEDs are turned off when stopped, wait for that before turning them on
+	blinkers.Wait()
+
 	usbarmory.LED("blue", true)
 	usbarmory.LED("white", true)
 }
 
+// Wink identifies the device by flashing both LEDs together quickly, which is distinct from the regular
+// blinking. The regular blinking is paused during the wink, and resumed afterwards.
+// It returns immediately, and it does nothing if a wink is already in progress.
+func Wink() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if winking || panicked {
+		return
+	}
+
+	winking = true
+	resume := cancelFuncs != nil
+	stopBlink()
+
+	go wink(resume)
+}
+
+func wink(resume bool) {
+	blinkers.Wait()
+
+	for i := 0; i < 2*winkFlashes; i++ {
+		lock.Lock()
+		if panicked {
+			lock.Unlock()
+			return
+		}
+
+		usbarmory.LED("white", i%2 == 0)
+		usbarmory.LED("blue", i%2 == 0)
+		lock.Unlock()
+
+		time.Sleep(winkPeriod)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	winking = false
+
+	if resume && !panicked && cancelFuncs == nil {
+		startBlink()
+	}
+}
+
 func blink(ctx context.Context, led string) {
+	defer blinkers.Done()
+
 	lastVal := true
 	for {
 		select {
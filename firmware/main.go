@@ -7,6 +7,8 @@ import (
 	"runtime/debug"
 
 	"github.com/gsora/fidati/firmware/leds"
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/storage"
 
 	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
 	"github.com/usbarmory/tamago/nxp/imx6ul"
@@ -65,39 +67,30 @@ func main() {
 
 	go rebootWatcher()
 
-	//s := &sd{}
+	sd := storage.SD{}
 
-	/*if err := blank(); err != nil {
+	counter, err := readSdCounter(sd)
+	if err != nil {
 		panic(err)
 	}
 
-	var store *storage.Storage
-	data, err := readStorageData(s)
-	if err != nil && err != noData {
+	credentialsStorage, err := newJournalStorage(sd, credentialsLBA, credentialsBlockAmount, credentialsSlotBlocks)
+	if err != nil {
 		panic(err)
-	} else if err == noData {
-		st, err := storage.New(s, nil)
-		if err != nil {
-			panic(err)
-		}
-
-		store = st
-	} else {
-		st, err := storage.New(s, data)
-		if err != nil {
-			panic(err)
-		}
+	}
 
-		store = st
-	}*/
+	credentials, err := keyring.NewCredentialStore(credentialsStorage)
+	if err != nil {
+		panic(err)
+	}
 
-	counter, err := readSdCounter()
+	up, err := userPresence()
 	if err != nil {
 		panic(err)
 	}
 
-	k := genKeyring(attestationPrivkey, counter)
-	startUSB(k)
+	k := genKeyring(attestationPrivkey, counter, credentials)
+	startUSB(k, up)
 }
 
 func rebootWatcher() {
@@ -110,9 +103,14 @@ func rebootWatcher() {
 			continue
 		}
 
-		if buf[0] == 'r' {
+		switch buf[0] {
+		case 'r':
 			log.Println("rebooting...")
 			imx6ul.Reset()
+		case presenceKey:
+			if uartPresence.Confirm() {
+				log.Println("user presence confirmed")
+			}
 		}
 
 		buf[0] = 0
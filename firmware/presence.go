@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+
+	"github.com/usbarmory/tamago/soc/nxp/gpio"
+	"github.com/usbarmory/tamago/soc/nxp/iomuxc"
+)
+
+const (
+	// presenceKey is the serial console key which confirms user presence.
+	presenceKey = 'y'
+
+	// buttonPollInterval is the interval at which the presence button state is sampled.
+	buttonPollInterval = 10 * time.Millisecond
+
+	// gpioMode is the IOMUXC mux mode which routes a pad to its GPIO controller.
+	gpioMode = 5
+)
+
+// buttonConfig describes a push button wired to a GPIO pin, active low.
+// mux and pad are the IOMUXC mux and pad control registers of the pin, see the
+// i.MX6UL reference manual.
+type buttonConfig struct {
+	controller *gpio.GPIO
+	num        int
+	mux        uint32
+	pad        uint32
+}
+
+// presenceButton is the button used to confirm user presence, nil if there's none.
+// The USB Armory Mk II has no user button: one can be wired to any GPIO exposed on the board.
+var presenceButton *buttonConfig
+
+// uartPresence is confirmed by pressing presenceKey on the serial console.
+var uartPresence = presence.NewSignal()
+
+// buttonPresence is a presence.Provider confirmed by pressing a button.
+type buttonPresence struct {
+	pin *gpio.Pin
+}
+
+func newButtonPresence(c *buttonConfig) (*buttonPresence, error) {
+	pin, err := c.controller.Init(c.num)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize presence button gpio, %w", err)
+	}
+
+	pin.In()
+
+	// input with pull-up and hysteresis, the button pulls the line low when pressed
+	p := iomuxc.Init(c.mux, c.pad, gpioMode)
+	p.Ctl(uint32((1 << iomuxc.SW_PAD_CTL_HYS) |
+		(1 << iomuxc.SW_PAD_CTL_PKE) |
+		(1 << iomuxc.SW_PAD_CTL_PUE) |
+		(iomuxc.SW_PAD_CTL_PUS_PULL_UP_100K << iomuxc.SW_PAD_CTL_PUS)))
+
+	return &buttonPresence{
+		pin: pin,
+	}, nil
+}
+
+// Wait implements the presence.Provider interface.
+func (b *buttonPresence) Wait(ctx context.Context) error {
+	t := time.NewTicker(buttonPollInterval)
+	defer t.Stop()
+
+	// a button held down since before the request doesn't count
+	released := b.pin.Value()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			pressed := !b.pin.Value()
+
+			if pressed && released {
+				return nil
+			}
+
+			if !pressed {
+				released = true
+			}
+		}
+	}
+}
+
+// userPresence returns the presence.Provider used by fidati: the serial console, and the presence
+// button if configured.
+func userPresence() (presence.Provider, error) {
+	var uart presence.Provider = presence.Func(func(ctx context.Context) error {
+		log.Printf("waiting for user presence, press '%c' on the serial console", presenceKey)
+		return uartPresence.Wait(ctx)
+	})
+
+	if presenceButton == nil {
+		return uart, nil
+	}
+
+	b, err := newButtonPresence(presenceButton)
+	if err != nil {
+		return nil, err
+	}
+
+	return presence.Any(uart, b), nil
+}
@@ -3,90 +3,82 @@ package main
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
-	"log"
-	"math"
 
-	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+	"github.com/gsora/fidati/counter"
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/storage"
 )
 
 const (
-	writeOffset = 1
-
 	counterLBA         = 1
 	counterBlockAmount = 1
-)
 
-var noData = errors.New("no data")
+	// credentials are held in a journal of 2 slots, 64 blocks each
+	credentialsLBA         = counterLBA + counterBlockAmount
+	credentialsBlockAmount = 128
+	credentialsSlotBlocks  = 64
 
-// wrongOffset panics if writeOffset is greater than the maximum number of blocks available on the SD.
-func wrongOffset() {
-	info := usbarmory.SD.Info()
-	if info.Blocks < writeOffset {
-		panic(fmt.Sprintf("specified base write offset %d bigger than SD total block number %d", writeOffset, info.Blocks))
-	}
-}
+	// pin state is held in a journal of 8 slots, 1 block each
+	pinLBA         = credentialsLBA + credentialsBlockAmount
+	pinBlockAmount = 8
+	pinSlotBlocks  = 1
 
-// closestSectorNumber returns the closest number of sectors divisible by the microSD block size,
-// by rounding up.
-func closestSectorNumber(n int) int {
-	m := float64(usbarmory.SD.Info().BlockSize)
-	return int(math.Ceil(float64(n)/m) * m)
-}
+	// counters are held in a journal of 8 slots, 4 blocks each
+	countersLBA         = pinLBA + pinBlockAmount
+	countersBlockAmount = 32
+	countersSlotBlocks  = 4
+)
+
+// globalCounter makes fidati keep a single signature counter shared by all the credentials,
+// like previous releases did.
+const globalCounter = false
 
-func sdWrite(offset int, data []byte) error {
-	var nd []byte
-
-	if len(data) < usbarmory.SD.Info().BlockSize {
-		nd = make([]byte, usbarmory.SD.Info().BlockSize)
-		copy(nd, data)
-	} else if len(data) == usbarmory.SD.Info().BlockSize {
-		nd = data
-	} else {
-		nd = make([]byte, closestSectorNumber(len(data)))
-		copy(nd, data)
+// readSdCounter loads signature counters from dev.
+// The global counter used by previous releases, stored at counterLBA, is used as initial value so that
+// counter values are never reused after an upgrade.
+func readSdCounter(dev storage.BlockDevice) (*counter.Counters, error) {
+	cbytes := make([]byte, counterBlockAmount*dev.Info().BlockSize)
+	if err := dev.ReadBlocks(counterLBA, cbytes); err != nil {
+		return nil, err
 	}
 
-	log.Printf("writing %v at lba %v", nd, offset)
-	err := usbarmory.SD.WriteBlocks(offset, nd)
-	log.Println("finished writing")
-	return err
-}
+	opts := []counter.Option{
+		counter.WithInitialValue(binary.LittleEndian.Uint32(cbytes)),
+	}
 
-func sdRead(offset, numBlocks int) ([]byte, error) {
-	ret := make([]byte, numBlocks)
+	if globalCounter {
+		opts = append(opts, counter.Global())
+	}
 
-	return ret, usbarmory.SD.ReadBlocks(offset, ret)
-}
+	journal, err := storage.NewJournal(dev, countersLBA, countersBlockAmount, countersSlotBlocks)
+	if err != nil {
+		return nil, err
+	}
 
-type sdCounter struct {
-	counter uint32
+	return counter.New(journal, opts...)
 }
 
-func (s *sdCounter) UserPresence() bool {
-	// we always say yes :)]
-	return true
+// journalStorage is a keyring.Storage on a storage.Journal, which reports a full journal slot as keyring.ErrStoreFull.
+type journalStorage struct {
+	*storage.Journal
 }
 
-func readSdCounter() (*sdCounter, error) {
-	cbytes, err := sdRead(counterLBA, counterBlockAmount)
+func newJournalStorage(dev storage.BlockDevice, lba, blocks, slotBlocks int) (*journalStorage, error) {
+	j, err := storage.NewJournal(dev, lba, blocks, slotBlocks)
 	if err != nil {
 		return nil, err
 	}
 
-	return &sdCounter{
-		counter: binary.LittleEndian.Uint32(cbytes),
+	return &journalStorage{
+		Journal: j,
 	}, nil
 }
 
-func (s *sdCounter) Increment(_ []byte, _ []byte, _ []byte) (uint32, error) {
-	s.counter++
-	cbytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(cbytes, s.counter)
-	err := sdWrite(counterLBA, cbytes)
-	if err != nil {
-		return 0, err
+func (j *journalStorage) Store(b []byte) error {
+	err := j.Journal.Store(b)
+	if errors.Is(err, storage.ErrNoSpace) {
+		return keyring.ErrStoreFull
 	}
 
-	return s.counter, nil
+	return err
 }
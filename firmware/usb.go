@@ -4,7 +4,11 @@ import (
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 
 	"github.com/gsora/fidati"
+	"github.com/gsora/fidati/ctap2"
+	"github.com/gsora/fidati/firmware/leds"
 	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+	"github.com/gsora/fidati/storage"
 	"github.com/gsora/fidati/u2fhid"
 	"github.com/gsora/fidati/u2ftoken"
 )
@@ -42,13 +46,34 @@ func baseConfiguration(device *usb.Device) {
 	device.Descriptor.SerialNumber = iSerial
 }
 
-func startUSB(keyring *keyring.Keyring) {
+func startUSB(keyring *keyring.Keyring, up presence.Provider) {
 	device := &usb.Device{}
 
-	token, err := u2ftoken.New(keyring, attestationCertificate, attestationPrivkey)
+	token, err := u2ftoken.New(keyring, up, attestationCertificate, attestationPrivkey)
 	notErr(err)
 
-	hid, err := u2fhid.NewHandler(token)
+	pinStorage, err := newJournalStorage(storage.SD{}, pinLBA, pinBlockAmount, pinSlotBlocks)
+	notErr(err)
+
+	authenticator, err := ctap2.New(
+		keyring,
+		up,
+		attestationCertificate,
+		attestationPrivkey,
+		ctap2.WithPIN(pinStorage),
+	)
+	notErr(err)
+
+	hidOpts := []u2fhid.Option{
+		u2fhid.WithCBOR(authenticator),
+		u2fhid.WithWinker(u2fhid.WinkerFunc(leds.Wink)),
+	}
+
+	if info, ok := u2fhid.DeviceInfoFromRevision(Revision); ok {
+		hidOpts = append(hidOpts, u2fhid.WithDeviceInfo(info))
+	}
+
+	hid, err := u2fhid.NewHandler(token, hidOpts...)
 	notErr(err)
 
 	conf := fidati.DefaultConfiguration()
@@ -3,6 +3,7 @@ module github.com/gsora/fidati
 go 1.15
 
 require (
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/rakyll/statik v0.1.7
 	github.com/stretchr/testify v1.7.1
 	github.com/usbarmory/tamago v0.0.0-20220823080407-04f05cf2a5a3
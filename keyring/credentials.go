@@ -0,0 +1,333 @@
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ErrStoreFull is returned by a CredentialStore when there's no space left to store a new credential.
+var ErrStoreFull = errors.New("credential store is full")
+
+// ErrNoStore is returned when a resident credential operation is requested on a Keyring without
+// a CredentialStore.
+var ErrNoStore = errors.New("keyring has no credential store")
+
+// credentialEncryptionLabel is used to derive the resident credentials encryption key from the master key.
+const credentialEncryptionLabel = "fidati resident credential encryption key"
+
+// Credential represents a resident (discoverable) credential.
+type Credential struct {
+	// ID is the credential ID, as seen by relying parties.
+	ID []byte `cbor:"1,keyasint"`
+
+	// RPID is the relying party identifier the credential belongs to.
+	RPID string `cbor:"2,keyasint"`
+
+	// UserHandle is the relying party user identifier.
+	UserHandle []byte `cbor:"3,keyasint"`
+
+	// UserName is the human-palatable user account identifier.
+	UserName string `cbor:"4,keyasint,omitempty"`
+
+	// UserDisplayName is the human-palatable user name.
+	UserDisplayName string `cbor:"5,keyasint,omitempty"`
+
+	// EncryptedPrivateKey holds the credential private key, encrypted with a key derived from the Keyring master key.
+	EncryptedPrivateKey []byte `cbor:"6,keyasint"`
+}
+
+// CredentialStore is a persistent store for resident credentials.
+type CredentialStore interface {
+	// Put stores c, replacing any credential with the same RPID and UserHandle.
+	Put(c Credential) error
+
+	// Get returns the credential identified by id, and false if it doesn't exist.
+	Get(id []byte) (Credential, bool, error)
+
+	// List returns all the credentials stored for rpID, most recently stored first.
+	List(rpID string) ([]Credential, error)
+}
+
+// Storage is a persistent storage area for an opaque byte slice.
+type Storage interface {
+	// Load returns the bytes previously saved with Store, or nil if nothing was ever stored.
+	Load() ([]byte, error)
+
+	// Store persists b, replacing previously stored data.
+	Store(b []byte) error
+}
+
+// storedCredentials is the on-storage representation of a credentials list.
+type storedCredentials struct {
+	Version     uint         `cbor:"1,keyasint"`
+	Credentials []Credential `cbor:"2,keyasint"`
+}
+
+// storedCredentialsVersion is the current credentials serialization format version.
+const storedCredentialsVersion = 1
+
+// persistentStore is a CredentialStore which keeps credentials in memory, and persists the whole
+// credential set on a Storage on each update.
+type persistentStore struct {
+	storage     Storage
+	credentials []Credential
+	lock        sync.Mutex
+}
+
+// NewCredentialStore returns a CredentialStore persisting data on s.
+// Existing credentials are loaded from s.
+func NewCredentialStore(s Storage) (CredentialStore, error) {
+	if s == nil {
+		return nil, errors.New("storage is nil")
+	}
+
+	data, err := s.Load()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load credentials, %w", err)
+	}
+
+	ps := &persistentStore{
+		storage: s,
+	}
+
+	if data == nil {
+		return ps, nil
+	}
+
+	var sc storedCredentials
+	if err := cbor.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("cannot decode credentials, %w", err)
+	}
+
+	if sc.Version != storedCredentialsVersion {
+		return nil, fmt.Errorf("unsupported credentials format version %d", sc.Version)
+	}
+
+	ps.credentials = sc.Credentials
+
+	return ps, nil
+}
+
+// Put implements the CredentialStore interface.
+func (p *persistentStore) Put(c Credential) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	creds := make([]Credential, 0, len(p.credentials)+1)
+	for _, ec := range p.credentials {
+		if ec.RPID == c.RPID && bytes.Equal(ec.UserHandle, c.UserHandle) {
+			continue
+		}
+
+		creds = append(creds, ec)
+	}
+
+	creds = append(creds, c)
+
+	data, err := cbor.Marshal(storedCredentials{
+		Version:     storedCredentialsVersion,
+		Credentials: creds,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot encode credentials, %w", err)
+	}
+
+	if err := p.storage.Store(data); err != nil {
+		return err
+	}
+
+	p.credentials = creds
+
+	return nil
+}
+
+// Get implements the CredentialStore interface.
+func (p *persistentStore) Get(id []byte) (Credential, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, c := range p.credentials {
+		if bytes.Equal(c.ID, id) {
+			return c, true, nil
+		}
+	}
+
+	return Credential{}, false, nil
+}
+
+// List implements the CredentialStore interface.
+func (p *persistentStore) List(rpID string) ([]Credential, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var ret []Credential
+	for i := len(p.credentials) - 1; i >= 0; i-- {
+		if p.credentials[i].RPID == rpID {
+			ret = append(ret, p.credentials[i])
+		}
+	}
+
+	return ret, nil
+}
+
+// CreateResident creates a new resident credential for the given relying party and user, and stores it in
+// the Keyring CredentialStore.
+// The credential private key is randomly generated, and stored encrypted.
+func (k *Keyring) CreateResident(rpID string, userHandle []byte, userName, userDisplayName string) (*ecdsa.PublicKey, Credential, error) {
+	if err := k.validate(); err != nil {
+		return nil, Credential{}, err
+	}
+
+	if k.Credentials == nil {
+		return nil, Credential{}, ErrNoStore
+	}
+
+	id, err := nonceFunc()
+	if err != nil {
+		return nil, Credential{}, err
+	}
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, Credential{}, err
+	}
+
+	c := Credential{
+		ID:              id,
+		RPID:            rpID,
+		UserHandle:      userHandle,
+		UserName:        userName,
+		UserDisplayName: userDisplayName,
+	}
+
+	c.EncryptedPrivateKey, err = k.encryptPrivkey(c, privKey)
+	if err != nil {
+		return nil, Credential{}, err
+	}
+
+	if err := k.Credentials.Put(c); err != nil {
+		return nil, Credential{}, err
+	}
+
+	return &privKey.PublicKey, c, nil
+}
+
+// ResidentCredentials returns the resident credentials stored for rpID, most recent first.
+func (k *Keyring) ResidentCredentials(rpID string) ([]Credential, error) {
+	if k.Credentials == nil {
+		return nil, nil
+	}
+
+	return k.Credentials.List(rpID)
+}
+
+// ResidentCredential returns the resident credential with the given ID, and false if it doesn't exist.
+func (k *Keyring) ResidentCredential(id []byte) (Credential, bool, error) {
+	if k.Credentials == nil {
+		return Credential{}, false, nil
+	}
+
+	return k.Credentials.Get(id)
+}
+
+// SignWithCredential returns an ECDSA signature of the SHA-256 hash of data, made with the private key
+// of the resident credential c.
+func (k *Keyring) SignWithCredential(c Credential, data []byte) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	privKey, err := k.decryptPrivkey(c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt credential private key, %w", err)
+	}
+
+	h := sha256.Sum256(data)
+
+	sign, err := ecdsa.SignASN1(rand.Reader, privKey, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot execute signature, %w", err)
+	}
+
+	return sign, nil
+}
+
+// credentialAEAD returns the AES-GCM instance used to encrypt resident credential private keys.
+func (k *Keyring) credentialAEAD() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.MasterKey)
+	_, err := mac.Write([]byte(credentialEncryptionLabel))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// credentialAdditionalData returns the data authenticated along with the encrypted private key of c,
+// which binds the key to its credential ID and relying party.
+func credentialAdditionalData(c Credential) []byte {
+	return append(append([]byte{}, c.ID...), c.RPID...)
+}
+
+// encryptPrivkey returns the encrypted private key for c, in the form nonce || ciphertext.
+func (k *Keyring) encryptPrivkey(c Credential, privKey *ecdsa.PrivateKey) ([]byte, error) {
+	aead, err := k.credentialAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	n := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(n); err != nil {
+		return nil, err
+	}
+
+	// private key scalar, zero-padded to the curve size
+	d := make([]byte, 32)
+	privKey.D.FillBytes(d)
+
+	return aead.Seal(n, n, d, credentialAdditionalData(c)), nil
+}
+
+// decryptPrivkey decrypts the private key of c.
+func (k *Keyring) decryptPrivkey(c Credential) (*ecdsa.PrivateKey, error) {
+	aead, err := k.credentialAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.EncryptedPrivateKey) < aead.NonceSize() {
+		return nil, errors.New("encrypted private key is too short")
+	}
+
+	n := c.EncryptedPrivateKey[:aead.NonceSize()]
+	d, err := aead.Open(nil, n, c.EncryptedPrivateKey[aead.NonceSize():], credentialAdditionalData(c))
+	if err != nil {
+		return nil, err
+	}
+
+	curve := elliptic.P256()
+
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = curve
+	priv.D = new(big.Int).SetBytes(d)
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	return priv, nil
+}
@@ -0,0 +1,180 @@
+package keyring_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/gsora/fidati/keyring"
+	"github.com/stretchr/testify/require"
+)
+
+type memStorage struct {
+	data          []byte
+	storeMustFail bool
+	loadMustFail  bool
+}
+
+func (m *memStorage) Load() ([]byte, error) {
+	if m.loadMustFail {
+		return nil, errors.New("cannot load")
+	}
+
+	return m.data, nil
+}
+
+func (m *memStorage) Store(b []byte) error {
+	if m.storeMustFail {
+		return errors.New("cannot store")
+	}
+
+	m.data = append([]byte{}, b...)
+	return nil
+}
+
+func TestNewCredentialStore(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(*testing.T)
+	}{
+		{
+			"nil storage",
+			func(t *testing.T) {
+				cs, err := keyring.NewCredentialStore(nil)
+				require.Error(t, err)
+				require.Nil(t, cs)
+			},
+		},
+		{
+			"storage cannot load",
+			func(t *testing.T) {
+				cs, err := keyring.NewCredentialStore(&memStorage{loadMustFail: true})
+				require.Error(t, err)
+				require.Nil(t, cs)
+			},
+		},
+		{
+			"storage holds garbage",
+			func(t *testing.T) {
+				cs, err := keyring.NewCredentialStore(&memStorage{data: []byte{0xff, 0xff}})
+				require.Error(t, err)
+				require.Nil(t, cs)
+			},
+		},
+		{
+			"credentials are persisted",
+			func(t *testing.T) {
+				s := &memStorage{}
+				cs, err := keyring.NewCredentialStore(s)
+				require.NoError(t, err)
+
+				c := keyring.Credential{
+					ID:         []byte{1},
+					RPID:       "rp",
+					UserHandle: []byte{2},
+				}
+
+				require.NoError(t, cs.Put(c))
+
+				cs, err = keyring.NewCredentialStore(s)
+				require.NoError(t, err)
+
+				got, found, err := cs.Get([]byte{1})
+				require.NoError(t, err)
+				require.True(t, found)
+				require.Equal(t, c.RPID, got.RPID)
+			},
+		},
+		{
+			"credential with same relying party and user handle is replaced",
+			func(t *testing.T) {
+				cs, err := keyring.NewCredentialStore(&memStorage{})
+				require.NoError(t, err)
+
+				require.NoError(t, cs.Put(keyring.Credential{ID: []byte{1}, RPID: "rp", UserHandle: []byte{2}}))
+				require.NoError(t, cs.Put(keyring.Credential{ID: []byte{3}, RPID: "rp", UserHandle: []byte{2}}))
+				require.NoError(t, cs.Put(keyring.Credential{ID: []byte{4}, RPID: "rp", UserHandle: []byte{5}}))
+				require.NoError(t, cs.Put(keyring.Credential{ID: []byte{6}, RPID: "other", UserHandle: []byte{2}}))
+
+				l, err := cs.List("rp")
+				require.NoError(t, err)
+				require.Len(t, l, 2)
+
+				// most recent first
+				require.Equal(t, []byte{4}, l[0].ID)
+				require.Equal(t, []byte{3}, l[1].ID)
+
+				_, found, err := cs.Get([]byte{1})
+				require.NoError(t, err)
+				require.False(t, found)
+			},
+		},
+		{
+			"failed store doesn't alter credentials",
+			func(t *testing.T) {
+				s := &memStorage{}
+				cs, err := keyring.NewCredentialStore(s)
+				require.NoError(t, err)
+
+				s.storeMustFail = true
+				require.Error(t, cs.Put(keyring.Credential{ID: []byte{1}, RPID: "rp"}))
+
+				l, err := cs.List("rp")
+				require.NoError(t, err)
+				require.Empty(t, l)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestKeyring_CreateResident(t *testing.T) {
+	t.Run("keyring without credential store", func(t *testing.T) {
+		k := keyring.New([]byte("key"), &testCounter{})
+
+		pk, c, err := k.CreateResident("rp", []byte{1}, "user", "User")
+		require.ErrorIs(t, err, keyring.ErrNoStore)
+		require.Nil(t, pk)
+		require.Empty(t, c)
+	})
+
+	t.Run("resident credential signs with its own key", func(t *testing.T) {
+		cs, err := keyring.NewCredentialStore(&memStorage{})
+		require.NoError(t, err)
+
+		k := keyring.New([]byte("key"), &testCounter{})
+		k.Credentials = cs
+
+		pk, c, err := k.CreateResident("rp", []byte{1}, "user", "User")
+		require.NoError(t, err)
+		require.NotNil(t, pk)
+		require.Len(t, c.ID, 32)
+
+		l, err := k.ResidentCredentials("rp")
+		require.NoError(t, err)
+		require.Len(t, l, 1)
+		require.Equal(t, "user", l[0].UserName)
+
+		data := []byte("data")
+		sign, err := k.SignWithCredential(l[0], data)
+		require.NoError(t, err)
+
+		h := sha256.Sum256(data)
+		require.True(t, ecdsa.VerifyASN1(pk, h[:], sign))
+
+		// a different master key cannot decrypt the private key
+		other := keyring.New([]byte("other key"), &testCounter{})
+		_, err = other.SignWithCredential(l[0], data)
+		require.Error(t, err)
+
+		// the private key is bound to its relying party
+		moved := l[0]
+		moved.RPID = "another rp"
+		_, err = k.SignWithCredential(moved, data)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,123 @@
+package keyring
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// keyHandleVersion identifies the layout of a key handle, and how the key it wraps is derived.
+type keyHandleVersion uint8
+
+const (
+	// keyHandleV0 handles were issued before key handles were versioned, and are made of
+	// HMAC-SHA256(appID || seed) || nonce, where seed is HMAC-SHA256(appID || nonce).
+	// They have no header, and are told apart from versioned ones by their length.
+	keyHandleV0 keyHandleVersion = 0
+
+	// keyHandleV1 handles are made of version || algorithm || nonce || MAC, where MAC authenticates all the
+	// preceding bytes and the appID.
+	keyHandleV1 keyHandleVersion = 1
+
+	// currentKeyHandleVersion is the version of the key handles returned by Register.
+	currentKeyHandleVersion = keyHandleV1
+)
+
+// algorithm identifies the kind of key wrapped in a key handle.
+type algorithm uint8
+
+const (
+	// algES256 is ECDSA over P-256, with SHA-256.
+	algES256 algorithm = 1
+)
+
+const (
+	nonceLen = 32
+	macLen   = sha256.Size
+
+	// keyHandleV0Len is the length of v0 key handles: key handles of any other version must not be that long.
+	keyHandleV0Len = macLen + nonceLen
+
+	keyHandleHeaderLen = 2
+	keyHandleV1Len     = keyHandleHeaderLen + nonceLen + macLen
+)
+
+// Domain separation bytes for the HMACs computed over versioned key handles.
+const (
+	purposeSeed = 0x01
+	purposeMAC  = 0x02
+)
+
+// keyHandle holds the fields of a key handle.
+type keyHandle struct {
+	version keyHandleVersion
+	alg     algorithm
+	nonce   []byte
+}
+
+// parseKeyHandle returns the fields of kh, and an error if its format is unknown.
+// The key handle MAC isn't checked.
+func parseKeyHandle(kh []byte) (keyHandle, error) {
+	switch {
+	case len(kh) == keyHandleV0Len:
+		return keyHandle{
+			version: keyHandleV0,
+			alg:     algES256,
+			nonce:   kh[macLen:],
+		}, nil
+	case len(kh) == keyHandleV1Len && keyHandleVersion(kh[0]) == keyHandleV1:
+		return keyHandle{
+			version: keyHandleV1,
+			alg:     algorithm(kh[1]),
+			nonce:   kh[keyHandleHeaderLen : keyHandleHeaderLen+nonceLen],
+		}, nil
+	default:
+		return keyHandle{}, fmt.Errorf("unknown format for key handle of length %d", len(kh))
+	}
+}
+
+// header returns the bytes preceding the nonce in a versioned key handle.
+func (h keyHandle) header() []byte {
+	return []byte{byte(h.version), byte(h.alg)}
+}
+
+// seed returns the secret the private key of h for appID is derived from.
+func (h keyHandle) seed(masterKey, appID []byte) []byte {
+	if h.version == keyHandleV0 {
+		return hmacSum(masterKey, appID, h.nonce)
+	}
+
+	return hmacSum(masterKey, []byte{purposeSeed}, h.header(), appID, h.nonce)
+}
+
+// bytes returns the key handle for appID.
+func (h keyHandle) bytes(masterKey, appID []byte) []byte {
+	if h.version == keyHandleV0 {
+		return append(hmacSum(masterKey, appID, h.seed(masterKey, appID)), h.nonce...)
+	}
+
+	kh := append(h.header(), h.nonce...)
+	return append(kh, hmacSum(masterKey, []byte{purposeMAC}, kh, appID)...)
+}
+
+// privateKey returns the private key of h for appID.
+func (h keyHandle) privateKey(masterKey, appID []byte) (*ecdsa.PrivateKey, error) {
+	switch h.alg {
+	case algES256:
+		return keygenFunc(h.seed(masterKey, appID))
+	default:
+		return nil, fmt.Errorf("unknown key handle algorithm %d", h.alg)
+	}
+}
+
+// hmacSum returns the HMAC-SHA256 of the concatenation of parts, keyed with key.
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		// hash.Hash never returns errors on Write
+		_, _ = mac.Write(p)
+	}
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,125 @@
+package keyring_test
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/gsora/fidati/keyring"
+	"github.com/stretchr/testify/require"
+)
+
+// v0KeyHandle returns a key handle built like the ones issued before key handles were versioned, and the seed of
+// its private key.
+func v0KeyHandle(masterKey, appID, nonce []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(appID)
+	mac.Write(nonce)
+	seed := mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write(appID)
+	mac.Write(seed)
+
+	return append(mac.Sum(nil), nonce...), seed
+}
+
+func TestKeyring_KeyHandleValid(t *testing.T) {
+	masterKey := []byte("key")
+	k := keyring.New(masterKey, &testCounter{})
+
+	appID := bytes.Repeat([]byte{42}, 32)
+	otherAppID := bytes.Repeat([]byte{43}, 32)
+
+	_, v1, err := k.Register(appID, nil)
+	require.NoError(t, err)
+
+	v0, _ := v0KeyHandle(masterKey, appID, bytes.Repeat([]byte{44}, 32))
+
+	tamper := func(kh []byte, i int) []byte {
+		ret := append([]byte{}, kh...)
+		ret[i] ^= 0xff
+		return ret
+	}
+
+	tests := []struct {
+		name      string
+		appID     []byte
+		keyHandle []byte
+		valid     bool
+	}{
+		{"v1", appID, v1, true},
+		{"v1, other appID", otherAppID, v1, false},
+		{"v1, unknown version", appID, tamper(v1, 0), false},
+		{"v1, other algorithm", appID, tamper(v1, 1), false},
+		{"v1, tampered nonce", appID, tamper(v1, 2), false},
+		{"v1, tampered MAC", appID, tamper(v1, len(v1)-1), false},
+		{"v1, truncated", appID, v1[:len(v1)-1], false},
+		{"v0", appID, v0, true},
+		{"v0, other appID", otherAppID, v0, false},
+		{"v0, tampered nonce", appID, tamper(v0, len(v0)-1), false},
+		{"v0, tampered MAC", appID, tamper(v0, 0), false},
+		{"empty", appID, nil, false},
+		{"nil appID", nil, v1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.valid, k.KeyHandleValid(tt.appID, tt.keyHandle))
+		})
+	}
+}
+
+func TestKeyring_Register_versioned(t *testing.T) {
+	k := keyring.New([]byte("key"), &testCounter{})
+	appID := bytes.Repeat([]byte{42}, 32)
+	nonce := bytes.Repeat([]byte{44}, 32)
+
+	pub, kh, err := k.Register(appID, nonce)
+	require.NoError(t, err)
+
+	// version, algorithm, nonce and MAC
+	require.Len(t, kh, 2+32+32)
+	require.Equal(t, []byte{1, 1}, kh[:2])
+	require.Equal(t, nonce, kh[2:34])
+	require.Equal(t, nonce, k.NonceFromKeyHandle(kh))
+
+	priv, err := keyring.RetrievePrivatekey(appID, kh, k.MasterKey)
+	require.NoError(t, err)
+	require.True(t, pub.Equal(&priv.PublicKey))
+
+	// the same nonce derives a different key than the v0 scheme
+	v0, _ := v0KeyHandle(k.MasterKey, appID, nonce)
+	v0Priv, err := keyring.RetrievePrivatekey(appID, v0, k.MasterKey)
+	require.NoError(t, err)
+	require.False(t, priv.Equal(v0Priv))
+
+	_, _, err = k.Register(appID, nonce[:16])
+	require.Error(t, err)
+}
+
+func TestKeyring_RetrievePrivatekey_v0(t *testing.T) {
+	masterKey := []byte("key")
+	appID := bytes.Repeat([]byte{42}, 32)
+
+	kh, seed := v0KeyHandle(masterKey, appID, bytes.Repeat([]byte{44}, 32))
+
+	priv, err := keyring.RetrievePrivatekey(appID, kh, masterKey)
+	require.NoError(t, err)
+
+	// v0 private keys are seed mod (N - 1) + 1
+	n := new(big.Int).Sub(elliptic.P256().Params().N, big.NewInt(1))
+	d := new(big.Int).Mod(new(big.Int).SetBytes(seed), n)
+	require.Equal(t, 0, d.Add(d, big.NewInt(1)).Cmp(priv.D))
+
+	k := keyring.New(masterKey, &testCounter{})
+	require.Equal(t, kh[32:], k.NonceFromKeyHandle(kh))
+
+	sig, counter, err := k.Authenticate(appID, bytes.Repeat([]byte{45}, 32), kh, true)
+	require.NoError(t, err)
+	require.NotNil(t, sig)
+	require.NotZero(t, counter)
+}
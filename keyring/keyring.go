@@ -16,20 +16,22 @@ import (
 var nonceFunc = nonce
 var keygenFunc = generateECKey
 
-// Counter is some sort of interface to a counter (like, a monotonic counter) and to a
-// user presence confirmation device.
+// Counter is some sort of interface to a counter (like, a monotonic counter).
+// User presence is confirmed by a presence.Provider.
 type Counter interface {
 	Increment(appID, challenge, keyHandle []byte) (uint32, error)
-	UserPresence() bool
 }
 
 // Keyring represents a mechanism to derive deterministic relying party authentication private keys
 // given a master key.
 // A Keyring needs a Counter to be able to pass along the counter value recommended by the FIDO U2F standard.
 // Keyring implements the key wrapping method described by Yubico: https://www.yubico.com/blog/yubicos-u2f-key-wrapping/.
+// Key handles are versioned, so that their derivation can change while keeping the ones issued before valid.
+// Credentials is optional, and holds resident credentials: when nil, only key-wrapped credentials are supported.
 type Keyring struct {
-	Counter   Counter
-	MasterKey []byte
+	Counter     Counter
+	MasterKey   []byte
+	Credentials CredentialStore
 }
 
 func (k *Keyring) validate() error {
@@ -51,19 +53,22 @@ func New(mk []byte, counter Counter) *Keyring {
 	}
 }
 
-// NonceFromKeyHandle returns the nonce from a given keyhandle.
-// Assumes SHA-256 as hashing function.
+// NonceFromKeyHandle returns the nonce from a given keyhandle, of any known version.
+// It returns nil if the key handle format is unknown.
 func (k *Keyring) NonceFromKeyHandle(kh []byte) []byte {
-	if len(kh) < sha256.Size {
+	h, err := parseKeyHandle(kh)
+	if err != nil {
 		return nil
 	}
 
-	return kh[sha256.Size:]
+	return h.nonce
 }
 
 // Register deterministically derives an ECDSA public key given an application ID.
-// It also returns a key handle (also deterministic) and an error.
+// It also returns a key handle (also deterministic) of the current version, and an error.
 // If nonce is not nil, it will be used for the derivation process.
+// Since version 1 key handles hold a fixed-size nonce, Register returns an error if nonce is not 32 bytes long:
+// previous releases accepted nonces of any length.
 func (k *Keyring) Register(appID []byte, nonce []byte) (*ecdsa.PublicKey, []byte, error) {
 	if err := k.validate(); err != nil {
 		return nil, nil, err
@@ -81,68 +86,34 @@ func (k *Keyring) Register(appID []byte, nonce []byte) (*ecdsa.PublicKey, []byte
 		}
 	}
 
-	mac := hmac.New(sha256.New, k.MasterKey)
-	_, err := mac.Write(appID)
-	if err != nil {
-		return nil, nil, err
+	if len(nonce) != nonceLen {
+		return nil, nil, fmt.Errorf("nonce is %d bytes long, must be %d", len(nonce), nonceLen)
 	}
 
-	_, err = mac.Write(nonce)
-	if err != nil {
-		return nil, nil, err
+	h := keyHandle{
+		version: currentKeyHandleVersion,
+		alg:     algES256,
+		nonce:   nonce,
 	}
 
-	rpPrivKey := mac.Sum(nil)
-
-	mac.Reset()
-
-	_, err = mac.Write(appID)
+	ecPrivKey, err := h.privateKey(k.MasterKey, appID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	_, err = mac.Write(rpPrivKey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	keyHandle := append(mac.Sum(nil), nonce...)
-
-	ecPrivKey, err := keygenFunc(rpPrivKey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return &ecPrivKey.PublicKey, keyHandle, nil
+	return &ecPrivKey.PublicKey, h.bytes(k.MasterKey, appID), nil
 }
 
-// retrievePrivkey returns the private key associated to a given application ID and key handle.
+// retrievePrivkey returns the private key associated to a given application ID and key handle, of any known
+// version.
+// The key handle MAC isn't checked, use KeyHandleValid for that.
 func retrievePrivkey(appID, keyHandle, masterKey []byte) (*ecdsa.PrivateKey, error) {
-	if len(keyHandle) < 32 {
-		return nil, errors.New("key handle is shorter than 32 bytes")
-	}
-
-	nonce := keyHandle[32:]
-
-	mac := hmac.New(sha256.New, masterKey)
-	_, err := mac.Write(appID)
+	h, err := parseKeyHandle(keyHandle)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = mac.Write(nonce)
-	if err != nil {
-		return nil, err
-	}
-
-	rpPrivKey := mac.Sum(nil)
-
-	ecPrivKey, err := keygenFunc(rpPrivKey)
-	if err != nil {
-		return nil, err
-	}
-
-	return ecPrivKey, nil
+	return h.privateKey(masterKey, appID)
 }
 
 // Authenticate returns a valid FIDO2 U2F authentication signature for the given application ID,
@@ -195,6 +166,44 @@ func (k *Keyring) Authenticate(appID, challenge, keyHandle []byte, userPresence
 	return sign, count, nil
 }
 
+// KeyHandleValid returns true if keyHandle has been generated by k for appID, with any known version.
+func (k *Keyring) KeyHandleValid(appID, keyHandle []byte) bool {
+	if k.validate() != nil || appID == nil {
+		return false
+	}
+
+	h, err := parseKeyHandle(keyHandle)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(h.bytes(k.MasterKey, appID), keyHandle)
+}
+
+// Sign returns an ECDSA signature of the SHA-256 hash of data, made with the private key associated to
+// the given application ID and key handle.
+// Unlike Authenticate, Sign doesn't build the signature payload nor touch the counter: callers which
+// need a different payload layout (like CTAP2 authenticator data) are responsible for that.
+func (k *Keyring) Sign(appID, keyHandle, data []byte) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	privKey, err := retrievePrivkey(appID, keyHandle, k.MasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive private key from appID and keyHandle, %w", err)
+	}
+
+	h := sha256.Sum256(data)
+
+	sign, err := ecdsa.SignASN1(rand.Reader, privKey, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot execute signature, %w", err)
+	}
+
+	return sign, nil
+}
+
 // signaturePayload returns the byte slice to be signed to validate an authentication request.
 func signaturePayload(appParam []byte, counter uint32, challengeParam []byte, userPresenceByte byte) []byte {
 	ret := new(bytes.Buffer)
@@ -213,7 +222,7 @@ func signaturePayload(appParam []byte, counter uint32, challengeParam []byte, us
 
 // nonce returns a byte slice with 32 bytes of randomness inside.
 func nonce() ([]byte, error) {
-	n := make([]byte, 32)
+	n := make([]byte, nonceLen)
 	_, err := rand.Read(n)
 	return n, err
 }
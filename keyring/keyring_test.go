@@ -12,7 +12,6 @@ import (
 
 type testCounter struct {
 	i                 uint32
-	userPresent       bool
 	incrementMustFail bool
 }
 
@@ -25,10 +24,6 @@ func (t *testCounter) Increment(appID []byte, challenge []byte, keyHandle []byte
 	return t.i, nil
 }
 
-func (t *testCounter) UserPresence() bool {
-	return t.userPresent
-}
-
 var nonceErr = func() ([]byte, error) {
 	return nil, errors.New("nonce generation error")
 }
@@ -159,7 +154,7 @@ func TestKeyring_Register(t *testing.T) {
 				}()
 			}
 
-			pubKey, keyHandle, err := tt.kr.Register(tt.appID)
+			pubKey, keyHandle, err := tt.kr.Register(tt.appID, nil)
 
 			if tt.wantErr {
 				t.Log("error:", err)
@@ -176,6 +171,27 @@ func TestKeyring_Register(t *testing.T) {
 	}
 }
 
+func TestKeyring_RegisterNonce(t *testing.T) {
+	k := keyring.New([]byte("key"), &testCounter{})
+
+	t.Run("nonce is embedded in the key handle", func(t *testing.T) {
+		nonce := bytes.Repeat([]byte{0x42}, 32)
+
+		_, kh, err := k.Register([]byte("appID"), nonce)
+		require.NoError(t, err)
+		require.Equal(t, nonce, k.NonceFromKeyHandle(kh))
+	})
+
+	t.Run("nonce must be 32 bytes long", func(t *testing.T) {
+		for _, l := range []int{1, 31, 33, 64} {
+			pubKey, kh, err := k.Register([]byte("appID"), make([]byte, l))
+			require.Error(t, err)
+			require.Nil(t, pubKey)
+			require.Nil(t, kh)
+		}
+	})
+}
+
 func TestKeyring_RetrievePrivatekey(t *testing.T) {
 	appID := bytes.Repeat([]byte{42}, 64)
 	keyHandle := bytes.Repeat([]byte{43}, 64)
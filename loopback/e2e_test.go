@@ -0,0 +1,202 @@
+package loopback
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/attestation"
+	"github.com/gsora/fidati/client"
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+	"github.com/gsora/fidati/u2fhid"
+	"github.com/gsora/fidati/u2ftoken"
+	"github.com/stretchr/testify/require"
+)
+
+type test struct {
+	name string
+	f    func(*testing.T)
+}
+
+type testCounter struct {
+	i uint32
+}
+
+func (t *testCounter) Increment(_ []byte, _ []byte, _ []byte) (uint32, error) {
+	t.i++
+	return t.i, nil
+}
+
+// newTestDevice returns a client.Device connected to a fidati U2F token, backed by the repository attestation
+// certificate and key, whose user is always present.
+// It also returns the DER-encoded attestation certificate.
+func newTestDevice(t *testing.T) (*client.Device, []byte) {
+	cert, err := ioutil.ReadFile("../certs/attestation_certificate.pem")
+	require.NoError(t, err)
+
+	key, err := ioutil.ReadFile("../certs/ecdsa_privkey.pem")
+	require.NoError(t, err)
+
+	present := presence.Func(func(_ context.Context) error {
+		return nil
+	})
+
+	token, err := u2ftoken.New(keyring.New([]byte("key"), &testCounter{}), present, cert, key)
+	require.NoError(t, err)
+
+	h, err := u2fhid.NewHandler(token)
+	require.NoError(t, err)
+
+	l, err := New(h)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, l.Close())
+	})
+
+	d, err := client.Open(l)
+	require.NoError(t, err)
+
+	der, _, err := attestation.ParseCertificate(cert)
+	require.NoError(t, err)
+
+	return d, der
+}
+
+func TestEndToEnd(t *testing.T) {
+	challenge := sha256.Sum256([]byte("challenge"))
+	application := sha256.Sum256([]byte("https://example.com"))
+
+	tests := []test{
+		{
+			"ping",
+			func(t *testing.T) {
+				d, _ := newTestDevice(t)
+
+				data := bytes.Repeat([]byte{42}, 1024)
+
+				resp, err := d.Ping(data)
+				require.NoError(t, err)
+				require.Equal(t, data, resp)
+			},
+		},
+		{
+			"version",
+			func(t *testing.T) {
+				d, _ := newTestDevice(t)
+
+				v, err := d.Version()
+				require.NoError(t, err)
+				require.Equal(t, "U2F_V2", v)
+
+				// short length APDUs, with and without Le
+				for _, apdu := range [][]byte{{0, 3, 0, 0}, {0, 3, 0, 0, 0}} {
+					resp, err := d.Message(apdu)
+					require.NoError(t, err)
+					require.Equal(t, append([]byte("U2F_V2"), 0x90, 0x00), resp)
+				}
+
+				resp, err := d.Message([]byte{0, 3})
+				require.NoError(t, err)
+				require.Equal(t, []byte{0x67, 0x00}, resp)
+			},
+		},
+		{
+			"register and authenticate",
+			func(t *testing.T) {
+				d, cert := newTestDevice(t)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				reg, err := d.Register(ctx, challenge[:], application[:])
+				require.NoError(t, err)
+				require.Equal(t, cert, reg.AttestationCertificate)
+				require.NoError(t, reg.Verify(challenge[:], application[:]))
+
+				known, err := d.CheckKeyHandle(challenge[:], application[:], reg.KeyHandle)
+				require.NoError(t, err)
+				require.True(t, known)
+
+				var last uint32
+				for i := 0; i < 2; i++ {
+					a, err := d.Authenticate(ctx, challenge[:], application[:], reg.KeyHandle)
+					require.NoError(t, err)
+					require.Equal(t, uint8(1), a.UserPresence)
+					require.Greater(t, a.Counter, last)
+					require.NoError(t, a.Verify(reg.PublicKey, challenge[:], application[:]))
+
+					last = a.Counter
+				}
+			},
+		},
+		{
+			"short APDU registration is chained",
+			func(t *testing.T) {
+				d, cert := newTestDevice(t)
+
+				apdu := append([]byte{0, 1, 0, 0, 64}, challenge[:]...)
+				apdu = append(apdu, application[:]...)
+				apdu = append(apdu, 0)
+
+				var reg []byte
+				for {
+					resp, err := d.Message(apdu)
+					require.NoError(t, err)
+					require.LessOrEqual(t, len(resp), 256+2)
+
+					sw := resp[len(resp)-2:]
+					reg = append(reg, resp[:len(resp)-2]...)
+
+					if sw[0] == 0x90 {
+						require.Equal(t, uint8(0), sw[1])
+						break
+					}
+
+					// the user presence confirmation is still pending
+					if sw[0] == 0x69 && sw[1] == 0x85 {
+						time.Sleep(50 * time.Millisecond)
+						continue
+					}
+
+					require.Equal(t, uint8(0x61), sw[0])
+
+					// GET RESPONSE
+					apdu = []byte{0, 0xc0, 0, 0, 0}
+				}
+
+				require.Greater(t, len(reg), 256)
+				require.True(t, bytes.Contains(reg, cert))
+			},
+		},
+		{
+			"key handles are bound to their application",
+			func(t *testing.T) {
+				d, _ := newTestDevice(t)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				reg, err := d.Register(ctx, challenge[:], application[:])
+				require.NoError(t, err)
+
+				other := sha256.Sum256([]byte("https://example.org"))
+
+				known, err := d.CheckKeyHandle(challenge[:], other[:], reg.KeyHandle)
+				require.NoError(t, err)
+				require.False(t, known)
+
+				_, err = d.Authenticate(ctx, challenge[:], other[:], reg.KeyHandle)
+				require.True(t, errors.Is(err, client.ErrWrongData))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
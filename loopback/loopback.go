@@ -0,0 +1,122 @@
+// Package loopback connects a u2fhid.Handler to an in-process host, which exchanges 64 bytes reports with it
+// through a pair of pipes instead of USB.
+package loopback
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/u2fhid"
+)
+
+// reportLen is the length of each report exchanged with the Handler.
+const reportLen = 64
+
+// Loopback is the host side of a u2fhid.Handler, to be used as a HID device: each Write sends a report to the
+// Handler, each Read returns a report sent by it.
+type Loopback struct {
+	h *u2fhid.Handler
+
+	// host side of the pipes
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	done    chan struct{}
+	workers sync.WaitGroup
+	once    sync.Once
+}
+
+// New returns a Loopback connected to h, which receives the messages sent by h through h.Outbound.
+// The Loopback must be closed once done with it, which closes h too.
+func New(h *u2fhid.Handler) (*Loopback, error) {
+	if h == nil {
+		return nil, errors.New("handler is nil")
+	}
+
+	hostR, deviceW := io.Pipe()
+	deviceR, hostW := io.Pipe()
+
+	l := &Loopback{
+		h:    h,
+		r:    hostR,
+		w:    hostW,
+		done: make(chan struct{}),
+	}
+
+	l.workers.Add(2)
+	go l.rx(h, deviceR)
+	go l.tx(h, deviceW)
+
+	return l, nil
+}
+
+// rx passes every report written by the host to h.
+func (l *Loopback) rx(h *u2fhid.Handler, r *io.PipeReader) {
+	defer l.workers.Done()
+
+	for {
+		buf := make([]byte, reportLen)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			r.CloseWithError(err)
+			return
+		}
+
+		if _, err := h.Rx(buf, nil); err != nil {
+			flog.Logger.Println("rx error:", err)
+		}
+	}
+}
+
+// tx passes every report sent by h to the host.
+func (l *Loopback) tx(h *u2fhid.Handler, w *io.PipeWriter) {
+	defer l.workers.Done()
+
+	out := h.Outbound()
+
+	for {
+		select {
+		case <-l.done:
+			w.Close()
+			return
+		case res, ok := <-out:
+			if !ok {
+				w.Close()
+				return
+			}
+
+			if _, err := w.Write(res); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read reads the next report sent by the Handler into b, blocking until there's one.
+func (l *Loopback) Read(b []byte) (int, error) {
+	return l.r.Read(b)
+}
+
+// Write sends b to the Handler as a report.
+func (l *Loopback) Write(b []byte) (int, error) {
+	if len(b) != reportLen {
+		return 0, errors.New("reports must be 64 bytes long")
+	}
+
+	return l.w.Write(b)
+}
+
+// Close disconnects l from the Handler, and closes it.
+// Pending and future Read and Write calls return an error.
+func (l *Loopback) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.h.Close()
+		l.w.Close()
+		l.r.Close()
+		l.workers.Wait()
+	})
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package loopback
+
+import (
+	"testing"
+
+	"github.com/gsora/fidati/u2fhid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	l, err := New(nil)
+	require.Error(t, err)
+	require.Nil(t, l)
+}
+
+func TestLoopback(t *testing.T) {
+	h, err := u2fhid.NewHandler(echoToken{})
+	require.NoError(t, err)
+
+	l, err := New(h)
+	require.NoError(t, err)
+
+	_, err = l.Write([]byte{1, 2, 3})
+	require.Error(t, err, "reports must be 64 bytes long")
+
+	init := make([]byte, reportLen)
+	copy(init, []byte{0xff, 0xff, 0xff, 0xff, 0x86, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+
+	_, err = l.Write(init)
+	require.NoError(t, err)
+
+	resp := make([]byte, reportLen)
+	_, err = l.Read(resp)
+	require.NoError(t, err)
+
+	ping := make([]byte, reportLen)
+	copy(ping, resp[15:19])
+	copy(ping[4:], []byte{0x81, 0, 1, 42})
+
+	_, err = l.Write(ping)
+	require.NoError(t, err)
+
+	n, err := l.Read(resp)
+	require.NoError(t, err)
+	require.Equal(t, reportLen, n)
+	require.Equal(t, ping, resp)
+
+	require.NoError(t, l.Close())
+	require.NoError(t, l.Close())
+
+	_, err = l.Read(resp)
+	require.Error(t, err)
+
+	_, err = l.Write(ping)
+	require.Error(t, err)
+}
+
+// echoToken is a u2fhid.Token which echoes requests back.
+type echoToken struct{}
+
+func (echoToken) HandleMessage(b []byte) []byte {
+	return b
+}
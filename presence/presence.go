@@ -0,0 +1,180 @@
+// Package presence implements user presence tests, the "touch the key" step of FIDO protocols.
+package presence
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDenied is returned by a Provider when the user explicitly refused to confirm presence.
+var ErrDenied = errors.New("user presence denied")
+
+// Provider is a user presence test.
+type Provider interface {
+	// Wait blocks until the user confirms presence, or ctx is done.
+	// It returns nil if presence was confirmed, ctx.Err() if ctx is done first, or ErrDenied if the user
+	// refused to confirm.
+	Wait(ctx context.Context) error
+}
+
+// Func is a function used as a Provider.
+type Func func(ctx context.Context) error
+
+// Wait implements the Provider interface.
+func (f Func) Wait(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Always is a Provider which always confirms user presence, without any user interaction.
+// It should only be used for testing.
+var Always Provider = Func(func(_ context.Context) error {
+	return nil
+})
+
+// Any returns a Provider which waits on all providers at once, and returns as soon as one of them confirms
+// presence.
+// If all providers fail, the first error is returned.
+func Any(providers ...Provider) Provider {
+	return Func(func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		errs := make(chan error, len(providers))
+		for _, p := range providers {
+			go func(p Provider) {
+				errs <- p.Wait(ctx)
+			}(p)
+		}
+
+		var firstErr error
+		for range providers {
+			err := <-errs
+			if err == nil {
+				return nil
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		return firstErr
+	})
+}
+
+// notifierKey is the context key holding the function registered with WithNotifier.
+type notifierKey struct{}
+
+// WithNotifier returns a copy of ctx which makes Wait call f with true before waiting for the user,
+// and with false once the wait is over.
+// Transports use it to tell the host that the token is waiting for the user.
+func WithNotifier(ctx context.Context, f func(waiting bool)) context.Context {
+	return context.WithValue(ctx, notifierKey{}, f)
+}
+
+// Wait waits for p to confirm presence, notifying the function registered on ctx with WithNotifier, if any.
+func Wait(ctx context.Context, p Provider) error {
+	if f, ok := ctx.Value(notifierKey{}).(func(bool)); ok {
+		f(true)
+		defer f(false)
+	}
+
+	return p.Wait(ctx)
+}
+
+// Signal is a Provider confirmed by calling Confirm, for example from a goroutine reading keypresses
+// or polling a button.
+// Confirmations sent while nobody is waiting are discarded, so that presence can't be confirmed in advance.
+type Signal struct {
+	c chan struct{}
+}
+
+// NewSignal returns a new Signal.
+func NewSignal() *Signal {
+	return &Signal{
+		c: make(chan struct{}),
+	}
+}
+
+// Confirm confirms user presence to a pending Wait, if any.
+// It returns true if a Wait call was pending.
+func (s *Signal) Confirm() bool {
+	select {
+	case s.c <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait implements the Provider interface.
+func (s *Signal) Wait(ctx context.Context) error {
+	select {
+	case <-s.c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Poller adapts a Provider to the U2F model, where the token answers immediately with a
+// "conditions not satisfied" status and the host retries the request until the user confirms presence.
+type Poller struct {
+	provider Provider
+	timeout  time.Duration
+
+	lock      sync.Mutex
+	waiting   bool
+	confirmed time.Time
+}
+
+// NewPoller returns a Poller for p.
+// Each presence request lasts timeout, and a confirmation is valid for the same amount of time.
+func NewPoller(p Provider, timeout time.Duration) *Poller {
+	return &Poller{
+		provider: p,
+		timeout:  timeout,
+	}
+}
+
+// Present returns true if the user confirmed presence since the last call which returned true.
+// Otherwise, it starts a presence request in background if there's none pending, and returns false.
+func (p *Poller) Present() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.confirmed.IsZero() {
+		valid := time.Since(p.confirmed) < p.timeout
+
+		// a confirmation can only be used once
+		p.confirmed = time.Time{}
+
+		if valid {
+			return true
+		}
+	}
+
+	if !p.waiting {
+		p.waiting = true
+		go p.wait()
+	}
+
+	return false
+}
+
+func (p *Poller) wait() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err := p.provider.Wait(ctx)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.waiting = false
+	if err == nil {
+		p.confirmed = time.Now()
+	}
+}
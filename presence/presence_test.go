@@ -0,0 +1,117 @@
+package presence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignal(t *testing.T) {
+	t.Run("confirmations without waiters are discarded", func(t *testing.T) {
+		s := presence.NewSignal()
+		require.False(t, s.Confirm())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, s.Wait(ctx), context.DeadlineExceeded)
+	})
+
+	t.Run("confirmation", func(t *testing.T) {
+		s := presence.NewSignal()
+
+		go func() {
+			for !s.Confirm() {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		require.NoError(t, s.Wait(context.Background()))
+	})
+}
+
+func TestAny(t *testing.T) {
+	denied := presence.Func(func(_ context.Context) error {
+		return presence.ErrDenied
+	})
+
+	t.Run("first confirmation wins", func(t *testing.T) {
+		s := presence.NewSignal()
+		require.NoError(t, presence.Any(s, denied, presence.Always).Wait(context.Background()))
+	})
+
+	t.Run("all providers fail", func(t *testing.T) {
+		require.ErrorIs(t, presence.Any(denied, denied).Wait(context.Background()), presence.ErrDenied)
+	})
+
+	t.Run("first error is returned", func(t *testing.T) {
+		s := presence.NewSignal()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, presence.Any(s, denied).Wait(ctx), presence.ErrDenied)
+		require.ErrorIs(t, presence.Any(s).Wait(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestWait(t *testing.T) {
+	t.Run("without notifier", func(t *testing.T) {
+		require.NoError(t, presence.Wait(context.Background(), presence.Always))
+	})
+
+	t.Run("notifier is called around the wait", func(t *testing.T) {
+		var calls []bool
+		ctx := presence.WithNotifier(context.Background(), func(waiting bool) {
+			calls = append(calls, waiting)
+		})
+
+		p := presence.Func(func(_ context.Context) error {
+			require.Equal(t, []bool{true}, calls)
+			return presence.ErrDenied
+		})
+
+		require.ErrorIs(t, presence.Wait(ctx, p), presence.ErrDenied)
+		require.Equal(t, []bool{true, false}, calls)
+	})
+}
+
+func TestPoller(t *testing.T) {
+	t.Run("presence is requested in background", func(t *testing.T) {
+		s := presence.NewSignal()
+		p := presence.NewPoller(s, time.Second)
+
+		require.False(t, p.Present())
+
+		// the background request is now waiting
+		require.Eventually(t, s.Confirm, time.Second, time.Millisecond)
+		require.Eventually(t, p.Present, time.Second, time.Millisecond)
+
+		// confirmations are consumed
+		require.False(t, p.Present())
+	})
+
+	t.Run("denied presence", func(t *testing.T) {
+		calls := make(chan struct{}, 2)
+		p := presence.NewPoller(presence.Func(func(_ context.Context) error {
+			calls <- struct{}{}
+			return presence.ErrDenied
+		}), time.Second)
+
+		require.False(t, p.Present())
+		<-calls
+
+		require.Never(t, p.Present, 50*time.Millisecond, time.Millisecond)
+	})
+
+	t.Run("expired confirmation", func(t *testing.T) {
+		p := presence.NewPoller(presence.Always, 10*time.Millisecond)
+
+		require.False(t, p.Present())
+		time.Sleep(50 * time.Millisecond)
+
+		require.False(t, p.Present())
+	})
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// File is a BlockDevice backed by a disk image file.
+type File struct {
+	f    *os.File
+	info Info
+}
+
+// OpenFile opens the disk image at path as a device of blocks blocks of blockSize bytes.
+// The image is created if it doesn't exist, and zero-extended if it's smaller than the device size.
+func OpenFile(path string, blockSize, blocks int) (*File, error) {
+	if blockSize <= 0 || blocks <= 0 {
+		return nil, fmt.Errorf("invalid geometry, %d blocks of %d bytes", blocks, blockSize)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := int64(blockSize) * int64(blocks)
+	if st.Size() < size {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &File{
+		f: f,
+		info: Info{
+			BlockSize: blockSize,
+			Blocks:    blocks,
+		},
+	}, nil
+}
+
+// Close closes the underlying disk image file.
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// Info implements the BlockDevice interface.
+func (f *File) Info() Info {
+	return f.info
+}
+
+// ReadBlocks implements the BlockDevice interface.
+func (f *File) ReadBlocks(lba int, buf []byte) error {
+	if err := checkRange(f.info, lba, len(buf)); err != nil {
+		return err
+	}
+
+	_, err := f.f.ReadAt(buf, int64(lba)*int64(f.info.BlockSize))
+	return err
+}
+
+// WriteBlocks implements the BlockDevice interface.
+// Data is synced to disk before returning.
+func (f *File) WriteBlocks(lba int, buf []byte) error {
+	if err := checkRange(f.info, lba, len(buf)); err != nil {
+		return err
+	}
+
+	if _, err := f.f.WriteAt(buf, int64(lba)*int64(f.info.BlockSize)); err != nil {
+		return err
+	}
+
+	return f.f.Sync()
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+)
+
+const (
+	// journalMagic marks the beginning of a journal record.
+	journalMagic uint32 = 0x6c6e6a66 // "fjnl", little-endian
+
+	// journalHeaderLen is the length of a journal record header: magic, sequence number, data length and CRC.
+	journalHeaderLen = 4 + 8 + 4 + 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Journal is a crash-safe, wear-levelled storage area for a small opaque byte slice, built on a
+// range of blocks of a BlockDevice.
+//
+// The range is split in slots of equal size, each holding a record made of a header followed by data.
+// The header holds a magic number, a sequence number, the data length and a CRC of both header and data.
+// Records are written in the slot following the most recent one, wrapping around at the end of the range:
+// the slot holding the most recent record is never overwritten, so a power loss during a write leaves
+// it intact, and writes are spread across all the slots.
+// On load, the valid record with the highest sequence number is picked.
+//
+// Journal implements keyring.Storage.
+type Journal struct {
+	dev        BlockDevice
+	lba        int
+	slots      int
+	slotBlocks int
+
+	// state of the most recent valid record
+	seq  uint64
+	last int
+	data []byte
+
+	lock sync.Mutex
+}
+
+// NewJournal returns a Journal on the blocks range of dev starting at lba, split in slots of slotBlocks blocks each.
+// blocks must be a multiple of slotBlocks, and hold at least two slots.
+// The most recent valid record is recovered from the device.
+func NewJournal(dev BlockDevice, lba, blocks, slotBlocks int) (*Journal, error) {
+	if dev == nil {
+		return nil, errors.New("block device is nil")
+	}
+
+	if slotBlocks <= 0 || blocks%slotBlocks != 0 || blocks/slotBlocks < 2 {
+		return nil, fmt.Errorf("%d blocks can't be split in at least two slots of %d blocks", blocks, slotBlocks)
+	}
+
+	if err := checkRange(dev.Info(), lba, blocks*dev.Info().BlockSize); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		dev:        dev,
+		lba:        lba,
+		slots:      blocks / slotBlocks,
+		slotBlocks: slotBlocks,
+		last:       -1,
+	}
+
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// recover scans all the slots, looking for the valid record with the highest sequence number.
+func (j *Journal) recover() error {
+	buf := make([]byte, j.slotSize())
+
+	for i := 0; i < j.slots; i++ {
+		if err := j.dev.ReadBlocks(j.slotLBA(i), buf); err != nil {
+			return fmt.Errorf("cannot read journal slot %d, %w", i, err)
+		}
+
+		seq, data, ok := parseRecord(buf)
+		if !ok {
+			continue
+		}
+
+		if j.last == -1 || seq > j.seq {
+			j.seq = seq
+			j.last = i
+			j.data = append([]byte{}, data...)
+		}
+	}
+
+	return nil
+}
+
+// Load returns the data held by the most recent valid record, or nil if there's none.
+func (j *Journal) Load() ([]byte, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.data == nil {
+		return nil, nil
+	}
+
+	return append([]byte{}, j.data...), nil
+}
+
+// Store writes b in a new record.
+// It returns ErrNoSpace if b doesn't fit in a slot.
+func (j *Journal) Store(b []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if len(b)+journalHeaderLen > j.slotSize() {
+		return fmt.Errorf("%d bytes don't fit in a %d bytes journal slot, %w", len(b), j.slotSize(), ErrNoSpace)
+	}
+
+	seq := j.seq + 1
+	slot := (j.last + 1) % j.slots
+
+	if err := j.dev.WriteBlocks(j.slotLBA(slot), buildRecord(seq, b, j.slotSize())); err != nil {
+		return fmt.Errorf("cannot write journal slot %d, %w", slot, err)
+	}
+
+	j.seq = seq
+	j.last = slot
+	j.data = append([]byte{}, b...)
+
+	return nil
+}
+
+func (j *Journal) slotSize() int {
+	return j.slotBlocks * j.dev.Info().BlockSize
+}
+
+func (j *Journal) slotLBA(slot int) int {
+	return j.lba + slot*j.slotBlocks
+}
+
+// buildRecord returns a slotSize bytes long record holding seq and data.
+func buildRecord(seq uint64, data []byte, slotSize int) []byte {
+	rec := make([]byte, slotSize)
+
+	binary.LittleEndian.PutUint32(rec[0:], journalMagic)
+	binary.LittleEndian.PutUint64(rec[4:], seq)
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(data)))
+	copy(rec[journalHeaderLen:], data)
+
+	crc := crc32.Update(crc32.Checksum(rec[:16], crcTable), crcTable, data)
+	binary.LittleEndian.PutUint32(rec[16:], crc)
+
+	return rec
+}
+
+// parseRecord returns sequence number and data of the record in rec, and false if it isn't a valid record.
+func parseRecord(rec []byte) (uint64, []byte, bool) {
+	if len(rec) < journalHeaderLen || binary.LittleEndian.Uint32(rec[0:]) != journalMagic {
+		return 0, nil, false
+	}
+
+	seq := binary.LittleEndian.Uint64(rec[4:])
+
+	// compare before converting, since a corrupted length might not fit an int on 32 bits targets
+	length := binary.LittleEndian.Uint32(rec[12:])
+	if length > uint32(len(rec)-journalHeaderLen) {
+		return 0, nil, false
+	}
+
+	data := rec[journalHeaderLen : journalHeaderLen+int(length)]
+
+	crc := crc32.Update(crc32.Checksum(rec[:16], crcTable), crcTable, data)
+	if crc != binary.LittleEndian.Uint32(rec[16:]) {
+		return 0, nil, false
+	}
+
+	return seq, data, true
+}
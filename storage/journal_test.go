@@ -0,0 +1,200 @@
+package storage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/storage"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	blockSize  = 512
+	journalLBA = 2
+	slotBlocks = 2
+	slots      = 4
+)
+
+// recorder is a BlockDevice which records the first block written by every WriteBlocks call, and can
+// simulate a power loss by writing only part of the buffer.
+type recorder struct {
+	*storage.Memory
+	writes []int
+	torn   bool
+}
+
+func (r *recorder) WriteBlocks(lba int, buf []byte) error {
+	r.writes = append(r.writes, lba)
+
+	if r.torn {
+		// only the first block makes it to the device
+		return r.Memory.WriteBlocks(lba, buf[:blockSize])
+	}
+
+	return r.Memory.WriteBlocks(lba, buf)
+}
+
+func newJournal(t *testing.T, dev storage.BlockDevice) *storage.Journal {
+	j, err := storage.NewJournal(dev, journalLBA, slots*slotBlocks, slotBlocks)
+	require.NoError(t, err)
+
+	return j
+}
+
+func TestNewJournal(t *testing.T) {
+	tests := []struct {
+		name       string
+		dev        storage.BlockDevice
+		lba        int
+		blocks     int
+		slotBlocks int
+		wantErr    bool
+	}{
+		{"nil device", nil, 0, 4, 2, true},
+		{"single slot", storage.NewMemory(blockSize, 16), 0, 2, 2, true},
+		{"blocks not multiple of slot size", storage.NewMemory(blockSize, 16), 0, 5, 2, true},
+		{"zero slot size", storage.NewMemory(blockSize, 16), 0, 4, 0, true},
+		{"out of range", storage.NewMemory(blockSize, 16), 14, 4, 2, true},
+		{"valid", storage.NewMemory(blockSize, 16), 12, 4, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := storage.NewJournal(tt.dev, tt.lba, tt.blocks, tt.slotBlocks)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestJournal(t *testing.T) {
+	t.Run("empty device holds no data", func(t *testing.T) {
+		data, err := newJournal(t, storage.NewMemory(blockSize, 16)).Load()
+		require.NoError(t, err)
+		require.Nil(t, data)
+	})
+
+	t.Run("data is recovered from the device", func(t *testing.T) {
+		dev := storage.NewMemory(blockSize, 16)
+		j := newJournal(t, dev)
+
+		for i := byte(0); i < 10; i++ {
+			require.NoError(t, j.Store([]byte{i, i, i}))
+		}
+
+		data, err := newJournal(t, dev).Load()
+		require.NoError(t, err)
+		require.Equal(t, []byte{9, 9, 9}, data)
+	})
+
+	t.Run("writes rotate across slots", func(t *testing.T) {
+		dev := &recorder{Memory: storage.NewMemory(blockSize, 16)}
+		j := newJournal(t, dev)
+
+		for i := 0; i < 2*slots; i++ {
+			require.NoError(t, j.Store([]byte{byte(i)}))
+		}
+
+		var expected []int
+		for i := 0; i < 2*slots; i++ {
+			expected = append(expected, journalLBA+(i%slots)*slotBlocks)
+		}
+
+		require.Equal(t, expected, dev.writes)
+
+		// rotation continues after recovery
+		dev.writes = nil
+		j = newJournal(t, dev)
+		require.NoError(t, j.Store([]byte{42}))
+		require.Equal(t, []int{journalLBA}, dev.writes)
+	})
+
+	t.Run("torn write keeps the previous record", func(t *testing.T) {
+		dev := &recorder{Memory: storage.NewMemory(blockSize, 16)}
+		j := newJournal(t, dev)
+
+		require.NoError(t, j.Store([]byte("first")))
+
+		// data spans both the slot blocks, and only the first one is written
+		dev.torn = true
+		require.NoError(t, j.Store(bytes.Repeat([]byte{0xaa}, blockSize+100)))
+
+		data, err := newJournal(t, dev).Load()
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), data)
+	})
+
+	t.Run("corrupted record is skipped", func(t *testing.T) {
+		dev := storage.NewMemory(blockSize, 16)
+		j := newJournal(t, dev)
+
+		require.NoError(t, j.Store([]byte("first")))
+		require.NoError(t, j.Store([]byte("second")))
+
+		// flip a data byte in the second slot
+		block := make([]byte, blockSize)
+		lba := journalLBA + slotBlocks
+		require.NoError(t, dev.ReadBlocks(lba, block))
+		block[25] ^= 0xff
+		require.NoError(t, dev.WriteBlocks(lba, block))
+
+		data, err := newJournal(t, dev).Load()
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), data)
+	})
+
+	t.Run("record with an invalid length is skipped", func(t *testing.T) {
+		dev := storage.NewMemory(blockSize, 16)
+		j := newJournal(t, dev)
+
+		require.NoError(t, j.Store([]byte("first")))
+		require.NoError(t, j.Store([]byte("second")))
+
+		// set the length field of the second slot record to 0xFFFFFFFF
+		block := make([]byte, blockSize)
+		lba := journalLBA + slotBlocks
+		require.NoError(t, dev.ReadBlocks(lba, block))
+		copy(block[12:16], []byte{0xff, 0xff, 0xff, 0xff})
+		require.NoError(t, dev.WriteBlocks(lba, block))
+
+		data, err := newJournal(t, dev).Load()
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), data)
+	})
+
+	t.Run("data too big", func(t *testing.T) {
+		j := newJournal(t, storage.NewMemory(blockSize, 16))
+		err := j.Store(make([]byte, slotBlocks*blockSize))
+		require.ErrorIs(t, err, storage.ErrNoSpace)
+	})
+
+	t.Run("torn write keeps the previous credentials", func(t *testing.T) {
+		dev := &recorder{Memory: storage.NewMemory(blockSize, 16)}
+
+		cs, err := keyring.NewCredentialStore(newJournal(t, dev))
+		require.NoError(t, err)
+		require.NoError(t, cs.Put(keyring.Credential{ID: []byte{1}, RPID: "rp", UserHandle: []byte{1}}))
+
+		// the new credential set spans both the slot blocks, and only the first one is written
+		dev.torn = true
+		require.NoError(t, cs.Put(keyring.Credential{
+			ID:              []byte{2},
+			RPID:            "rp",
+			UserHandle:      []byte{2},
+			UserDisplayName: string(bytes.Repeat([]byte{'a'}, blockSize)),
+		}))
+
+		cs, err = keyring.NewCredentialStore(newJournal(t, dev))
+		require.NoError(t, err)
+
+		l, err := cs.List("rp")
+		require.NoError(t, err)
+		require.Len(t, l, 1)
+		require.Equal(t, []byte{1}, l[0].ID)
+	})
+}
@@ -0,0 +1,43 @@
+package storage
+
+// Memory is a BlockDevice held in memory, useful for testing.
+type Memory struct {
+	info Info
+	data []byte
+}
+
+// NewMemory returns a zeroed Memory device made of blocks blocks of blockSize bytes.
+func NewMemory(blockSize, blocks int) *Memory {
+	return &Memory{
+		info: Info{
+			BlockSize: blockSize,
+			Blocks:    blocks,
+		},
+		data: make([]byte, blockSize*blocks),
+	}
+}
+
+// Info implements the BlockDevice interface.
+func (m *Memory) Info() Info {
+	return m.info
+}
+
+// ReadBlocks implements the BlockDevice interface.
+func (m *Memory) ReadBlocks(lba int, buf []byte) error {
+	if err := checkRange(m.info, lba, len(buf)); err != nil {
+		return err
+	}
+
+	copy(buf, m.data[lba*m.info.BlockSize:])
+	return nil
+}
+
+// WriteBlocks implements the BlockDevice interface.
+func (m *Memory) WriteBlocks(lba int, buf []byte) error {
+	if err := checkRange(m.info, lba, len(buf)); err != nil {
+		return err
+	}
+
+	copy(m.data[lba*m.info.BlockSize:], buf)
+	return nil
+}
@@ -0,0 +1,39 @@
+// +build usbarmory
+
+package storage
+
+import (
+	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+)
+
+// SD is a BlockDevice backed by the USB Armory Mk II microSD card.
+// The card must have been detected with usbarmory.SD.Detect before use.
+type SD struct{}
+
+// Info implements the BlockDevice interface.
+func (SD) Info() Info {
+	info := usbarmory.SD.Info()
+
+	return Info{
+		BlockSize: info.BlockSize,
+		Blocks:    info.Blocks,
+	}
+}
+
+// ReadBlocks implements the BlockDevice interface.
+func (s SD) ReadBlocks(lba int, buf []byte) error {
+	if err := checkRange(s.Info(), lba, len(buf)); err != nil {
+		return err
+	}
+
+	return usbarmory.SD.ReadBlocks(lba, buf)
+}
+
+// WriteBlocks implements the BlockDevice interface.
+func (s SD) WriteBlocks(lba int, buf []byte) error {
+	if err := checkRange(s.Info(), lba, len(buf)); err != nil {
+		return err
+	}
+
+	return usbarmory.SD.WriteBlocks(lba, buf)
+}
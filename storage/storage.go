@@ -0,0 +1,46 @@
+// Package storage implements persistence primitives on top of block-addressable devices.
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoSpace is returned when data doesn't fit in the space reserved for it.
+var ErrNoSpace = errors.New("not enough space")
+
+// Info describes a BlockDevice geometry.
+type Info struct {
+	// BlockSize is the size of a block, in bytes.
+	BlockSize int
+
+	// Blocks is the number of blocks available on the device.
+	Blocks int
+}
+
+// BlockDevice is a block-addressable storage device, like a microSD card.
+// Reads and writes operate on whole blocks: buf length must be a multiple of the block size.
+type BlockDevice interface {
+	// Info returns the device geometry.
+	Info() Info
+
+	// ReadBlocks reads len(buf) bytes starting at block lba.
+	ReadBlocks(lba int, buf []byte) error
+
+	// WriteBlocks writes buf starting at block lba.
+	WriteBlocks(lba int, buf []byte) error
+}
+
+// checkRange returns an error if a transfer of bufLen bytes starting at lba doesn't fit info geometry,
+// or bufLen isn't a multiple of its block size.
+func checkRange(info Info, lba, bufLen int) error {
+	if bufLen%info.BlockSize != 0 {
+		return fmt.Errorf("buffer length %d is not a multiple of block size %d", bufLen, info.BlockSize)
+	}
+
+	if lba < 0 || lba+bufLen/info.BlockSize > info.Blocks {
+		return fmt.Errorf("blocks %d-%d out of range, device has %d blocks", lba, lba+bufLen/info.BlockSize, info.Blocks)
+	}
+
+	return nil
+}
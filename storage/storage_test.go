@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/gsora/fidati/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlockDevice checks that dev, made of 8 blocks of blockSize bytes, behaves as a BlockDevice.
+func testBlockDevice(t *testing.T, dev storage.BlockDevice) {
+	require.Equal(t, storage.Info{BlockSize: blockSize, Blocks: 8}, dev.Info())
+
+	data := bytes.Repeat([]byte{0x42}, 2*blockSize)
+	require.NoError(t, dev.WriteBlocks(3, data))
+
+	buf := make([]byte, 4*blockSize)
+	require.NoError(t, dev.ReadBlocks(2, buf))
+	require.Equal(t, make([]byte, blockSize), buf[:blockSize])
+	require.Equal(t, data, buf[blockSize:3*blockSize])
+	require.Equal(t, make([]byte, blockSize), buf[3*blockSize:])
+
+	require.Error(t, dev.ReadBlocks(0, make([]byte, blockSize+1)), "partial block")
+	require.Error(t, dev.ReadBlocks(7, make([]byte, 2*blockSize)), "out of range read")
+	require.Error(t, dev.WriteBlocks(-1, make([]byte, blockSize)), "negative lba")
+	require.Error(t, dev.WriteBlocks(8, make([]byte, blockSize)), "out of range write")
+}
+
+func TestMemory(t *testing.T) {
+	testBlockDevice(t, storage.NewMemory(blockSize, 8))
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+
+	f, err := storage.OpenFile(path, blockSize, 8)
+	require.NoError(t, err)
+
+	testBlockDevice(t, f)
+	require.NoError(t, f.Close())
+
+	// data survives reopening
+	f, err = storage.OpenFile(path, blockSize, 8)
+	require.NoError(t, err)
+	defer f.Close()
+
+	buf := make([]byte, blockSize)
+	require.NoError(t, f.ReadBlocks(3, buf))
+	require.Equal(t, bytes.Repeat([]byte{0x42}, blockSize), buf)
+
+	_, err = storage.OpenFile(path, 0, 8)
+	require.Error(t, err)
+}
@@ -0,0 +1,28 @@
+// Package transport holds the request metadata transports pass to tokens along with each message, so that
+// tokens don't depend on the transport they're used with.
+package transport
+
+import "context"
+
+// channelKey is the context key holding the channel registered with WithChannel.
+type channelKey struct{}
+
+// WithChannel returns a copy of ctx carrying channel, the transport channel a message was received on.
+func WithChannel(ctx context.Context, channel uint32) context.Context {
+	return context.WithValue(ctx, channelKey{}, channel)
+}
+
+// ChannelFromContext returns the channel registered on ctx with WithChannel, and false if there's none.
+// Tokens can use it to keep per-channel state.
+func ChannelFromContext(ctx context.Context) (uint32, bool) {
+	channel, ok := ctx.Value(channelKey{}).(uint32)
+	return channel, ok
+}
+
+// ChannelReleaser is implemented by tokens which keep per-channel state.
+// Transports call ReleaseChannel once channel is released, so that its state can be dropped.
+type ChannelReleaser interface {
+	// ReleaseChannel drops the state kept for channel.
+	// It must return immediately.
+	ReleaseChannel(channel uint32)
+}
@@ -0,0 +1,17 @@
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelFromContext(t *testing.T) {
+	_, ok := ChannelFromContext(context.Background())
+	require.False(t, ok)
+
+	channel, ok := ChannelFromContext(WithChannel(context.Background(), 0x01020304))
+	require.True(t, ok)
+	require.Equal(t, uint32(0x01020304), channel)
+}
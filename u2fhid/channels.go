@@ -0,0 +1,194 @@
+package u2fhid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/transport"
+)
+
+const (
+	// messageTimeout is the maximum amount of time between two packets of the same request.
+	messageTimeout = 500 * time.Millisecond
+
+	// channelTimeout is the amount of time after which an unused channel is released.
+	channelTimeout = 10 * time.Minute
+
+	// maxChannels is the maximum number of channels held at once.
+	// When a new channel is needed, the least recently used one is released to make room for it.
+	maxChannels = 32
+)
+
+// channelPacket returns an empty u2fPacket addressed to channel, used to build responses which aren't
+// related to a specific packet.
+func channelPacket(channel uint32) u2fPacket {
+	var ip initPacket
+	binary.BigEndian.PutUint32(ip.ChannelID[:], channel)
+
+	return ip
+}
+
+// inUse returns true if channel is accumulating a request or executing a command.
+func (u *u2fHIDState) inUse(channel uint32) bool {
+	return (u.accumulatingMsgs && u.accumulatingChannel == channel) ||
+		(u.pending && u.pendingChannel == channel)
+}
+
+// allocated returns true if channel was allocated, and not released since.
+func (u *u2fHIDState) allocated(channel uint32) bool {
+	_, ok := u.sessions[channel]
+	return ok
+}
+
+// session returns the session of channel and marks channel as used at now, or false if channel isn't allocated.
+func (u *u2fHIDState) session(channel uint32, now time.Time) (*session, bool) {
+	s, ok := u.sessions[channel]
+	if !ok {
+		return nil, false
+	}
+
+	s.lastUsed = now
+
+	return s, true
+}
+
+// add adds a session for channel, used at now, making room for it if needed.
+// Only allocate adds sessions, so that packets sent on channels the host never obtained can't release
+// allocated ones.
+func (u *u2fHIDState) add(channel uint32, now time.Time) *session {
+	if s, ok := u.session(channel, now); ok {
+		return s
+	}
+
+	u.makeRoom()
+
+	s := &session{lastUsed: now}
+	u.sessions[channel] = s
+
+	return s
+}
+
+// allocate allocates a new random channel, and marks it as used at now.
+func (u *u2fHIDState) allocate(now time.Time) (uint32, error) {
+	b := make([]byte, 4)
+
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, fmt.Errorf("cannot generate random channel ID, %w", err)
+		}
+
+		channel := binary.BigEndian.Uint32(b)
+		if _, exists := u.sessions[channel]; exists || channel == 0 || channel == BroadcastChannel {
+			continue
+		}
+
+		u.add(channel, now)
+		return channel, nil
+	}
+}
+
+// makeRoom releases least recently used channels until there's room for a new one.
+// Channels in use are never released.
+func (u *u2fHIDState) makeRoom() {
+	for len(u.sessions) >= maxChannels {
+		var (
+			lru   uint32
+			found bool
+		)
+
+		for channel, s := range u.sessions {
+			if u.inUse(channel) {
+				continue
+			}
+
+			if !found || s.lastUsed.Before(u.sessions[lru].lastUsed) {
+				lru = channel
+				found = true
+			}
+		}
+
+		if !found {
+			return
+		}
+
+		flog.Logger.Printf("releasing least recently used channel 0x%X", lru)
+		u.release(lru)
+	}
+}
+
+// release releases channel, dropping the lock it holds.
+func (u *u2fHIDState) release(channel uint32) {
+	delete(u.sessions, channel)
+	u.unlock(channel)
+
+	if u.onRelease != nil {
+		u.onRelease(channel)
+	}
+}
+
+// releaseChannel tells the tokens of h which implement transport.ChannelReleaser that channel was released.
+func (h *Handler) releaseChannel(channel uint32) {
+	for _, t := range []Token{h.token, h.cborToken} {
+		if r, ok := t.(transport.ChannelReleaser); ok {
+			r.ReleaseChannel(channel)
+		}
+	}
+}
+
+// resync aborts everything in progress on channel: its request is dropped, its outbound messages are discarded
+// and its pending command is cancelled, without sending a response.
+// The channel stays allocated, and keeps the lock if it holds it.
+func (u *u2fHIDState) resync(channel uint32) {
+	flog.Logger.Printf("resynchronising channel 0x%X", channel)
+
+	u.clear(channel)
+
+	if s, ok := u.sessions[channel]; ok {
+		s.clear()
+	}
+
+	if u.pending && u.pendingChannel == channel {
+		u.cancel()
+		u.discard = true
+	}
+
+	delete(u.outbound, channel)
+
+	order := u.txOrder[:0]
+	for _, c := range u.txOrder {
+		if c != channel {
+			order = append(order, c)
+		}
+	}
+
+	u.txOrder = order
+}
+
+// expire aborts the transaction whose request didn't receive packets for more than messageTimeout, queuing a
+// ErrMsgTimeout error on its channel, releases channels unused for more than channelTimeout, and drops the lock
+// once expired.
+func (u *u2fHIDState) expire(now time.Time) {
+	if u.lockChannel != 0 && !now.Before(u.lockExpiry) {
+		u.unlock(u.lockChannel)
+	}
+
+	if u.accumulatingMsgs {
+		channel := u.accumulatingChannel
+
+		if s, ok := u.sessions[channel]; ok && now.Sub(s.lastUsed) > messageTimeout {
+			flog.Logger.Printf("request on channel 0x%X timed out", channel)
+			u.queue(generateError(ErrMsgTimeout, channelPacket(channel))...)
+			u.clear(channel)
+		}
+	}
+
+	for channel, s := range u.sessions {
+		if !u.inUse(channel) && now.Sub(s.lastUsed) > channelTimeout {
+			flog.Logger.Printf("releasing unused channel 0x%X", channel)
+			u.release(channel)
+		}
+	}
+}
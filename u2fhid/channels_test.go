@@ -0,0 +1,302 @@
+package u2fhid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_u2fHIDState_allocate(t *testing.T) {
+	u := newU2FHIDState()
+	now := time.Now()
+
+	seen := map[uint32]bool{}
+	for i := 0; i < maxChannels; i++ {
+		channel, err := u.allocate(now)
+		require.NoError(t, err)
+
+		require.NotZero(t, channel)
+		require.NotEqual(t, uint32(BroadcastChannel), channel)
+		require.False(t, seen[channel])
+		require.Contains(t, u.sessions, channel)
+
+		seen[channel] = true
+	}
+}
+
+func Test_u2fHIDState_makeRoom(t *testing.T) {
+	u := newU2FHIDState()
+	now := time.Now()
+
+	for i := 0; i < maxChannels; i++ {
+		u.add(uint32(i+1), now.Add(time.Duration(i)*time.Second))
+	}
+
+	// the least recently used channel is in use, so the next one is released
+	u.accumulate(1)
+
+	u.add(maxChannels+1, now.Add(time.Hour))
+	require.Len(t, u.sessions, maxChannels)
+	require.Contains(t, u.sessions, uint32(1))
+	require.NotContains(t, u.sessions, uint32(2))
+	require.Contains(t, u.sessions, uint32(maxChannels+1))
+
+	// existing channels don't need room
+	u.add(3, now.Add(time.Hour))
+	require.Len(t, u.sessions, maxChannels)
+	require.Contains(t, u.sessions, uint32(4))
+}
+
+func Test_u2fHIDState_expire(t *testing.T) {
+	t.Run("stalled request times out", func(t *testing.T) {
+		u := newU2FHIDState()
+		now := time.Now()
+
+		s := u.add(42, now)
+		s.command = CmdMsg
+		u.accumulate(42)
+
+		u.expire(now.Add(messageTimeout))
+		require.True(t, u.accumulatingMsgs)
+		require.Nil(t, u.next())
+
+		u.expire(now.Add(messageTimeout + time.Millisecond))
+		require.False(t, u.accumulatingMsgs)
+		require.Zero(t, u.sessions[42].command)
+		require.Contains(t, u.sessions, uint32(42), "channel stays allocated")
+
+		msg := u.next()
+		require.Equal(t, []byte{0, 0, 0, 42, uint8(CmdError), 0, 1, uint8(ErrMsgTimeout)}, msg)
+	})
+
+	t.Run("unused channels are released", func(t *testing.T) {
+		u := newU2FHIDState()
+		now := time.Now()
+
+		u.add(1, now)
+		u.add(2, now)
+		u.add(3, now.Add(time.Minute))
+		u.pending = true
+		u.pendingChannel = 2
+
+		u.expire(now.Add(channelTimeout + time.Millisecond))
+		require.NotContains(t, u.sessions, uint32(1))
+		require.Contains(t, u.sessions, uint32(2), "channel executing a command is in use")
+		require.Contains(t, u.sessions, uint32(3))
+	})
+}
+
+func Test_u2fHIDState_resync(t *testing.T) {
+	u := newU2FHIDState()
+	now := time.Now()
+
+	s := u.add(42, now)
+	s.command = CmdMsg
+	u.accumulate(42)
+	u.lock(42, now.Add(time.Second))
+
+	u.queue([]byte{0, 0, 0, 42, 1}, []byte{0, 0, 0, 43, 1}, []byte{0, 0, 0, 42, 2})
+
+	u.resync(42)
+	require.False(t, u.accumulatingMsgs)
+	require.Zero(t, u.sessions[42].command)
+	require.Contains(t, u.sessions, uint32(42), "channel stays allocated")
+	require.Equal(t, uint32(42), u.lockChannel, "channel keeps the lock")
+
+	require.Equal(t, []byte{0, 0, 0, 43, 1}, u.next())
+	require.Nil(t, u.next())
+}
+
+func TestHandler_resync(t *testing.T) {
+	// allocate returns a channel allocated on h.
+	allocate := func(t *testing.T, h *Handler) [4]byte {
+		_, err := h.Rx(zeroPad([]byte{255, 255, 255, 255, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}), nil)
+		require.NoError(t, err)
+
+		sent := drain(t, h)
+		require.Len(t, sent, 1)
+
+		var channel [4]byte
+		copy(channel[:], sent[0][15:19])
+
+		return channel
+	}
+
+	// resync sends a CmdInit on channel, and checks that it's answered on channel with the same channel.
+	resync := func(t *testing.T, h *Handler, channel [4]byte) {
+		nonce := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+
+		_, err := h.Rx(zeroPad(append(append(channel[:], uint8(CmdInit), 0, 8), nonce...)), nil)
+		require.NoError(t, err)
+
+		sent := drain(t, h)
+		require.Len(t, sent, 1)
+		require.Equal(t, append(channel[:], uint8(CmdInit)), sent[0][:5])
+		require.Equal(t, nonce, sent[0][7:15])
+		require.Equal(t, channel[:], sent[0][15:19])
+	}
+
+	tests := []test{
+		{
+			"incomplete request is dropped",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				channel := allocate(t, h)
+
+				msg := append(channel[:], uint8(CmdPing), 0, 120)
+				_, err = h.Rx(zeroPad(append(msg, bytes.Repeat([]byte{1}, initPacketDataLen)...)), nil)
+				require.NoError(t, err)
+
+				resync(t, h, channel)
+				require.False(t, h.state.accumulatingMsgs)
+
+				_, err = h.Rx(pingRequest(channel), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, uint8(CmdPing), sent[0][4])
+			},
+		},
+		{
+			"pending command is cancelled without response",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				channel := allocate(t, h)
+
+				_, err = h.Rx(cborRequest(channel, []byte{42}), nil)
+				require.NoError(t, err)
+
+				resync(t, h, channel)
+				require.Empty(t, waitResponse(t, h))
+
+				_, err = h.Rx(pingRequest(channel), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, uint8(CmdPing), sent[0][4])
+			},
+		},
+		{
+			"other channels are left alone",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				a := allocate(t, h)
+				b := allocate(t, h)
+
+				_, err = h.Rx(pingRequest(b), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(zeroPad(append(a[:], uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8)), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 2)
+				require.Equal(t, append(b[:], uint8(CmdPing)), sent[0][:5])
+				require.Equal(t, append(a[:], uint8(CmdInit)), sent[1][:5])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestHandler_messageTimeout(t *testing.T) {
+	h, err := NewHandler(&fakeToken{})
+	require.NoError(t, err)
+
+	allocateChannels(h, [4]byte{1, 2, 3, 4}, [4]byte{5, 6, 7, 8})
+
+	channel := []byte{1, 2, 3, 4}
+
+	msg := append(channel, uint8(CmdPing), 0, 120)
+	_, err = h.Rx(zeroPad(append(msg, bytes.Repeat([]byte{1}, 57)...)), nil)
+	require.NoError(t, err)
+	require.Nil(t, drain(t, h))
+
+	// the host disappears
+	h.stateLock.Lock()
+	h.state.sessions[0x01020304].lastUsed = time.Now().Add(-2 * messageTimeout)
+	h.stateLock.Unlock()
+
+	sent := drain(t, h)
+	require.Len(t, sent, 1)
+	require.Equal(t, channel, sent[0][:4])
+	require.Equal(t, uint8(CmdError), sent[0][4])
+	require.Equal(t, uint8(ErrMsgTimeout), sent[0][7])
+
+	// other channels can start a transaction
+	_, err = h.Rx(zeroPad([]byte{5, 6, 7, 8, uint8(CmdPing), 0, 1, 42}), nil)
+	require.NoError(t, err)
+
+	sent = drain(t, h)
+	require.Len(t, sent, 1)
+	require.Equal(t, uint8(CmdPing), sent[0][4])
+}
+
+func TestHandler_unallocatedChannels(t *testing.T) {
+	h, err := NewHandler(&fakeToken{})
+	require.NoError(t, err)
+
+	_, err = h.Rx(zeroPad([]byte{255, 255, 255, 255, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}), nil)
+	require.NoError(t, err)
+
+	sent := drain(t, h)
+	require.Len(t, sent, 1)
+
+	legit := binary.BigEndian.Uint32(sent[0][15:19])
+
+	// more channels than the table can hold, none of them obtained with CmdInit
+	for i := 0; i < maxChannels+8; i++ {
+		var channel [4]byte
+		binary.BigEndian.PutUint32(channel[:], uint32(i+1))
+
+		_, err = h.Rx(pingRequest(channel), nil)
+		require.NoError(t, err)
+
+		sent = drain(t, h)
+		require.Len(t, sent, 1)
+		require.Equal(t, append(channel[:], uint8(CmdError), 0, 1, uint8(ErrInvalidCid)), sent[0][:8])
+	}
+
+	require.Len(t, h.state.sessions, 1)
+	require.True(t, h.state.allocated(legit))
+}
+
+// releaseToken is a Token which records the channels it's told were released.
+type releaseToken struct {
+	fakeToken
+	released []uint32
+}
+
+func (r *releaseToken) ReleaseChannel(channel uint32) {
+	r.released = append(r.released, channel)
+}
+
+func TestHandler_releaseChannel(t *testing.T) {
+	token := &releaseToken{}
+	h, err := NewHandler(token)
+	require.NoError(t, err)
+
+	allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+	h.stateLock.Lock()
+	h.state.expire(time.Now().Add(2 * channelTimeout))
+	h.stateLock.Unlock()
+
+	require.Equal(t, []uint32{0x01020304}, token.released)
+}
@@ -0,0 +1,18 @@
+package u2fhid
+
+import "github.com/gsora/fidati/internal/flog"
+
+// ctap2ErrKeepaliveCancel is the CTAP2 status code answering a CmdCbor request cancelled by the host.
+const ctap2ErrKeepaliveCancel uint8 = 0x2d
+
+// handleCancel handles CmdCancel commands, aborting the command being executed on pkt channel, if any.
+// CmdCancel has no response of its own: the aborted command responds as soon as it returns.
+func (h *Handler) handleCancel(pkt u2fPacket) {
+	if !h.state.pending || h.state.pendingChannel != pkt.Channel() {
+		flog.Logger.Printf("no command to cancel on channel 0x%X", pkt.Channel())
+		return
+	}
+
+	flog.Logger.Printf("cancelling command on channel 0x%X", pkt.Channel())
+	h.state.cancel()
+}
@@ -0,0 +1,90 @@
+package u2fhid
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+// cancelRequest returns a CmdCancel request on channel.
+func cancelRequest(channel [4]byte) []byte {
+	return zeroPad(append(channel[:], uint8(CmdCancel), 0, 0))
+}
+
+func TestHandler_handleCancel(t *testing.T) {
+	tests := []test{
+		{
+			"pending command is cancelled",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				channel := [4]byte{1, 2, 3, 4}
+				allocateChannels(h, channel)
+
+				_, err = h.Rx(cborRequest(channel, []byte{42}), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(cancelRequest(channel), nil)
+				require.NoError(t, err)
+
+				dd := waitResponse(t, h)
+				resp := dd[len(dd)-1]
+				require.Equal(t, channel[:], resp[:4])
+				require.Equal(t, uint8(CmdCbor), resp[4])
+				require.Equal(t, []byte{0, 1, ctap2ErrKeepaliveCancel}, resp[5:8])
+
+				// the handler is usable again
+				_, err = h.Rx(cborRequest(channel, []byte{42}), nil)
+				require.NoError(t, err)
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+				dd = waitResponse(t, h)
+				require.Equal(t, uint8(CmdCbor), dd[len(dd)-1][4])
+				require.Equal(t, []byte{0, 1, 42}, dd[len(dd)-1][5:8])
+			},
+		},
+		{
+			"cancel on another channel is ignored",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4}, [4]byte{5, 6, 7, 8})
+
+				_, err = h.Rx(cborRequest([4]byte{1, 2, 3, 4}, []byte{42}), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(cancelRequest([4]byte{5, 6, 7, 8}), nil)
+				require.NoError(t, err)
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+				dd := waitResponse(t, h)
+				require.Equal(t, []byte{0, 1, 42}, dd[len(dd)-1][5:8])
+			},
+		},
+		{
+			"cancel without a pending command is ignored",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				d, err := h.parseMsg(cancelRequest([4]byte{1, 2, 3, 4}))
+				require.NoError(t, err)
+				require.Nil(t, d)
+
+				require.Empty(t, h.state.sessions)
+				require.Empty(t, h.state.outbound)
+				require.False(t, h.state.accumulatingMsgs)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
@@ -0,0 +1,18 @@
+package u2fhid
+
+import "context"
+
+// handleCbor handles CmdCbor commands.
+// If ctx is cancelled by CmdCancel, the response is always ctap2ErrKeepaliveCancel.
+func (h *Handler) handleCbor(ctx context.Context, session *session, pkt u2fPacket) ([][]byte, error) {
+	resp := handleMessage(ctx, h.cborToken, session.data[:session.total])
+	if ctx.Err() != nil {
+		resp = []byte{ctap2ErrKeepaliveCancel}
+	}
+
+	return genPackets(
+		resp,
+		session.command,
+		pkt.ChannelBytes(),
+	)
+}
@@ -0,0 +1,42 @@
+package u2fhid
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_handleCbor(t *testing.T) {
+	t.Run("cbor payload is handled by cbor token", func(t *testing.T) {
+		cborToken := &fakeToken{
+			shouldReturnData: true,
+			data:             []byte{0, 1, 2, 3},
+		}
+
+		u, err := NewHandler(&fakeToken{}, WithCBOR(cborToken))
+		require.NoError(t, err)
+
+		s := &session{
+			data:    bytes.Repeat([]byte{42}, 42),
+			command: CmdCbor,
+			total:   42,
+		}
+
+		p := initPacket{
+			ChannelID:     [4]byte{1, 2, 3, 4},
+			Cmd:           CmdCbor,
+			PayloadLength: 42,
+			Data:          bytes.Repeat([]byte{42}, 42),
+		}
+
+		data, err := u.handleCbor(context.Background(), s, p)
+		require.NoError(t, err)
+		require.Len(t, data, 1)
+
+		require.Equal(t, uint8(CmdCbor), data[0][4])
+		require.Equal(t, []byte{0, 4}, data[0][5:7])
+		require.Equal(t, cborToken.data, data[0][7:11])
+	})
+}
@@ -0,0 +1,52 @@
+package u2fhid
+
+import (
+	"time"
+
+	"github.com/gsora/fidati/internal/flog"
+)
+
+// maxLockTime is the maximum amount of time, in seconds, a channel can hold the lock for.
+const maxLockTime = 10
+
+// handleLock handles CmdLock commands.
+// The payload holds the number of seconds pkt channel gets exclusive access to the token for, or zero to
+// release the lock.
+func (h *Handler) handleLock(session *session, pkt u2fPacket) ([][]byte, error) {
+	if session.total != 1 {
+		return generateError(ErrInvalidLen, pkt), nil
+	}
+
+	seconds := session.data[0]
+	if seconds > maxLockTime {
+		return generateError(ErrInvalidPar, pkt), nil
+	}
+
+	if seconds == 0 {
+		h.state.unlock(pkt.Channel())
+	} else {
+		h.state.lock(pkt.Channel(), time.Now().Add(time.Duration(seconds)*time.Second))
+	}
+
+	return genPackets([]byte{}, session.command, pkt.ChannelBytes())
+}
+
+// lock gives channel exclusive access to the token until expiry.
+func (u *u2fHIDState) lock(channel uint32, expiry time.Time) {
+	flog.Logger.Printf("channel 0x%X locked until %s", channel, expiry)
+
+	u.lockChannel = channel
+	u.lockExpiry = expiry
+}
+
+// unlock releases the lock held by channel, if any.
+func (u *u2fHIDState) unlock(channel uint32) {
+	if u.lockChannel != channel {
+		return
+	}
+
+	flog.Logger.Printf("channel 0x%X released the lock", channel)
+
+	u.lockChannel = 0
+	u.lockExpiry = time.Time{}
+}
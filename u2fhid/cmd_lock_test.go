@@ -0,0 +1,125 @@
+package u2fhid
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lockRequest returns a CmdLock request on channel, with payload as data.
+func lockRequest(channel [4]byte, payload ...byte) []byte {
+	msg := append(channel[:], uint8(CmdLock), 0, uint8(len(payload)))
+	return zeroPad(append(msg, payload...))
+}
+
+// pingRequest returns a single byte CmdPing request on channel.
+func pingRequest(channel [4]byte) []byte {
+	return zeroPad(append(channel[:], uint8(CmdPing), 0, 1, 42))
+}
+
+func TestHandler_handleLock(t *testing.T) {
+	a := [4]byte{1, 2, 3, 4}
+	b := [4]byte{5, 6, 7, 8}
+
+	// exchange sends msg to h and returns the first response packet.
+	exchange := func(t *testing.T, h *Handler, msg []byte) []byte {
+		_, err := h.Rx(msg, nil)
+		require.NoError(t, err)
+
+		sent := drain(t, h)
+		require.NotEmpty(t, sent)
+
+		return sent[0]
+	}
+
+	tests := []test{
+		{
+			"invalid lock requests",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				resp := exchange(t, h, lockRequest(a))
+				require.Equal(t, uint8(CmdError), resp[4])
+				require.Equal(t, uint8(ErrInvalidLen), resp[7])
+
+				resp = exchange(t, h, lockRequest(a, maxLockTime+1))
+				require.Equal(t, uint8(CmdError), resp[4])
+				require.Equal(t, uint8(ErrInvalidPar), resp[7])
+
+				require.Zero(t, h.state.lockChannel)
+			},
+		},
+		{
+			"lock gives exclusive access until released",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				resp := exchange(t, h, lockRequest(a, 5))
+				require.Equal(t, append(a[:], uint8(CmdLock), 0, 0), resp[:7])
+
+				resp = exchange(t, h, pingRequest(b))
+				require.Equal(t, uint8(CmdError), resp[4])
+				require.Equal(t, uint8(ErrChannelBusy), resp[7])
+
+				resp = exchange(t, h, lockRequest(b, 5))
+				require.Equal(t, uint8(CmdError), resp[4])
+				require.Equal(t, uint8(ErrChannelBusy), resp[7])
+
+				resp = exchange(t, h, pingRequest(a))
+				require.Equal(t, uint8(CmdPing), resp[4])
+
+				resp = exchange(t, h, lockRequest(a, 0))
+				require.Equal(t, uint8(CmdLock), resp[4])
+
+				resp = exchange(t, h, pingRequest(b))
+				require.Equal(t, uint8(CmdPing), resp[4])
+			},
+		},
+		{
+			"lock expires",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				exchange(t, h, lockRequest(a, 1))
+
+				h.stateLock.Lock()
+				h.state.expire(time.Now().Add(500 * time.Millisecond))
+				require.True(t, h.state.busy(0x05060708))
+
+				h.state.expire(time.Now().Add(time.Second))
+				require.False(t, h.state.busy(0x05060708))
+				h.stateLock.Unlock()
+			},
+		},
+		{
+			"lock is dropped when the owning channel is released",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				exchange(t, h, lockRequest(a, maxLockTime))
+
+				h.stateLock.Lock()
+				h.state.release(0x01020304)
+				require.False(t, h.state.busy(0x05060708))
+				h.stateLock.Unlock()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
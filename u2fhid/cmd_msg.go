@@ -1,9 +1,11 @@
 package u2fhid
 
-// handleMsg handles cmdMsg commands.
-func (h *Handler) handleMsg(session *session, pkt u2fPacket) ([][]byte, error) {
+import "context"
+
+// handleMsg handles CmdMsg commands.
+func (h *Handler) handleMsg(ctx context.Context, session *session, pkt u2fPacket) ([][]byte, error) {
 	return genPackets(
-		h.token.HandleMessage(session.data[:session.total]),
+		handleMessage(ctx, h.token, session.data[:session.total]),
 		session.command,
 		pkt.ChannelBytes(),
 	)
@@ -2,6 +2,7 @@ package u2fhid
 
 import (
 	"bytes"
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -32,7 +33,7 @@ func TestHandler_handleMsg(t *testing.T) {
 
 			s := &session{
 				data:         bytes.Repeat([]byte{42}, 42),
-				command:      cmdMsg,
+				command:      CmdMsg,
 				total:        42,
 				leftToRead:   0,
 				lastSequence: 0,
@@ -45,12 +46,12 @@ func TestHandler_handleMsg(t *testing.T) {
 					3,
 					4,
 				},
-				Cmd:           cmdMsg,
+				Cmd:           CmdMsg,
 				PayloadLength: 42,
 				Data:          bytes.Repeat([]byte{42}, 42),
 			}
 
-			data, err := u.handleMsg(s, p)
+			data, err := u.handleMsg(context.Background(), s, p)
 			tt.errAssertion(t, err)
 			tt.packetsAssertion(t, data)
 		})
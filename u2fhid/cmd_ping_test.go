@@ -11,7 +11,7 @@ func Test_handlePing(t *testing.T) {
 	t.Run("ping returns whatever you throw at it", func(t *testing.T) {
 		s := &session{
 			data:         bytes.Repeat([]byte{42}, 42),
-			command:      cmdPing,
+			command:      CmdPing,
 			total:        42,
 			leftToRead:   0,
 			lastSequence: 0,
@@ -24,7 +24,7 @@ func Test_handlePing(t *testing.T) {
 				3,
 				4,
 			},
-			Cmd:           cmdPing,
+			Cmd:           CmdPing,
 			PayloadLength: 42,
 			Data:          bytes.Repeat([]byte{42}, 42),
 		}
@@ -0,0 +1,12 @@
+package u2fhid
+
+// handleWink handles CmdWink commands.
+func (h *Handler) handleWink(session *session, pkt u2fPacket) ([][]byte, error) {
+	if session.total != 0 {
+		return generateError(ErrInvalidLen, pkt), nil
+	}
+
+	h.winker.Wink()
+
+	return genPackets([]byte{}, session.command, pkt.ChannelBytes())
+}
@@ -0,0 +1,76 @@
+package u2fhid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_handleWink(t *testing.T) {
+	winkRequest := func(payload ...byte) []byte {
+		return zeroPad(append([]byte{1, 2, 3, 4, uint8(CmdWink), 0, uint8(len(payload))}, payload...))
+	}
+
+	tests := []test{
+		{
+			"winker is called",
+			func(t *testing.T) {
+				winks := 0
+				h, err := NewHandler(&fakeToken{}, WithWinker(WinkerFunc(func() {
+					winks++
+				})))
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				_, err = h.Rx(winkRequest(), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, []byte{1, 2, 3, 4, uint8(CmdWink), 0, 0}, sent[0][:7])
+				require.Equal(t, 1, winks)
+			},
+		},
+		{
+			"wink with a payload",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{}, WithWinker(WinkerFunc(func() {
+					require.Fail(t, "winker must not be called")
+				})))
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				_, err = h.Rx(winkRequest(42), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, uint8(CmdError), sent[0][4])
+				require.Equal(t, uint8(ErrInvalidLen), sent[0][7])
+			},
+		},
+		{
+			"wink without winker",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				_, err = h.Rx(winkRequest(), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, uint8(CmdError), sent[0][4])
+				require.Equal(t, uint8(ErrInvalidCmd), sent[0][7])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
@@ -6,48 +6,53 @@ import (
 	"fmt"
 )
 
-// u2fError represent some kind of error happened during the u2fhid processing.
-//go:generate stringer -type=u2fError
-type u2fError uint8
+// Error is a U2FHID error code, sent to the host with a CmdError message when a request can't be handled.
+//go:generate stringer -type=Error
+type Error uint8
 
 const (
 	// no error
-	none u2fError = 0
+	none Error = 0
 
-	// invalid command
-	invalidCmd u2fError = 1
+	// ErrInvalidCmd means the command isn't handled.
+	ErrInvalidCmd Error = 1
 
-	// invalid parameter
-	invalidPar u2fError = 2
+	// ErrInvalidPar means a parameter of the command is invalid.
+	ErrInvalidPar Error = 2
 
-	// invalid length
-	invalidLen u2fError = 3
+	// ErrInvalidLen means the message length is invalid.
+	ErrInvalidLen Error = 3
 
-	// invalid sequence number
-	invalidSeq u2fError = 4
+	// ErrInvalidSeq means a continuation packet was received out of sequence.
+	ErrInvalidSeq Error = 4
 
-	// timeout
-	msgTimeout u2fError = 5
+	// ErrMsgTimeout means the rest of a message wasn't received in time.
+	ErrMsgTimeout Error = 5
 
-	// communication channel is busy
-	channelBusy u2fError = 6
+	// ErrChannelBusy means another channel is being served.
+	ErrChannelBusy Error = 6
 
-	// a channel lock is required
-	lockRequired u2fError = 10
+	// ErrLockRequired means the command requires a channel lock.
+	ErrLockRequired Error = 10
 
-	// invalid channel id
-	invalidCid u2fError = 11
+	// ErrInvalidCid means the channel is invalid.
+	ErrInvalidCid Error = 11
 
-	// other kind of error
-	other u2fError = 127
+	// ErrOther is any other error.
+	ErrOther Error = 127
 )
 
-// generateError generates a u2fError payload ready to be sent on the wire.
-func generateError(code u2fError, pkt u2fPacket) [][]byte {
+// Error implements the error interface, so that hosts can return error codes sent by devices as they are.
+func (e Error) Error() string {
+	return fmt.Sprintf("u2fhid error %s", e.String())
+}
+
+// generateError generates an Error payload ready to be sent on the wire.
+func generateError(code Error, pkt u2fPacket) [][]byte {
 	b := new(bytes.Buffer)
 
 	u := standardResponse{
-		Command:   uint8(cmdError),
+		Command:   uint8(CmdError),
 		ChannelID: pkt.ChannelBytes(),
 	}
 
@@ -16,12 +16,12 @@ func Test_generateError(t *testing.T) {
 				3,
 				4,
 			},
-			Cmd:           cmdPing,
+			Cmd:           CmdPing,
 			PayloadLength: 42,
 			Data:          bytes.Repeat([]byte{42}, 42),
 		}
 
-		b := generateError(other, p)
+		b := generateError(ErrOther, p)
 
 		require.Len(t, b, 1)
 
@@ -30,8 +30,8 @@ func Test_generateError(t *testing.T) {
 		require.Len(t, pkt, 8) // 7 bytes of header + 1 for error
 
 		require.Equal(t, pkt[0:4], p.ChannelID[:]) // channelID
-		require.Equal(t, pkt[4], uint8(cmdError))  // command
+		require.Equal(t, pkt[4], uint8(CmdError))  // command
 		require.Equal(t, pkt[5:7], []byte{0, 1})   // packet count
-		require.Equal(t, pkt[7], uint8(other))     // error number
+		require.Equal(t, pkt[7], uint8(ErrOther))     // error number
 	})
 }
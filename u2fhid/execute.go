@@ -0,0 +1,128 @@
+package u2fhid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/presence"
+	"github.com/gsora/fidati/transport"
+)
+
+// keepaliveInterval is the amount of time between two keepalive packets sent while a command is executing.
+const keepaliveInterval = 100 * time.Millisecond
+
+// keepaliveStatus is the status carried by CmdKeepalive packets.
+type keepaliveStatus uint32
+
+const (
+	// the token is processing the command
+	keepaliveProcessing keepaliveStatus = 1
+
+	// the token is waiting for the user to confirm presence
+	keepaliveUpNeeded keepaliveStatus = 2
+)
+
+// commandFunc executes a command bound to ctx, and returns the packets to be sent as its response.
+type commandFunc func(ctx context.Context) ([][]byte, error)
+
+// execute runs f in background, and queues its response once ready.
+// Until then, a CmdKeepalive packet is queued on pkt channel every keepaliveInterval, so that the host
+// knows the token is still alive.
+// f context is cancelled when the host sends CmdCancel on pkt channel, or resynchronises it.
+// The caller must hold stateLock.
+func (h *Handler) execute(pkt u2fPacket, f commandFunc) {
+	ctx, cancel := context.WithCancel(transport.WithChannel(context.Background(), pkt.Channel()))
+
+	h.state.pending = true
+	h.state.pendingChannel = pkt.Channel()
+	h.state.cancel = cancel
+
+	status := uint32(keepaliveProcessing)
+	ctx = presence.WithNotifier(ctx, func(waiting bool) {
+		if waiting {
+			atomic.StoreUint32(&status, uint32(keepaliveUpNeeded))
+			return
+		}
+
+		atomic.StoreUint32(&status, uint32(keepaliveProcessing))
+	})
+
+	done := make(chan [][]byte, 1)
+
+	go func() {
+		pkts, err := f(ctx)
+		if err != nil {
+			flog.Logger.Println(err)
+			pkts = generateError(ErrOther, pkt)
+		}
+
+		done <- pkts
+	}()
+
+	go h.keepalive(pkt.ChannelBytes(), &status, done)
+}
+
+// keepalive queues a keepalive packet on channel every keepaliveInterval, until a response is received from done.
+// Keepalives are only queued if the host read all the previous outbound messages of channel, so that they don't pile up.
+func (h *Handler) keepalive(channel [4]byte, status *uint32, done <-chan [][]byte) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case pkts := <-done:
+			h.stateLock.Lock()
+			if !h.state.discard {
+				h.state.queue(pkts...)
+			}
+
+			h.state.cancel()
+			h.state.pending = false
+			h.state.pendingChannel = 0
+			h.state.cancel = nil
+			h.state.discard = false
+			h.stateLock.Unlock()
+
+			return
+		case <-ticker.C:
+			h.stateLock.Lock()
+			if !h.state.discard && len(h.state.outbound[binary.BigEndian.Uint32(channel[:])]) == 0 {
+				s := keepaliveStatus(atomic.LoadUint32(status))
+				h.state.queue(keepalivePacket(channel, s))
+			}
+			h.stateLock.Unlock()
+		}
+	}
+}
+
+// keepalivePacket generates a CmdKeepalive packet for channel, ready to be sent on the wire.
+func keepalivePacket(channel [4]byte, status keepaliveStatus) []byte {
+	b := new(bytes.Buffer)
+
+	u := standardResponse{
+		Command:   uint8(CmdKeepalive),
+		ChannelID: channel,
+	}
+
+	binary.BigEndian.PutUint16(u.Count[:], uint16(1))
+	err := binary.Write(b, binary.LittleEndian, u)
+	if err != nil {
+		panic(fmt.Sprintf("cannot serialize keepalive payload, %v", err))
+	}
+
+	return append(b.Bytes(), uint8(status))
+}
+
+// handleMessage passes b to t, bound to ctx if t is a ContextToken.
+func handleMessage(ctx context.Context, t Token, b []byte) []byte {
+	if ct, ok := t.(ContextToken); ok {
+		return ct.HandleMessageContext(ctx, b)
+	}
+
+	return t.HandleMessage(b)
+}
@@ -0,0 +1,176 @@
+package u2fhid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/gsora/fidati/transport"
+	"github.com/stretchr/testify/require"
+)
+
+// presenceToken is a ContextToken which echoes requests back once the user confirmed presence on signal.
+type presenceToken struct {
+	signal *presence.Signal
+}
+
+func (p *presenceToken) HandleMessage(b []byte) []byte {
+	return p.HandleMessageContext(context.Background(), b)
+}
+
+func (p *presenceToken) HandleMessageContext(ctx context.Context, b []byte) []byte {
+	if err := presence.Wait(ctx, p.signal); err != nil {
+		return []byte{0xff}
+	}
+
+	return b
+}
+
+// channelToken is a ContextToken which responds with the channel of each message.
+type channelToken struct{}
+
+func (c channelToken) HandleMessage(b []byte) []byte {
+	return c.HandleMessageContext(context.Background(), b)
+}
+
+func (channelToken) HandleMessageContext(ctx context.Context, _ []byte) []byte {
+	channel, ok := transport.ChannelFromContext(ctx)
+	if !ok {
+		return []byte{}
+	}
+
+	return []byte{uint8(channel >> 24), uint8(channel >> 16), uint8(channel >> 8), uint8(channel)}
+}
+
+// cborRequest returns a single packet CmdCbor request on channel.
+func cborRequest(channel [4]byte, payload []byte) []byte {
+	msg := append(channel[:], uint8(CmdCbor), 0, uint8(len(payload)))
+	return zeroPad(append(msg, payload...))
+}
+
+func Test_keepalivePacket(t *testing.T) {
+	p := keepalivePacket([4]byte{1, 2, 3, 4}, keepaliveUpNeeded)
+	require.Equal(t, []byte{1, 2, 3, 4, uint8(CmdKeepalive), 0, 1, uint8(keepaliveUpNeeded)}, p)
+}
+
+func TestHandler_execute(t *testing.T) {
+	tests := []test{
+		{
+			"keepalives are sent until the response is ready",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				channel := [4]byte{1, 2, 3, 4}
+				allocateChannels(h, channel)
+
+				_, err = h.Rx(cborRequest(channel, []byte{42}), nil)
+				require.NoError(t, err)
+
+				res, err := h.Tx(nil, nil)
+				require.NoError(t, err)
+				require.Nil(t, res, "response isn't ready yet")
+
+				var keepalive []byte
+				require.Eventually(t, func() bool {
+					keepalive, _ = h.Tx(nil, nil)
+					return keepalive != nil
+				}, time.Second, time.Millisecond)
+
+				require.Equal(t, channel[:], keepalive[:4])
+				require.Equal(t, uint8(CmdKeepalive), keepalive[4])
+				require.Equal(t, []byte{0, 1}, keepalive[5:7])
+				require.Equal(t, uint8(keepaliveUpNeeded), keepalive[7])
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+
+				var resp []byte
+				require.Eventually(t, func() bool {
+					resp, _ = h.Tx(nil, nil)
+					return resp != nil && resp[4] == uint8(CmdCbor)
+				}, time.Second, time.Millisecond)
+
+				require.Equal(t, channel[:], resp[:4])
+				require.Equal(t, []byte{0, 1, 42}, resp[5:8])
+
+				h.stateLock.Lock()
+				defer h.stateLock.Unlock()
+
+				require.False(t, h.state.pending)
+				require.Empty(t, h.state.outbound)
+			},
+		},
+		{
+			"keepalives don't pile up",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4}, [4]byte{5, 6, 7, 8})
+
+				_, err = h.Rx(cborRequest([4]byte{1, 2, 3, 4}, []byte{42}), nil)
+				require.NoError(t, err)
+
+				time.Sleep(5 * keepaliveInterval)
+
+				h.stateLock.Lock()
+				require.Len(t, h.state.outbound[0x01020304], 1)
+				h.stateLock.Unlock()
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+				waitResponse(t, h)
+			},
+		},
+		{
+			"other channels are busy while a command is executing",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4}, [4]byte{5, 6, 7, 8})
+
+				_, err = h.Rx(cborRequest([4]byte{1, 2, 3, 4}, []byte{42}), nil)
+				require.NoError(t, err)
+
+				h.stateLock.Lock()
+				d, err := h.parseMsg(cborRequest([4]byte{5, 6, 7, 8}, []byte{42}))
+				h.stateLock.Unlock()
+
+				require.NoError(t, err)
+				require.Len(t, d, 1)
+				require.Equal(t, []byte{5, 6, 7, 8}, d[0][:4])
+				require.Equal(t, uint8(CmdError), d[0][4])
+				require.Equal(t, uint8(ErrChannelBusy), d[0][7])
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+				waitResponse(t, h)
+			},
+		},
+		{
+			"commands know their channel",
+			func(t *testing.T) {
+				h, err := NewHandler(channelToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				_, err = h.Rx(zeroPad([]byte{1, 2, 3, 4, uint8(CmdMsg), 0, 1, 42}), nil)
+				require.NoError(t, err)
+
+				dd := waitResponse(t, h)
+				require.Equal(t, []byte{0, 4, 1, 2, 3, 4}, dd[len(dd)-1][5:11])
+
+				_, ok := transport.ChannelFromContext(context.Background())
+				require.False(t, ok)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
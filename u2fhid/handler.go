@@ -2,66 +2,64 @@ package u2fhid
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/gsora/fidati/internal/flog"
 )
 
-// zeroPad pads b with as many zeroes as needed to have len(b) == 64.
+// zeroPad pads b with as many zeroes as needed to have len(b) == ReportLen.
 func zeroPad(b []byte) []byte {
-	if len(b) == 64 {
+	if len(b) == ReportLen {
 		return b
 	}
 
-	nb := make([]byte, 64)
+	nb := make([]byte, ReportLen)
 	copy(nb, b)
 
 	return nb
 }
 
 // Tx handles USB endpoint data outtake.
-// res will always not be nil.
+// res is nil when there's nothing to send, otherwise it holds the next outbound message.
+// It returns ErrOutboundInUse if outbound messages are delivered through Outbound.
 func (h *Handler) Tx(buf []byte, lastErr error) (res []byte, err error) {
 	h.stateLock.Lock()
-	defer h.stateLock.Unlock()
-	
-	if h.state.outboundMsgs == nil || h.state.accumulatingMsgs {
-		return
-	}
+	pushing := h.outbound != nil
+	h.stateLock.Unlock()
 
-	if h.state.lastOutboundIndex == 0 {
-		flog.Logger.Println("found", len(h.state.outboundMsgs), "outbound messages")
+	if pushing {
+		return nil, ErrOutboundInUse
 	}
 
-	if len(h.state.outboundMsgs) == 1 {
-		b := &bytes.Buffer{}
-		binary.Write(b, binary.LittleEndian, zeroPad(h.state.outboundMsgs[h.state.lastOutboundIndex]))
+	res = h.nextReport()
+	return
+}
 
-		res = b.Bytes()
-		flog.Logger.Println(res)
-		flog.Logger.Println("finished processing messages, clearing buffers")
-		h.state.clear()
-		return
-	}
+// nextReport returns the next outbound message, ready to be sent on the wire, or nil if there's none.
+func (h *Handler) nextReport() []byte {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
 
-	if h.state.lastOutboundIndex == len(h.state.outboundMsgs) {
-		flog.Logger.Println("finished processing messages, clearing buffers")
-		h.state.clear()
-		return
+	h.state.expire(time.Now())
+
+	msg := h.state.next()
+	if msg == nil {
+		return nil
 	}
 
 	b := &bytes.Buffer{}
-	binary.Write(b, binary.LittleEndian, zeroPad(h.state.outboundMsgs[h.state.lastOutboundIndex]))
-	h.state.lastOutboundIndex++
+	binary.Write(b, binary.LittleEndian, zeroPad(msg))
 
-	res = b.Bytes()
+	res := b.Bytes()
 
-	flog.Logger.Println("processed message", h.state.lastOutboundIndex)
+	flog.Logger.Printf("processed message for channel 0x%X", binary.BigEndian.Uint32(res[:4]))
 
-	return
+	return res
 }
 
 // Rx handles data intake, parses messages and builds responses.
@@ -74,15 +72,30 @@ func (h *Handler) Rx(buf []byte, lastErr error) (res []byte, err error) {
 	h.stateLock.Lock()
 	defer h.stateLock.Unlock()
 
+	h.state.expire(time.Now())
+
 	// From here onwards, all the call stack that originates from parseMsg has exclusive access to h.state.
 	msgs, err := h.parseMsg(buf)
 	if err != nil {
 		flog.Logger.Println(err)
-		h.state.clear()
+
+		if len(buf) >= 4 {
+			h.state.clear(binary.BigEndian.Uint32(buf[:4]))
+		}
+
+		var pe protocolError
+		if !errors.As(err, &pe) {
+			return
+		}
+
+		// the host is told what went wrong, there's nothing left for the caller to handle
+		h.state.queue(pe.response()...)
+		err = nil
+
 		return
 	}
 
-	h.state.outboundMsgs = msgs
+	h.state.queue(msgs...)
 
 	return
 }
@@ -90,8 +103,8 @@ func (h *Handler) Rx(buf []byte, lastErr error) (res []byte, err error) {
 // parseMsg parses msg and constructs a slice of messages ready to be sent over the wire.
 // Each response message is exactly 64 bytes in length.
 func (h *Handler) parseMsg(msg []byte) ([][]byte, error) {
-	if len(msg) != 64 { // something's wrong
-		return nil, fmt.Errorf("wrong message length, expected 64 but got %d", len(msg))
+	if len(msg) != ReportLen { // something's wrong
+		return nil, fmt.Errorf("wrong message length, expected %d but got %d", ReportLen, len(msg))
 	}
 
 	cmd := msg[4]
@@ -99,6 +112,30 @@ func (h *Handler) parseMsg(msg []byte) ([][]byte, error) {
 
 	flog.Logger.Println("msg ", msg)
 
+	if isInit && Command(cmd) == CmdCancel {
+		// CmdCancel is handled out of band, without touching the channel session
+		h.handleCancel(parseInitPkt(msg))
+		return nil, nil
+	}
+
+	var pkt u2fPacket = parseContinuationPkt(msg)
+	if isInit {
+		pkt = parseInitPkt(msg)
+	}
+
+	// malformed packets are reported as such, even while other channels are busy
+	if err := h.validate(pkt); err != nil {
+		return nil, err
+	}
+
+	// channel allocation is always allowed, since its response is a single packet, and so is resynchronisation
+	// of the channel whose transaction is in progress
+	resync := isInit && Command(cmd) == CmdInit && h.state.inUse(pkt.Channel())
+	if pkt.Channel() != BroadcastChannel && !resync && h.state.busy(pkt.Channel()) {
+		flog.Logger.Printf("channel 0x%X sent a message while another transaction is in progress", pkt.Channel())
+		return generateError(ErrChannelBusy, pkt), nil
+	}
+
 	if isInit {
 		return h.handleInitPacket(msg)
 	} else {
@@ -113,41 +150,20 @@ func (h *Handler) handleContinuationPacket(msg []byte) ([][]byte, error) {
 
 	session, ok := h.state.sessions[cp.Channel()]
 	if !ok {
-		return nil, fmt.Errorf("new continuation packet with id 0x%X, which was not seen before", cp.ChannelID)
+		return nil, newProtocolError(ErrInvalidSeq, cp, "new continuation packet with id 0x%X, which was not seen before", cp.ChannelID)
 	}
 
-	var seqError bool
-	switch {
-	case cp.SequenceNumber == 0:
-		if session.packetZeroSeen {
-			seqError = true
-		}
-	case cp.SequenceNumber-session.lastSequence != 1:
-		seqError = true
-	}
-
-	if seqError {
-		return nil, fmt.Errorf("found a continuation packet with non-sequential sequence number, expected %d but found %d", cp.SequenceNumber+1, session.lastSequence)
-	}
-
-	session.packetZeroSeen = true
-	session.lastSequence = cp.SequenceNumber
-
 	lastSize := len(session.data)
-	// TODO: here we should count how many zeroes we should include in cp.Data, because some of them
-	// are used in the U2F protocol.
 
-	if session.leftToRead < continuationPacketDataLen {
-		session.data = append(session.data, cp.Data[:session.leftToRead]...)
-		session.leftToRead = 0
-	} else {
-		session.data = append(session.data, cp.Data...)
-		session.leftToRead -= uint64(len(cp.Data))
+	if err := session.appendPacket(cp); err != nil {
+		return nil, newProtocolError(ErrInvalidSeq, cp, "%s", err)
 	}
 
+	session.lastUsed = time.Now()
+
 	flog.Logger.Printf("read new %d bytes, last size %d, new size %d, total expected size %d", len(cp.Data), lastSize, len(session.data), session.total)
 
-	if len(session.data) != int(session.total) {
+	if !session.complete() {
 		return nil, nil // we still need more data
 	}
 
@@ -160,27 +176,27 @@ func (h *Handler) handleInitPacket(msg []byte) ([][]byte, error) {
 	flog.Logger.Println("found init packet")
 	ip := parseInitPkt(msg)
 
-	s, ok := h.state.sessions[ip.Channel()]
+	s, ok := h.state.session(ip.Channel(), time.Now())
 	if !ok {
+		if ip.Channel() != BroadcastChannel {
+			return nil, newProtocolError(ErrInvalidCid, ip, "found %s on channel 0x%X, which was not allocated", ip.Cmd, ip.Channel())
+		}
+
+		// CmdInit on the broadcast channel fits in a single packet, and its session is never stored
 		s = &session{}
 	}
 
 	flog.Logger.Println("command:", ip.Cmd.String())
 
-	s.command = ip.Cmd
-	s.total = uint64(ip.PayloadLength)
-	s.data = make([]byte, 0, s.total)
-	s.data = append(s.data, ip.Data...)
-	s.leftToRead = uint64(int(ip.PayloadLength) - len(s.data))
+	// a new request starts from scratch, even if the channel was used before
+	s.start(ip)
 
-	h.state.sessions[ip.Channel()] = s
-
-	if s.total <= initPacketDataLen {
+	if s.complete() {
 		// handle everything as a single entity
 		return h.packetBuilder(s, ip)
 	}
 
-	h.state.accumulatingMsgs = true
+	h.state.accumulate(ip.Channel())
 
 	return nil, nil
 }
@@ -192,21 +208,15 @@ func numPackets(rawMsgLen int) int {
 	return int(math.Ceil(float64(rawMsgLen) / float64(continuationPacketDataLen)))
 }
 
-// broadcastReq responds to broadcast messages, sent with channel id [255, 255, 255, 255].
-func broadcastReq(ip initPacket) ([]byte, error) {
-	if ip.Cmd != cmdInit {
+// broadcastReq responds to CmdInit messages, sent with channel id [255, 255, 255, 255] to allocate a channel, or
+// on an allocated channel to resynchronise it.
+// assignedChannelID is the channel allocated to the host, info and capabilities describe the device to it.
+func broadcastReq(ip initPacket, assignedChannelID uint32, info DeviceInfo, capabilities uint8) ([]byte, error) {
+	if ip.Cmd != CmdInit {
 		return nil, fmt.Errorf("found message for broadcast chan but command was %d instead of U2FHID_INIT", ip.Command())
 	}
 
-	flog.Logger.Println("found cmdInit on broadcast channel")
-
-	assignedChannelID := make([]byte, 4)
-	_, err := rand.Read(assignedChannelID)
-	if err != nil {
-		return nil, fmt.Errorf("cannot generate random channel ID, %w", err)
-	}
-
-	flog.Logger.Println("created new channel id", assignedChannelID)
+	flog.Logger.Printf("found cmdInit on channel 0x%X, assigning channel 0x%X", ip.Channel(), assignedChannelID)
 
 	b := new(bytes.Buffer)
 	u := initResponse{
@@ -214,18 +224,18 @@ func broadcastReq(ip initPacket) ([]byte, error) {
 			Command:   ip.Command(),
 			ChannelID: ip.ChannelID,
 		},
-		ProtocolVersion:    12,
-		MajorDeviceVersion: 4,
-		MinorDeviceVersion: 2,
-		BuildDeviceVersion: 0,
-		Capabilities:       0,
+		ProtocolVersion:    protocolVersion,
+		MajorDeviceVersion: info.MajorVersion,
+		MinorDeviceVersion: info.MinorVersion,
+		BuildDeviceVersion: info.BuildVersion,
+		Capabilities:       capabilities,
 	}
 
 	copy(u.Nonce[:], ip.Data)
-	copy(u.AssignedChannelID[:], assignedChannelID)
+	binary.BigEndian.PutUint32(u.AssignedChannelID[:], assignedChannelID)
 
-	binary.BigEndian.PutUint16(u.Count[:], 17)
-	err = binary.Write(b, binary.LittleEndian, u)
+	binary.BigEndian.PutUint16(u.Count[:], uint16(binary.Size(u)-binary.Size(u.standardResponse)))
+	err := binary.Write(b, binary.LittleEndian, u)
 	if err != nil {
 		return nil, fmt.Errorf("cannot serialize initResponse: %w", err)
 	}
@@ -236,67 +246,113 @@ func broadcastReq(ip initPacket) ([]byte, error) {
 
 // packetBuilder builds response packages for a given session, depending on session.command.
 func (h *Handler) packetBuilder(session *session, pkt u2fPacket) ([][]byte, error) {
-	flog.Logger.Println("message", u2fHIDCommand(pkt.Command()))
+	flog.Logger.Println("message", Command(pkt.Command()))
+
+	// the request is complete, its response ends the transaction
+	h.state.stopAccumulating(pkt.Channel())
 
 	if ch, handled := h.commandMappings[session.command]; handled {
 		flog.Logger.Println("found command to be handled via command mappings:", session.command)
 
-		pkts, err := genPackets(
-			ch(session.data[:session.total]),
-			session.command,
-			pkt.ChannelBytes(),
-		)
+		s := *session
+		h.execute(pkt, func(_ context.Context) ([][]byte, error) {
+			pkts, err := genPackets(
+				ch(s.data[:s.total]),
+				s.command,
+				pkt.ChannelBytes(),
+			)
 
-		if err != nil {
-			return nil, fmt.Errorf("error while handling msg, %w", err)
-		}
+			if err != nil {
+				return nil, fmt.Errorf("error while handling msg, %w", err)
+			}
 
-		h.state.accumulatingMsgs = false
-		h.state.lastChannelID = pkt.Channel()
-		return pkts, nil
+			return pkts, nil
+		})
+
+		return nil, nil
 	}
 
 	// use standard u2fhid commands
 	switch session.command {
-	case cmdInit:
+	case CmdInit:
 		ip, ok := pkt.(initPacket)
 		if !ok {
 			return nil, fmt.Errorf("found cmdInit packet, but said packet cannot be read as one")
 		}
 
-		if ip.Channel() != broadcastChan {
-			return nil, fmt.Errorf("found a cmdInit, but not on the broadcast channel")
+		var channel uint32
+		if ip.Channel() == BroadcastChannel {
+			var err error
+			if channel, err = h.state.allocate(time.Now()); err != nil {
+				return nil, err
+			}
+		} else {
+			if !h.state.allocated(ip.Channel()) {
+				return nil, fmt.Errorf("found a cmdInit, but not on the broadcast channel nor on an allocated one")
+			}
+
+			channel = ip.Channel()
+			h.state.resync(channel)
 		}
 
-		h.state.lastChannelID = broadcastChan
-		h.state.accumulatingMsgs = false
-
-		ret, err := broadcastReq(ip)
+		ret, err := broadcastReq(ip, channel, h.deviceInfo, h.capabilities())
 		if err != nil {
 			return nil, err
 		}
 
 		return [][]byte{ret}, nil
-	case cmdPing:
+	case CmdPing:
 		pkts, err := handlePing(session, pkt)
 		if err != nil {
 			return nil, fmt.Errorf("error while handling ping, %w", err)
 		}
 
-		h.state.accumulatingMsgs = false
-		h.state.lastChannelID = pkt.Channel()
 		return pkts, nil
-	case cmdMsg:
-		pkts, err := h.handleMsg(session, pkt)
-		if err != nil {
-			return nil, fmt.Errorf("error while handling msg, %w", err)
+	case CmdLock:
+		return h.handleLock(session, pkt)
+	case CmdWink:
+		if h.winker == nil {
+			flog.Logger.Println("wink command received, but no winker configured")
+			return generateError(ErrInvalidCmd, pkt), nil
 		}
 
-		h.state.accumulatingMsgs = false
-		h.state.lastChannelID = pkt.Channel()
-		return pkts, nil
+		return h.handleWink(session, pkt)
+	case CmdMsg:
+		if h.token == nil {
+			flog.Logger.Println("msg command received, but no token configured")
+			return generateError(ErrInvalidCmd, pkt), nil
+		}
+
+		s := *session
+		h.execute(pkt, func(ctx context.Context) ([][]byte, error) {
+			pkts, err := h.handleMsg(ctx, &s, pkt)
+			if err != nil {
+				return nil, fmt.Errorf("error while handling msg, %w", err)
+			}
+
+			return pkts, nil
+		})
+
+		return nil, nil
+	case CmdCbor:
+		if h.cborToken == nil {
+			flog.Logger.Println("cbor command received, but no cbor token configured")
+			return generateError(ErrInvalidCmd, pkt), nil
+		}
+
+		s := *session
+		h.execute(pkt, func(ctx context.Context) ([][]byte, error) {
+			pkts, err := h.handleCbor(ctx, &s, pkt)
+			if err != nil {
+				return nil, fmt.Errorf("error while handling cbor, %w", err)
+			}
+
+			return pkts, nil
+		})
+
+		return nil, nil
 	default:
 		flog.Logger.Printf("command %d not found, sending error payload", session.command)
-		return generateError(invalidCmd, pkt), nil
+		return generateError(ErrInvalidCmd, pkt), nil
 	}
 }
@@ -70,7 +70,7 @@ func TestHandler_parseMsg(t *testing.T) {
 				h, err := NewHandler(&fakeToken{})
 				require.NoError(t, err)
 
-				msg := zeroPad([]byte{1, 2, 3, 4, uint8(cmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+				msg := zeroPad([]byte{1, 2, 3, 4, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
 
 				d, err := h.parseMsg(msg)
 				require.Error(t, err)
@@ -84,21 +84,18 @@ func TestHandler_parseMsg(t *testing.T) {
 				h, err := NewHandler(&fakeToken{})
 				require.NoError(t, err)
 
-				channelInt := binary.BigEndian.Uint32([]byte{255, 255, 255, 255})
-
-				msg := zeroPad([]byte{255, 255, 255, 255, uint8(cmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+				msg := zeroPad([]byte{255, 255, 255, 255, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8})
 
 				d, err := h.parseMsg(msg)
 				require.NoError(t, err)
-				require.NotNil(t, d)
+				require.Len(t, d, 1)
 
 				require.False(t, h.state.accumulatingMsgs)
-				require.Contains(t, h.state.sessions, channelInt)
-
-				s := h.state.sessions[channelInt]
+				require.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, d[0][7:15])
 
-				require.Equal(t, uint64(8), s.total)
-				require.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, s.data[:8])
+				// only the allocated channel has a session
+				require.Len(t, h.state.sessions, 1)
+				require.Contains(t, h.state.sessions, binary.BigEndian.Uint32(d[0][15:19]))
 			},
 		},
 		{
@@ -126,10 +123,11 @@ func TestHandler_parseMsg(t *testing.T) {
 				secondHalf := bytes.Repeat([]byte{1}, 5)
 
 				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
 
 				channelInt := binary.BigEndian.Uint32(channel)
 
-				initNoPad := append(channel, uint8(cmdMsg))
+				initNoPad := append(channel, uint8(CmdMsg))
 				initNoPad = append(initNoPad, []byte{0, 62}...)
 				initNoPad = append(initNoPad, firstHalf...)
 				init := zeroPad(initNoPad)
@@ -148,7 +146,7 @@ func TestHandler_parseMsg(t *testing.T) {
 				s := h.state.sessions[channelInt]
 
 				require.Equal(t, uint64(57+5), s.total)
-				require.Equal(t, cmdMsg, s.command)
+				require.Equal(t, CmdMsg, s.command)
 				require.Equal(t, firstHalf, s.data)
 				require.Equal(t, uint64(5), s.leftToRead)
 
@@ -158,7 +156,8 @@ func TestHandler_parseMsg(t *testing.T) {
 
 				d, err = h.parseMsg(cont)
 				require.NoError(t, err)
-				require.NotNil(t, d)
+				require.Nil(t, d)
+				require.NotEmpty(t, waitResponse(t, h))
 
 				require.False(t, h.state.accumulatingMsgs)
 				require.Contains(t, h.state.sessions, channelInt)
@@ -166,7 +165,7 @@ func TestHandler_parseMsg(t *testing.T) {
 				s = h.state.sessions[channelInt]
 
 				require.Equal(t, uint64(57+5), s.total)
-				require.Equal(t, cmdMsg, s.command)
+				require.Equal(t, CmdMsg, s.command)
 				require.Equal(t, append(firstHalf, secondHalf...), s.data)
 				require.Equal(t, uint64(0), s.leftToRead)
 			},
@@ -213,8 +212,9 @@ func TestHandler_handleContinuationPacket(t *testing.T) {
 				secondHalf := bytes.Repeat([]byte{1}, 59)
 
 				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
 
-				initNoPad := append(channel, uint8(cmdMsg))
+				initNoPad := append(channel, uint8(CmdMsg))
 				initNoPad = append(initNoPad, []byte{0, 255}...)
 				initNoPad = append(initNoPad, firstHalf...)
 				init := zeroPad(initNoPad)
@@ -275,8 +275,9 @@ func TestHandler_handleInitPacket(t *testing.T) {
 				firstHalf := bytes.Repeat([]byte{1}, 57)
 
 				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
 
-				initNoPad := append(channel, uint8(cmdMsg))
+				initNoPad := append(channel, uint8(CmdMsg))
 				initNoPad = append(initNoPad, []byte{0, 57}...)
 				initNoPad = append(initNoPad, firstHalf...)
 				init := zeroPad(initNoPad)
@@ -286,7 +287,8 @@ func TestHandler_handleInitPacket(t *testing.T) {
 				token.data = firstHalf
 				d, err := h.handleInitPacket(init)
 				require.NoError(t, err)
-				require.NotNil(t, d)
+				require.Nil(t, d)
+				require.NotEmpty(t, waitResponse(t, h))
 
 				channelInt := binary.BigEndian.Uint32(channel)
 				s, found := h.state.sessions[channelInt]
@@ -305,8 +307,9 @@ func TestHandler_handleInitPacket(t *testing.T) {
 				firstHalf := bytes.Repeat([]byte{1}, 57)
 
 				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
 
-				initNoPad := append(channel, uint8(cmdMsg))
+				initNoPad := append(channel, uint8(CmdMsg))
 				initNoPad = append(initNoPad, []byte{0, 58}...)
 				initNoPad = append(initNoPad, firstHalf...)
 				init := zeroPad(initNoPad)
@@ -329,6 +332,54 @@ func TestHandler_handleInitPacket(t *testing.T) {
 	}
 }
 
+// TestHandler_initPadding is a regression test: the bytes of an init packet past the payload length are padding,
+// and used to be handled as part of the payload.
+func TestHandler_initPadding(t *testing.T) {
+	h, err := NewHandler(&fakeToken{})
+	require.NoError(t, err)
+
+	channel := [4]byte{1, 2, 3, 4}
+	allocateChannels(h, channel)
+
+	// hosts aren't required to pad with zeroes
+	msg := append(channel[:], uint8(CmdPing), 0, 1, 42)
+	msg = append(msg, bytes.Repeat([]byte{0xaa}, initPacketDataLen-1)...)
+
+	_, err = h.Rx(msg, nil)
+	require.NoError(t, err)
+
+	sent := drain(t, h)
+	require.Len(t, sent, 1)
+	require.Equal(t, append(channel[:], uint8(CmdPing), 0, 1, 42), sent[0][:8])
+	require.Equal(t, make([]byte, initPacketDataLen-1), sent[0][8:])
+}
+
+// TestHandler_sessionReuse is a regression test: a new request used to inherit the sequence number of the previous
+// one on the same channel, so the second multi-packet request of a channel was rejected.
+func TestHandler_sessionReuse(t *testing.T) {
+	h, err := NewHandler(&fakeToken{})
+	require.NoError(t, err)
+
+	channel := [4]byte{1, 2, 3, 4}
+	allocateChannels(h, channel)
+
+	init := zeroPad(append(append(channel[:], uint8(CmdPing), 0, 60), bytes.Repeat([]byte{1}, initPacketDataLen)...))
+	cont := zeroPad(append(channel[:], 0, 2, 2, 2))
+
+	for i := 0; i < 2; i++ {
+		_, err = h.Rx(init, nil)
+		require.NoError(t, err)
+
+		_, err = h.Rx(cont, nil)
+		require.NoError(t, err)
+
+		sent := drain(t, h)
+		require.Len(t, sent, 2)
+		require.Equal(t, append(channel[:], uint8(CmdPing), 0, 60), sent[0][:7])
+		require.Equal(t, append(channel[:], 0, 2, 2, 2), sent[1][:8])
+	}
+}
+
 func Test_numPackets(t *testing.T) {
 
 	tests := []struct {
@@ -368,12 +419,12 @@ func Test_broadcastReq(t *testing.T) {
 				255,
 				255,
 			},
-			Cmd:           cmdPing,
+			Cmd:           CmdPing,
 			PayloadLength: 0,
 			Data:          nil,
 		}
 
-		d, err := broadcastReq(i)
+		d, err := broadcastReq(i, 0x01020304, defaultDeviceInfo, 0)
 		require.Nil(t, d)
 		require.Error(t, err)
 		require.Contains(t, err.Error(), "instead of U2FHID_INIT")
@@ -387,12 +438,12 @@ func Test_broadcastReq(t *testing.T) {
 				255,
 				255,
 			},
-			Cmd:           cmdInit,
+			Cmd:           CmdInit,
 			PayloadLength: 8,
 			Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
 		}
 
-		d, err := broadcastReq(i)
+		d, err := broadcastReq(i, 0x01020304, defaultDeviceInfo, 0)
 		require.NotNil(t, d)
 		require.NoError(t, err)
 
@@ -401,7 +452,7 @@ func Test_broadcastReq(t *testing.T) {
 		copy(c[:], d[:4])
 		require.Equal(t, i.ChannelID, c)
 
-		// command is cmdInit
+		// command is CmdInit
 		require.Equal(t, i.Command(), d[4])
 
 		// first byte of payload size is zero, second is 17
@@ -411,16 +462,42 @@ func Test_broadcastReq(t *testing.T) {
 		// nonce is equal to what we put in data
 		require.Equal(t, i.Data, d[7:7+8])
 
-		// assigned channel id isn't all zeroes
-		require.NotEqual(t, []byte{0, 0, 0, 0}, d[15:19])
+		// assigned channel id is the one allocated
+		require.Equal(t, []byte{1, 2, 3, 4}, d[15:19])
 
 		// remaining version bytes are equal
-		require.Equal(t, uint8(12), d[19])
+		require.Equal(t, uint8(protocolVersion), d[19])
 		require.Equal(t, uint8(4), d[20])
 		require.Equal(t, uint8(2), d[21])
 		require.Equal(t, uint8(0), d[22])
 		require.Equal(t, uint8(0), d[23])
 	})
+
+	t.Run("capabilities are advertised", func(t *testing.T) {
+		i := initPacket{
+			ChannelID:     [4]byte{255, 255, 255, 255},
+			Cmd:           CmdInit,
+			PayloadLength: 8,
+			Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+
+		d, err := broadcastReq(i, 0x01020304, defaultDeviceInfo, CapabilityCbor)
+		require.NoError(t, err)
+		require.Equal(t, CapabilityCbor, d[23])
+	})
+
+	t.Run("device info is advertised", func(t *testing.T) {
+		i := initPacket{
+			ChannelID:     [4]byte{255, 255, 255, 255},
+			Cmd:           CmdInit,
+			PayloadLength: 8,
+			Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		}
+
+		d, err := broadcastReq(i, 0x01020304, DeviceInfo{MajorVersion: 1, MinorVersion: 7, BuildVersion: 42}, 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte{1, 7, 42}, d[20:23])
+	})
 }
 
 func TestHandler_packetBuilder(t *testing.T) {
@@ -433,7 +510,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 				require.NoError(t, err)
 
 				s := session{
-					command: u2fHIDCommand(42),
+					command: Command(42),
 				}
 
 				dd, err := h.packetBuilder(&s, initPacket{})
@@ -448,7 +525,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 				require.Equal(t, []byte{0, 0, 0, 0}, d[:4])
 
 				d = d[4:]
-				require.Equal(t, uint8(cmdError), d[0])
+				require.Equal(t, uint8(CmdError), d[0])
 				require.Equal(t, uint8(0), d[1])
 				require.Equal(t, uint8(1), d[2])
 			},
@@ -461,7 +538,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 				require.NoError(t, err)
 
 				s := session{
-					command: cmdInit,
+					command: CmdInit,
 				}
 
 				dd, err := h.packetBuilder(&s, continuationPacket{})
@@ -478,7 +555,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 				require.NoError(t, err)
 
 				s := session{
-					command: cmdInit,
+					command: CmdInit,
 				}
 
 				p := initPacket{
@@ -499,7 +576,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 				require.NoError(t, err)
 
 				s := session{
-					command: cmdInit,
+					command: CmdInit,
 				}
 
 				i := initPacket{
@@ -509,7 +586,7 @@ func TestHandler_packetBuilder(t *testing.T) {
 						255,
 						255,
 					},
-					Cmd:           cmdInit,
+					Cmd:           CmdInit,
 					PayloadLength: 8,
 					Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
 				}
@@ -533,13 +610,13 @@ func TestHandler_packetBuilder(t *testing.T) {
 						3,
 						4,
 					},
-					Cmd:           cmdPing,
+					Cmd:           CmdPing,
 					PayloadLength: 8,
 					Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
 				}
 
 				s := session{
-					command: cmdPing,
+					command: CmdPing,
 					data:    i.Data,
 					total:   uint64(len(i.Data)),
 				}
@@ -571,13 +648,13 @@ func TestHandler_packetBuilder(t *testing.T) {
 						3,
 						4,
 					},
-					Cmd:           cmdPing,
+					Cmd:           CmdPing,
 					PayloadLength: 8,
 					Data:          []byte{1, 2, 3, 4, 5, 6, 7, 8},
 				}
 
 				s := session{
-					command: cmdPing,
+					command: CmdPing,
 					total:   uint64(len(i.Data)),
 				}
 
@@ -602,14 +679,14 @@ func TestHandler_packetBuilder(t *testing.T) {
 						3,
 						4,
 					},
-					Cmd:           cmdMsg,
+					Cmd:           CmdMsg,
 					PayloadLength: 57,
 					Data:          firstHalf,
 				}
 
 				s := session{
 					data:           firstHalf,
-					command:        cmdMsg,
+					command:        CmdMsg,
 					total:          57,
 					leftToRead:     0,
 					lastSequence:   0,
@@ -622,7 +699,28 @@ func TestHandler_packetBuilder(t *testing.T) {
 
 				d, err := h.packetBuilder(&s, i)
 				require.NoError(t, err)
-				require.NotNil(t, d)
+				require.Nil(t, d)
+				require.NotEmpty(t, waitResponse(t, h))
+			},
+		},
+		{
+			"session is cmdCbor but no cbor token is configured",
+			func(t *testing.T) {
+				token := &fakeToken{}
+				h, err := NewHandler(token)
+				require.NoError(t, err)
+
+				s := session{
+					command: CmdCbor,
+				}
+
+				dd, err := h.packetBuilder(&s, initPacket{ChannelID: [4]byte{1, 2, 3, 4}})
+				require.NoError(t, err)
+				require.Len(t, dd, 1)
+
+				d := dd[0]
+				require.Equal(t, uint8(CmdError), d[4])
+				require.Equal(t, uint8(ErrInvalidCmd), d[7])
 			},
 		},
 		{
@@ -641,14 +739,14 @@ func TestHandler_packetBuilder(t *testing.T) {
 						3,
 						4,
 					},
-					Cmd:           cmdMsg,
+					Cmd:           CmdMsg,
 					PayloadLength: 57,
 					Data:          firstHalf,
 				}
 
 				s := session{
 					data:           firstHalf,
-					command:        cmdMsg,
+					command:        CmdMsg,
 					total:          57,
 					leftToRead:     0,
 					lastSequence:   0,
@@ -660,8 +758,111 @@ func TestHandler_packetBuilder(t *testing.T) {
 				token.data = firstHalf
 
 				d, err := h.packetBuilder(&s, i)
-				require.Error(t, err)
+				require.NoError(t, err)
 				require.Nil(t, d)
+
+				dd := waitResponse(t, h)
+				require.Len(t, dd, 1)
+				require.Equal(t, uint8(CmdError), dd[0][4])
+				require.Equal(t, uint8(ErrOther), dd[0][7])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestHandler_channels(t *testing.T) {
+	pingInit := func(channel [4]byte, length int, data []byte) []byte {
+		msg := append(channel[:], uint8(CmdPing), 0, uint8(length))
+		return zeroPad(append(msg, data...))
+	}
+
+	pingCont := func(channel [4]byte, seq uint8, data []byte) []byte {
+		msg := append(channel[:], seq)
+		return zeroPad(append(msg, data...))
+	}
+
+	a := [4]byte{1, 2, 3, 4}
+	b := [4]byte{5, 6, 7, 8}
+
+	tests := []test{
+		{
+			"other channels are busy while a request is accumulated",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				_, err = h.Rx(pingInit(a, 60, bytes.Repeat([]byte{1}, 57)), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(pingInit(b, 4, []byte{2, 2, 2, 2}), nil)
+				require.NoError(t, err)
+
+				// channel allocation doesn't interfere with the transaction
+				_, err = h.Rx(zeroPad([]byte{255, 255, 255, 255, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(pingCont(a, 0, []byte{1, 1, 1}), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 4)
+
+				require.Equal(t, b[:], sent[0][:4])
+				require.Equal(t, uint8(CmdError), sent[0][4])
+				require.Equal(t, uint8(ErrChannelBusy), sent[0][7])
+
+				require.Equal(t, []byte{255, 255, 255, 255, uint8(CmdInit)}, sent[1][:5])
+
+				require.Equal(t, a[:], sent[2][:4])
+				require.Equal(t, uint8(CmdPing), sent[2][4])
+				require.Equal(t, []byte{0, 60}, sent[2][5:7])
+				require.Equal(t, a[:], sent[3][:4])
+				require.Equal(t, uint8(0), sent[3][4])
+
+				// the transaction is over, so other channels can start a new one
+				_, err = h.Rx(pingInit(b, 4, []byte{2, 2, 2, 2}), nil)
+				require.NoError(t, err)
+
+				sent = drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, b[:], sent[0][:4])
+				require.Equal(t, uint8(CmdPing), sent[0][4])
+			},
+		},
+		{
+			"outbound messages of different channels are interleaved",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, a, b)
+
+				// a three packets ping response for a, queued before b response
+				_, err = h.Rx(pingInit(a, 120, bytes.Repeat([]byte{1}, 57)), nil)
+				require.NoError(t, err)
+				_, err = h.Rx(pingCont(a, 0, bytes.Repeat([]byte{1}, 59)), nil)
+				require.NoError(t, err)
+				_, err = h.Rx(pingCont(a, 1, bytes.Repeat([]byte{1}, 4)), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(pingInit(b, 4, []byte{2, 2, 2, 2}), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 4)
+
+				var channels [][]byte
+				for _, s := range sent {
+					channels = append(channels, s[:4])
+				}
+
+				require.Equal(t, [][]byte{a[:], b[:], a[:], a[:]}, channels)
 			},
 		},
 	}
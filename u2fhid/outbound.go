@@ -0,0 +1,67 @@
+package u2fhid
+
+import (
+	"errors"
+	"time"
+)
+
+// expireInterval is the amount of time between two checks for stalled requests and unused channels, while there
+// are no outbound messages to deliver through Outbound.
+const expireInterval = 100 * time.Millisecond
+
+// ErrOutboundInUse is returned by Tx once outbound messages are delivered through Outbound.
+var ErrOutboundInUse = errors.New("outbound messages are delivered through Outbound")
+
+// Outbound returns a channel delivering outbound messages as soon as they're ready, for transports which push data
+// to the host instead of being polled for it with Tx.
+// Once Outbound is called Tx returns ErrOutboundInUse, and the channel is closed once Close is called.
+func (h *Handler) Outbound() <-chan []byte {
+	h.outboundOnce.Do(func() {
+		out := make(chan []byte)
+
+		h.stateLock.Lock()
+		h.outbound = out
+		h.stateLock.Unlock()
+
+		go h.deliver(out)
+	})
+
+	return h.outbound
+}
+
+// Close stops the delivery of outbound messages started by Outbound, and closes the channel it returned.
+// Messages not delivered yet are dropped.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.closed)
+	})
+
+	return nil
+}
+
+// deliver sends outbound messages to out, waiting for new ones to be queued when there's none, until h is closed.
+func (h *Handler) deliver(out chan<- []byte) {
+	defer close(out)
+
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		if res := h.nextReport(); res != nil {
+			select {
+			case out <- res:
+			case <-h.closed:
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case <-h.state.ready:
+		case <-ticker.C:
+		case <-h.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package u2fhid
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+// receive returns the next message delivered by out, failing if none arrives within a second.
+func receive(t *testing.T, out <-chan []byte) []byte {
+	select {
+	case msg := <-out:
+		return msg
+	case <-time.After(time.Second):
+		require.FailNow(t, "no outbound message")
+		return nil
+	}
+}
+
+func TestHandler_Outbound(t *testing.T) {
+	tests := []test{
+		{
+			"responses are delivered as soon as they're ready",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				out := h.Outbound()
+				require.Equal(t, out, h.Outbound())
+
+				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+				msg := append(channel, uint8(CmdPing), 0, 100)
+
+				_, err = h.Rx(zeroPad(append(msg, bytes.Repeat([]byte{1}, initPacketDataLen)...)), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(zeroPad(append(channel, 0)), nil)
+				require.NoError(t, err)
+
+				first := receive(t, out)
+				require.Len(t, first, 64)
+				require.Equal(t, append(channel, uint8(CmdPing), 0, 100), first[:7])
+
+				second := receive(t, out)
+				require.Equal(t, append(channel, 0), second[:5])
+			},
+		},
+		{
+			"keepalives and responses of commands executed in background",
+			func(t *testing.T) {
+				token := &presenceToken{signal: presence.NewSignal()}
+				h, err := NewHandler(&fakeToken{}, WithCBOR(token))
+				require.NoError(t, err)
+
+				out := h.Outbound()
+				channel := [4]byte{1, 2, 3, 4}
+				allocateChannels(h, channel)
+
+				_, err = h.Rx(cborRequest(channel, []byte{42}), nil)
+				require.NoError(t, err)
+
+				require.Equal(t, uint8(CmdKeepalive), receive(t, out)[4])
+
+				require.Eventually(t, token.signal.Confirm, time.Second, time.Millisecond)
+
+				for {
+					msg := receive(t, out)
+					if msg[4] == uint8(CmdKeepalive) {
+						continue
+					}
+
+					require.Equal(t, uint8(CmdCbor), msg[4])
+					require.Equal(t, []byte{0, 1, 42}, msg[5:8])
+					break
+				}
+			},
+		},
+		{
+			"stalled requests time out without further packets",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				out := h.Outbound()
+				channel := []byte{1, 2, 3, 4}
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+				msg := append(channel, uint8(CmdPing), 0, 100)
+
+				_, err = h.Rx(zeroPad(append(msg, bytes.Repeat([]byte{1}, initPacketDataLen)...)), nil)
+				require.NoError(t, err)
+
+				h.stateLock.Lock()
+				h.state.sessions[0x01020304].lastUsed = time.Now().Add(-2 * messageTimeout)
+				h.stateLock.Unlock()
+
+				resp := receive(t, out)
+				require.Equal(t, append(channel, uint8(CmdError), 0, 1, uint8(ErrMsgTimeout)), resp[:8])
+			},
+		},
+		{
+			"tx can't be used along with outbound",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				h.Outbound()
+
+				_, err = h.Tx(nil, nil)
+				require.ErrorIs(t, err, ErrOutboundInUse)
+			},
+		},
+		{
+			"close stops the delivery",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				out := h.Outbound()
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				// a response nobody reads
+				_, err = h.Rx(pingRequest([4]byte{1, 2, 3, 4}), nil)
+				require.NoError(t, err)
+
+				require.NoError(t, h.Close())
+				require.NoError(t, h.Close())
+
+				require.Eventually(t, func() bool {
+					select {
+					case _, ok := <-out:
+						return !ok
+					default:
+						return false
+					}
+				}, time.Second, time.Millisecond)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
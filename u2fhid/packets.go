@@ -11,6 +11,9 @@ import (
 )
 
 const (
+	// ReportLen is the length of each packet, sent as a single HID report.
+	ReportLen = 64
+
 	initPacketDataLen         = 57
 	continuationPacketDataLen = 59
 )
@@ -93,7 +96,7 @@ func parseContinuationPkt(msg []byte) continuationPacket {
 // initPacket is a U2FHID message packet for which the command byte has the seventh bit set.
 type initPacket struct {
 	ChannelID     [4]byte
-	Cmd           u2fHIDCommand
+	Cmd           Command
 	PayloadLength uint16
 	Data          []byte
 }
@@ -137,7 +140,7 @@ func (i initPacket) String() string {
 // FIDO U2F HID Protocol Specification, pg 4, "2.4 Message- and packet structure"
 func parseInitPkt(msg []byte) initPacket {
 	i := initPacket{
-		Cmd: u2fHIDCommand(msg[4]),
+		Cmd: Command(msg[4]),
 	}
 
 	copy(i.ChannelID[:], msg[0:4])
@@ -156,7 +159,7 @@ func isInitPkt(cmd uint8) bool {
 }
 
 // genPackets generates response packets for msg, command cmd and channel id chanID.
-func genPackets(msg []byte, cmd u2fHIDCommand, chanID [4]byte) ([][]byte, error) {
+func genPackets(msg []byte, cmd Command, chanID [4]byte) ([][]byte, error) {
 	if msg == nil {
 		return nil, errors.New("message is nil")
 	}
@@ -240,3 +243,80 @@ func split(sizeFirst int, sizeRest int, msg []byte) [][]byte {
 
 	return ret
 }
+
+// Fragment splits data into the packets of a cmd message sent on channel, each one ReportLen bytes long and ready
+// to be sent on the wire.
+// FIDO U2F HID Protocol Specification, pg 4, "2.4 Message- and packet structure"
+func Fragment(channel uint32, cmd Command, data []byte) ([][]byte, error) {
+	if len(data) > MaxPayloadLen {
+		return nil, fmt.Errorf("payload is %d bytes long, maximum is %d", len(data), MaxPayloadLen)
+	}
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	var chanID [4]byte
+	binary.BigEndian.PutUint32(chanID[:], channel)
+
+	pkts, err := genPackets(data, cmd, chanID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pkts {
+		pkts[i] = zeroPad(pkts[i])
+	}
+
+	return pkts, nil
+}
+
+// Message reassembles a message from the packets it was split into, see Fragment.
+// The zero value is an empty Message, ready to use.
+type Message struct {
+	s       session
+	started bool
+}
+
+// Add adds pkt, a ReportLen bytes long packet, to m, and returns true once m is complete.
+// The first packet of m must be an init packet, all the others continuation packets in sequence.
+func (m *Message) Add(pkt []byte) (bool, error) {
+	if len(pkt) != ReportLen {
+		return false, fmt.Errorf("packet is %d bytes long, expected %d", len(pkt), ReportLen)
+	}
+
+	if m.started && m.s.complete() {
+		return false, errors.New("message is already complete")
+	}
+
+	if !m.started {
+		if !isInitPkt(pkt[4]) {
+			return false, fmt.Errorf("expected an init packet, found continuation packet with sequence %d", pkt[4])
+		}
+
+		m.s.start(parseInitPkt(pkt))
+		m.started = true
+
+		return m.s.complete(), nil
+	}
+
+	if isInitPkt(pkt[4]) {
+		return false, fmt.Errorf("expected a continuation packet, found init packet with command 0x%X", pkt[4])
+	}
+
+	if err := m.s.appendPacket(parseContinuationPkt(pkt)); err != nil {
+		return false, err
+	}
+
+	return m.s.complete(), nil
+}
+
+// Command returns the command of m.
+func (m *Message) Command() Command {
+	return m.s.command
+}
+
+// Data returns the payload of m, received so far.
+func (m *Message) Data() []byte {
+	return m.s.data
+}
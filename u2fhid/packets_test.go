@@ -93,7 +93,7 @@ func Test_initPacket(t *testing.T) {
 			3,
 			4,
 		},
-		Cmd:           cmdInit,
+		Cmd:           CmdInit,
 		PayloadLength: 42,
 		Data:          bytes.Repeat([]byte("data"), 42),
 	}
@@ -111,7 +111,7 @@ func Test_initPacket(t *testing.T) {
 		{
 			"Command",
 			func(t *testing.T) {
-				require.Equal(t, uint8(cmdInit), cp.Command())
+				require.Equal(t, uint8(CmdInit), cp.Command())
 			},
 		},
 		{
@@ -149,7 +149,7 @@ func Test_parseInitPkt(t *testing.T) {
 		})
 
 		require.Equal(t, [4]byte{1, 2, 3, 4}, cp.ChannelID)
-		require.Equal(t, u2fHIDCommand(11), cp.Cmd)
+		require.Equal(t, Command(11), cp.Cmd)
 		require.Equal(t, uint16(2827), cp.PayloadLength)
 		require.Equal(t, []byte{42, 42, 42, 42}, cp.Data)
 	})
@@ -215,7 +215,7 @@ func Test_split(t *testing.T) {
 }
 
 func Test_genPackets(t *testing.T) {
-	cmd, chanID := cmdInit, [4]byte{1, 2, 3, 4}
+	cmd, chanID := CmdInit, [4]byte{1, 2, 3, 4}
 
 	tests := []struct {
 		name         string
@@ -278,3 +278,56 @@ func Test_genPackets(t *testing.T) {
 		})
 	}
 }
+
+func TestFragment(t *testing.T) {
+	for _, l := range []int{0, 1, initPacketDataLen, initPacketDataLen + 1, 1000, MaxPayloadLen} {
+		data := bytes.Repeat([]byte{42}, l)
+
+		pkts, err := Fragment(0x01020304, CmdPing, data)
+		require.NoError(t, err)
+		require.Len(t, pkts, 1+numPackets(l-initPacketDataLen))
+
+		var m Message
+		for i, p := range pkts {
+			require.Len(t, p, ReportLen)
+			require.Equal(t, []byte{1, 2, 3, 4}, p[:4])
+
+			done, err := m.Add(p)
+			require.NoError(t, err)
+			require.Equal(t, i == len(pkts)-1, done)
+		}
+
+		require.Equal(t, CmdPing, m.Command())
+		require.Equal(t, data, m.Data())
+	}
+
+	pkts, err := Fragment(0x01020304, CmdWink, nil)
+	require.NoError(t, err)
+	require.Len(t, pkts, 1)
+	require.Equal(t, []byte{1, 2, 3, 4, uint8(CmdWink), 0, 0}, pkts[0][:7])
+
+	_, err = Fragment(0x01020304, CmdPing, make([]byte, MaxPayloadLen+1))
+	require.Error(t, err)
+}
+
+func TestMessage_Add(t *testing.T) {
+	pkts, err := Fragment(0x01020304, CmdPing, make([]byte, 200))
+	require.NoError(t, err)
+
+	var m Message
+	_, err = m.Add(pkts[1])
+	require.Error(t, err, "continuation packet before init packet")
+
+	m = Message{}
+	_, err = m.Add(pkts[0][:10])
+	require.Error(t, err, "short packet")
+
+	_, err = m.Add(pkts[0])
+	require.NoError(t, err)
+
+	_, err = m.Add(pkts[0])
+	require.Error(t, err, "init packet in the middle of a message")
+
+	_, err = m.Add(pkts[2])
+	require.Error(t, err, "continuation packet out of sequence")
+}
@@ -1,6 +1,6 @@
 package u2fhid
 
-// initResponse represents the standard response to a cmdInit command.
+// initResponse represents the standard response to a CmdInit command.
 type initResponse struct {
 	standardResponse
 	Nonce              [8]byte
@@ -2,19 +2,35 @@ package u2fhid
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Token represents a unit which can handle U2F messages.
+// Tokens keeping per-channel state can implement transport.ChannelReleaser, to be told when a channel is released
+// because it expired or was evicted to make room for a new one.
 type Token interface {
-	// HandleMessage handles cmdMsg payloads, and return an appropriate response
+	// HandleMessage handles CmdMsg payloads, and return an appropriate response
 	// for the underlying command.
 	HandleMessage([]byte) []byte
 }
 
+// ContextToken is a Token whose message handling can be bound to a context.
+// Handler runs commands with a context which is notified of user presence waits, so that
+// keepalives sent to the host reflect them, and which carries the command channel, see
+// transport.ChannelFromContext.
+type ContextToken interface {
+	Token
+
+	// HandleMessageContext is like HandleMessage, but bound to ctx.
+	HandleMessageContext(ctx context.Context, b []byte) []byte
+}
+
 // u2fHIDReport is a byte slice holding a standard U2F HID report.
 type u2fHIDReport []byte
 
@@ -49,27 +65,34 @@ var DefaultReport = u2fHIDReport{
 	0xC0, /* End Collection */
 }
 
-//go:generate stringer -type=u2fHIDCommand
-type u2fHIDCommand int
+// Command is a U2FHID command, sent in init packets.
+//go:generate stringer -type=Command
+type Command int
 
-func (c u2fHIDCommand) isVendorCommand() bool {
+func (c Command) isVendorCommand() bool {
 	u := uint8(c)
 	return u >= VendorCommandFirst || u <= VendorCommandLast
 }
 
 const (
-	broadcastChan = 0xffffffff
+	// BroadcastChannel is the channel CmdInit is sent on to allocate a new channel.
+	BroadcastChannel = 0xffffffff
 
 	// mandatory commands
-	cmdPing  u2fHIDCommand = 0x80 | 0x01
-	cmdMsg   u2fHIDCommand = 0x80 | 0x03
-	cmdInit  u2fHIDCommand = 0x80 | 0x06
-	cmdError u2fHIDCommand = 0x80 | 0x3f
+	CmdPing  Command = 0x80 | 0x01
+	CmdMsg   Command = 0x80 | 0x03
+	CmdInit  Command = 0x80 | 0x06
+	CmdError Command = 0x80 | 0x3f
 
 	// optional commands
-	cmdLock u2fHIDCommand = 0x80 | 0x04
-	cmdWink u2fHIDCommand = 0x80 | 0x08
-	cmdSync u2fHIDCommand = 0x80 | 0x3c
+	CmdLock Command = 0x80 | 0x04
+	CmdWink Command = 0x80 | 0x08
+	CmdSync Command = 0x80 | 0x3c
+
+	// CTAP2 commands
+	CmdCbor      Command = 0x80 | 0x10
+	CmdCancel    Command = 0x80 | 0x11
+	CmdKeepalive Command = 0x80 | 0x3b
 
 	// VendorCommandFirst is the first admissible vendor command identifier.
 	VendorCommandFirst = 0x80 | 0x40
@@ -78,6 +101,75 @@ const (
 	VendorCommandLast = 0x80 | 0x7f
 )
 
+const (
+	// CapabilityWink is set in the CmdInit response capabilities byte when the device handles CmdWink.
+	CapabilityWink uint8 = 0x01
+
+	// CapabilityCbor is set in the CmdInit response capabilities byte when the device handles CmdCbor.
+	CapabilityCbor uint8 = 0x04
+
+	// CapabilityNmsg is set in the CmdInit response capabilities byte when the device doesn't handle CmdMsg.
+	CapabilityNmsg uint8 = 0x08
+)
+
+// protocolVersion is the CTAPHID protocol version sent in CmdInit responses.
+const protocolVersion = 2
+
+// DeviceInfo describes the device to the host in CmdInit responses, which hosts can use to tell firmware
+// versions apart.
+type DeviceInfo struct {
+	MajorVersion uint8
+	MinorVersion uint8
+	BuildVersion uint8
+}
+
+// DeviceInfoFromRevision returns the DeviceInfo derived from rev, the git revision the firmware has been built from.
+// A "vX.Y.Z" tag is used as version number, otherwise the first three bytes of the git hash are.
+// It returns false if rev is neither.
+func DeviceInfoFromRevision(rev string) (DeviceInfo, bool) {
+	var info DeviceInfo
+
+	_, err := fmt.Sscanf(rev, "v%d.%d.%d", &info.MajorVersion, &info.MinorVersion, &info.BuildVersion)
+	if err == nil {
+		return info, true
+	}
+
+	if len(rev) < 6 {
+		return info, false
+	}
+
+	b, err := hex.DecodeString(rev[:6])
+	if err != nil {
+		return info, false
+	}
+
+	info.MajorVersion, info.MinorVersion, info.BuildVersion = b[0], b[1], b[2]
+
+	return info, true
+}
+
+// defaultDeviceInfo is the DeviceInfo sent when none is configured.
+var defaultDeviceInfo = DeviceInfo{
+	MajorVersion: 4,
+	MinorVersion: 2,
+	BuildVersion: 0,
+}
+
+// Winker is implemented by devices which can identify themselves to the user, for example by blinking a LED.
+type Winker interface {
+	// Wink performs a short, distinctive identification sequence.
+	// It is called while handling CmdWink, so it must return immediately.
+	Wink()
+}
+
+// WinkerFunc is a function used as a Winker.
+type WinkerFunc func()
+
+// Wink implements the Winker interface.
+func (f WinkerFunc) Wink() {
+	f()
+}
+
 type CommandHandler func([]byte) []byte
 
 // Handler holds methods for sending and receiving packets.
@@ -90,31 +182,113 @@ type Handler struct {
 	stateLock sync.Mutex
 
 	// mapping between u2fHIDCommands and Token instances
-	commandMappings map[u2fHIDCommand]CommandHandler
+	commandMappings map[Command]CommandHandler
+
+	// token instance handling CmdCbor payloads, nil if CTAP2 is not supported
+	cborToken Token
+
+	// winker handling CmdWink, nil if not supported
+	winker Winker
+
+	// device description sent in CmdInit responses
+	deviceInfo DeviceInfo
+
+	// outbound messages channel, created by the first Outbound call, and closed once closed is
+	outbound     chan []byte
+	outboundOnce sync.Once
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// Option configures optional Handler features.
+type Option func(*Handler) error
+
+// WithCBOR enables CmdCbor handling, by passing each CTAP2 payload to t.
+// When set, the CmdInit response advertises CBOR capability.
+func WithCBOR(t Token) Option {
+	return func(h *Handler) error {
+		if t == nil {
+			return errors.New("cbor token is nil")
+		}
+
+		h.cborToken = t
+		return nil
+	}
+}
+
+// WithWinker enables CmdWink handling, by calling w.Wink for each request.
+// When set, the CmdInit response advertises wink capability.
+func WithWinker(w Winker) Option {
+	return func(h *Handler) error {
+		if w == nil {
+			return errors.New("winker is nil")
+		}
+
+		h.winker = w
+		return nil
+	}
+}
+
+// WithDeviceInfo sets the device description sent in CmdInit responses.
+func WithDeviceInfo(d DeviceInfo) Option {
+	return func(h *Handler) error {
+		h.deviceInfo = d
+		return nil
+	}
 }
 
 // NewHandler returns a new Handler instance with a given u2ftoken.Token.
-// Token cannot be nil.
-func NewHandler(token Token) (*Handler, error) {
-	if token == nil {
+// Token can only be nil if a CBOR token is configured with WithCBOR: in that case CmdMsg isn't handled,
+// and the CmdInit response advertises it.
+func NewHandler(token Token, opts ...Option) (*Handler, error) {
+	h := &Handler{
+		token:           token,
+		commandMappings: make(map[Command]CommandHandler),
+		state:           newU2FHIDState(),
+		deviceInfo:      defaultDeviceInfo,
+		closed:          make(chan struct{}),
+	}
+
+	h.state.onRelease = h.releaseChannel
+
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.token == nil && h.cborToken == nil {
 		return nil, errors.New("token is nil")
 	}
 
-	return &Handler{
-		token:           token,
-		commandMappings: make(map[u2fHIDCommand]CommandHandler),
-		state: &u2fHIDState{
-			sessions: map[uint32]*session{},
-		},
-	}, nil
+	return h, nil
+}
+
+// capabilities returns the capabilities byte to be sent in CmdInit responses.
+func (h *Handler) capabilities() uint8 {
+	var c uint8
+
+	if h.winker != nil {
+		c |= CapabilityWink
+	}
+
+	if h.cborToken != nil {
+		c |= CapabilityCbor
+	}
+
+	if h.token == nil {
+		c |= CapabilityNmsg
+	}
+
+	return c
 }
 
 // AddMapping adds a new CommandHandler mapping for a given command.
 // Returns error if there's already a mapping for command, or if it is not defined
 // between VendorCommandFirst and VendorCommandLast.
-// Each mapping will be handled like a cmdMsg, meaning that the input for ch will be the whole session
+// Each mapping will be handled like a CmdMsg, meaning that the input for ch will be the whole session
 // data, while its output will be framed and sent over the wire.
-func (h *Handler) AddMapping(command u2fHIDCommand, ch CommandHandler) error {
+func (h *Handler) AddMapping(command Command, ch CommandHandler) error {
 	if _, mappingExists := h.commandMappings[command]; mappingExists {
 		return errors.New("command mapping already exists")
 	}
@@ -141,14 +315,69 @@ type u2fPacket interface {
 // session holds informations about a single operation currently happening (MSG, PING...).
 type session struct {
 	data           []byte
-	command        u2fHIDCommand
+	command        Command
 	total          uint64
 	leftToRead     uint64
 	lastSequence   uint8
 	packetZeroSeen bool
+
+	// last time a packet was received on the session channel
+	lastUsed time.Time
+}
+
+// start starts reassembling the message whose init packet is ip, discarding the previous one.
+func (s *session) start(ip initPacket) {
+	s.clear()
+
+	s.command = ip.Cmd
+	s.total = uint64(ip.PayloadLength)
+	s.data = make([]byte, 0, s.total)
+
+	if s.total < uint64(len(ip.Data)) {
+		// the rest of the packet is padding
+		s.data = append(s.data, ip.Data[:s.total]...)
+	} else {
+		s.data = append(s.data, ip.Data...)
+	}
+
+	s.leftToRead = s.total - uint64(len(s.data))
+}
+
+// appendPacket appends the data of cp to the message being reassembled, returning an error if cp is out of
+// sequence.
+func (s *session) appendPacket(cp continuationPacket) error {
+	var expected uint8
+	if s.packetZeroSeen {
+		expected = s.lastSequence + 1
+	}
+
+	if cp.SequenceNumber != expected {
+		return fmt.Errorf("found a continuation packet with non-sequential sequence number, expected %d but found %d", expected, cp.SequenceNumber)
+	}
+
+	s.packetZeroSeen = true
+	s.lastSequence = cp.SequenceNumber
+
+	// TODO: here we should count how many zeroes we should include in cp.Data, because some of them
+	// are used in the U2F protocol.
+
+	if s.leftToRead < uint64(len(cp.Data)) {
+		s.data = append(s.data, cp.Data[:s.leftToRead]...)
+		s.leftToRead = 0
+	} else {
+		s.data = append(s.data, cp.Data...)
+		s.leftToRead -= uint64(len(cp.Data))
+	}
+
+	return nil
 }
 
-// clear clears a session, setting everything to their default values.
+// complete returns true once all the data of the message being reassembled was received.
+func (s *session) complete() bool {
+	return s.leftToRead == 0
+}
+
+// clear clears a session, setting everything but lastUsed to their default values.
 func (s *session) clear() {
 	s.data = nil
 	s.command = 0
@@ -158,25 +387,135 @@ func (s *session) clear() {
 	s.packetZeroSeen = false
 }
 
-// u2fHIDState holds the global state of the U2FHID token, keeping track of whether it is still accumulating messages,
-// all the outbound messages, all the sessions.
+// u2fHIDState holds the global state of the U2FHID token, keeping track of the transaction in progress,
+// the outbound messages of each channel, all the sessions.
+//
+// A transaction starts with the first packet of a request and ends once its response is queued.
+// Only one transaction at a time can be in progress: packets sent on other channels in the meantime are answered
+// with a ErrChannelBusy error. The same happens while a channel holds the lock, obtained with CmdLock.
 type u2fHIDState struct {
-	outboundMsgs      [][]byte
-	lastOutboundIndex int
-	accumulatingMsgs  bool
-	sessions          map[uint32]*session
-	lastChannelID     uint32
+	sessions map[uint32]*session
+
+	// outbound messages of each channel, and channels with outbound messages in transmission order
+	outbound map[uint32][][]byte
+	txOrder  []uint32
+
+	// channel whose request is being accumulated
+	accumulatingMsgs    bool
+	accumulatingChannel uint32
+
+	// command being executed, its channel, the function which aborts it and whether its response must be
+	// dropped, because the channel was resynchronised in the meantime
+	pending        bool
+	pendingChannel uint32
+	cancel         context.CancelFunc
+	discard        bool
+
+	// channel holding the lock, zero if none, and the time the lock expires at
+	lockChannel uint32
+	lockExpiry  time.Time
+
+	// ready receives a value when outbound messages are queued, without blocking
+	ready chan struct{}
+
+	// onRelease is called with each channel released, nil if nobody needs to know
+	onRelease func(channel uint32)
+}
+
+// newU2FHIDState returns a new, idle u2fHIDState.
+func newU2FHIDState() *u2fHIDState {
+	return &u2fHIDState{
+		sessions: map[uint32]*session{},
+		outbound: map[uint32][][]byte{},
+		ready:    make(chan struct{}, 1),
+	}
 }
 
-// clear deletes the last channel id session, and sets outbound messages and its index, and channel id to zero.
-func (u *u2fHIDState) clear() {
-	sess, ok := u.sessions[u.lastChannelID]
-	if ok {
+// busy returns true if a transaction is in progress or another channel holds the lock, and channel can't
+// send packets.
+// The channel accumulating a request can keep sending packets.
+func (u *u2fHIDState) busy(channel uint32) bool {
+	if u.pending {
+		return true
+	}
+
+	if u.lockChannel != 0 && u.lockChannel != channel {
+		return true
+	}
+
+	return u.accumulatingMsgs && u.accumulatingChannel != channel
+}
+
+// accumulate marks channel as the one whose request is being accumulated.
+func (u *u2fHIDState) accumulate(channel uint32) {
+	u.accumulatingMsgs = true
+	u.accumulatingChannel = channel
+}
+
+// queue appends pkts to the outbound messages of the channel each one of them is addressed to.
+func (u *u2fHIDState) queue(pkts ...[]byte) {
+	for _, p := range pkts {
+		channel := binary.BigEndian.Uint32(p[:4])
+
+		if len(u.outbound[channel]) == 0 {
+			u.txOrder = append(u.txOrder, channel)
+		}
+
+		u.outbound[channel] = append(u.outbound[channel], p)
+	}
+
+	if len(pkts) == 0 {
+		return
+	}
+
+	select {
+	case u.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next outbound message, or nil if there's none.
+// Channels are served in round-robin, one message each.
+func (u *u2fHIDState) next() []byte {
+	if len(u.txOrder) == 0 {
+		return nil
+	}
+
+	channel := u.txOrder[0]
+	u.txOrder = u.txOrder[1:]
+
+	msgs := u.outbound[channel]
+	if len(msgs) > 1 {
+		u.outbound[channel] = msgs[1:]
+		u.txOrder = append(u.txOrder, channel)
+	} else {
+		delete(u.outbound, channel)
+	}
+
+	return msgs[0]
+}
+
+// clear aborts the transaction of channel, if it is accumulating a request: its session is cleared, and
+// other channels can start a new transaction.
+// Pending commands are left running, their response will be queued once ready.
+func (u *u2fHIDState) clear(channel uint32) {
+	if !u.accumulatingMsgs || u.accumulatingChannel != channel {
+		return
+	}
+
+	if sess, ok := u.sessions[channel]; ok {
 		sess.clear()
 	}
 
-	u.outboundMsgs = nil
-	u.lastOutboundIndex = 0
-	u.lastChannelID = 0
+	u.stopAccumulating(channel)
+}
+
+// stopAccumulating marks the request of channel as complete, if it was being accumulated.
+func (u *u2fHIDState) stopAccumulating(channel uint32) {
+	if !u.accumulatingMsgs || u.accumulatingChannel != channel {
+		return
+	}
+
 	u.accumulatingMsgs = false
+	u.accumulatingChannel = 0
 }
@@ -40,13 +40,65 @@ func TestNewHandler(t *testing.T) {
 			tt.dataAssertion(t, got)
 		})
 	}
+
+	t.Run("cbor token is nil", func(t *testing.T) {
+		got, err := NewHandler(&fakeToken{}, WithCBOR(nil))
+		require.Error(t, err)
+		require.Nil(t, got)
+	})
+
+	t.Run("cbor token enables cbor capability", func(t *testing.T) {
+		got, err := NewHandler(&fakeToken{}, WithCBOR(&fakeToken{}))
+		require.NoError(t, err)
+		require.Equal(t, CapabilityCbor, got.capabilities())
+	})
+
+	t.Run("nil token with cbor token disables msg", func(t *testing.T) {
+		got, err := NewHandler(nil, WithCBOR(&fakeToken{}))
+		require.NoError(t, err)
+		require.Equal(t, CapabilityCbor|CapabilityNmsg, got.capabilities())
+
+		allocateChannels(got, [4]byte{1, 2, 3, 4})
+
+		_, err = got.Rx(zeroPad([]byte{1, 2, 3, 4, uint8(CmdMsg), 0, 1, 42}), nil)
+		require.NoError(t, err)
+
+		sent := drain(t, got)
+		require.Len(t, sent, 1)
+		require.Equal(t, uint8(CmdError), sent[0][4])
+		require.Equal(t, uint8(ErrInvalidCmd), sent[0][7])
+	})
+
+	t.Run("device info is sent in init responses", func(t *testing.T) {
+		got, err := NewHandler(&fakeToken{}, WithDeviceInfo(DeviceInfo{MajorVersion: 1, MinorVersion: 2, BuildVersion: 3}))
+		require.NoError(t, err)
+
+		_, err = got.Rx(zeroPad([]byte{255, 255, 255, 255, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}), nil)
+		require.NoError(t, err)
+
+		sent := drain(t, got)
+		require.Len(t, sent, 1)
+		require.Equal(t, []byte{protocolVersion, 1, 2, 3}, sent[0][19:23])
+	})
+
+	t.Run("winker is nil", func(t *testing.T) {
+		got, err := NewHandler(&fakeToken{}, WithWinker(nil))
+		require.Error(t, err)
+		require.Nil(t, got)
+	})
+
+	t.Run("winker enables wink capability", func(t *testing.T) {
+		got, err := NewHandler(&fakeToken{}, WithWinker(WinkerFunc(func() {})), WithCBOR(&fakeToken{}))
+		require.NoError(t, err)
+		require.Equal(t, CapabilityWink|CapabilityCbor, got.capabilities())
+	})
 }
 
 func Test_session_clear(t *testing.T) {
 	t.Run("state values are set to their default values", func(t *testing.T) {
 		s := &session{
 			data:         []byte("some data"),
-			command:      cmdMsg,
+			command:      CmdMsg,
 			total:        42,
 			leftToRead:   0,
 			lastSequence: 42,
@@ -59,32 +111,100 @@ func Test_session_clear(t *testing.T) {
 }
 
 func Test_u2fHIDState_clear(t *testing.T) {
-	t.Run("state values are set to their default values", func(t *testing.T) {
-		u := &u2fHIDState{
-			outboundMsgs: [][]byte{
-				[]byte("some data"),
-			},
-			lastOutboundIndex: 42,
-			accumulatingMsgs:  true,
-			sessions: map[uint32]*session{
-				42: {
-					data:         []byte("some data"),
-					command:      cmdMsg,
-					total:        42,
-					leftToRead:   0,
-					lastSequence: 42,
-				},
-			},
-			lastChannelID: 42,
+	newState := func() *u2fHIDState {
+		u := newU2FHIDState()
+		u.queue([]byte{0, 0, 0, 42, 1})
+		u.accumulate(42)
+		u.pending = true
+		u.sessions[42] = &session{
+			data:         []byte("some data"),
+			command:      CmdMsg,
+			total:        42,
+			leftToRead:   0,
+			lastSequence: 42,
 		}
 
-		u.clear()
+		return u
+	}
+
+	t.Run("state values are set to their default values", func(t *testing.T) {
+		u := newState()
+		u.clear(42)
 
-		require.Nil(t, u.outboundMsgs)
-		require.Zero(t, u.lastOutboundIndex)
 		require.False(t, u.accumulatingMsgs)
-		require.NotNil(t, u.sessions[42])
+		require.Zero(t, u.accumulatingChannel)
+		require.True(t, u.pending, "pending commands keep running")
+		require.Equal(t, session{}, *u.sessions[42])
 		require.Len(t, u.sessions, 1)
-		require.Zero(t, u.lastChannelID)
+		require.Len(t, u.outbound[42], 1, "outbound messages are kept")
 	})
+
+	t.Run("other channels don't abort the transaction", func(t *testing.T) {
+		u := newState()
+		u.clear(43)
+
+		require.True(t, u.accumulatingMsgs)
+		require.Equal(t, uint32(42), u.accumulatingChannel)
+		require.Equal(t, CmdMsg, u.sessions[42].command)
+	})
+}
+
+func Test_u2fHIDState_busy(t *testing.T) {
+	u := newU2FHIDState()
+	require.False(t, u.busy(1))
+
+	u.accumulate(1)
+	require.False(t, u.busy(1), "accumulating channel can send packets")
+	require.True(t, u.busy(2))
+
+	u.stopAccumulating(1)
+	require.False(t, u.busy(2))
+
+	u.pending = true
+	require.True(t, u.busy(1))
+	require.True(t, u.busy(2))
+}
+
+func Test_u2fHIDState_next(t *testing.T) {
+	u := newU2FHIDState()
+	require.Nil(t, u.next())
+
+	a1, a2, a3 := []byte{0, 0, 0, 1, 1}, []byte{0, 0, 0, 1, 2}, []byte{0, 0, 0, 1, 3}
+	b1, b2 := []byte{0, 0, 0, 2, 1}, []byte{0, 0, 0, 2, 2}
+
+	u.queue(a1, a2, a3)
+	u.queue(b1, b2)
+
+	var sent [][]byte
+	for msg := u.next(); msg != nil; msg = u.next() {
+		sent = append(sent, msg)
+	}
+
+	// channels are served in round-robin, and messages of each channel keep their order
+	require.Equal(t, [][]byte{a1, b1, a2, b2, a3}, sent)
+	require.Empty(t, u.outbound)
+	require.Empty(t, u.txOrder)
+}
+
+func TestDeviceInfoFromRevision(t *testing.T) {
+	tests := []struct {
+		rev  string
+		info DeviceInfo
+		ok   bool
+	}{
+		{"v1.2.3", DeviceInfo{MajorVersion: 1, MinorVersion: 2, BuildVersion: 3}, true},
+		{"a1b2c3d", DeviceInfo{MajorVersion: 0xa1, MinorVersion: 0xb2, BuildVersion: 0xc3}, true},
+		{"", DeviceInfo{}, false},
+		{"dirty", DeviceInfo{}, false},
+		{"zzzzzzz", DeviceInfo{}, false},
+	}
+
+	for _, tt := range tests {
+		info, ok := DeviceInfoFromRevision(tt.rev)
+		require.Equal(t, tt.ok, ok, tt.rev)
+
+		if ok {
+			require.Equal(t, tt.info, info, tt.rev)
+		}
+	}
 }
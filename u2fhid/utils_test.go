@@ -1,6 +1,12 @@
 package u2fhid
 
-import "testing"
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 type test struct {
 	name string
@@ -19,3 +25,42 @@ func (f *fakeToken) HandleMessage(b []byte) []byte {
 
 	return nil
 }
+
+// waitResponse waits for the command being executed by h to complete, and returns the outbound messages
+// read through Tx.
+func waitResponse(t *testing.T, h *Handler) [][]byte {
+	require.Eventually(t, func() bool {
+		h.stateLock.Lock()
+		defer h.stateLock.Unlock()
+
+		return !h.state.pending
+	}, time.Second, time.Millisecond)
+
+	return drain(t, h)
+}
+
+// drain reads all the outbound messages of h through Tx, and returns them.
+func drain(t *testing.T, h *Handler) [][]byte {
+	var ret [][]byte
+
+	for {
+		res, err := h.Tx(nil, nil)
+		require.NoError(t, err)
+
+		if res == nil {
+			return ret
+		}
+
+		ret = append(ret, res)
+	}
+}
+
+// allocateChannels marks channels as allocated on h, as if the host obtained them with CmdInit.
+func allocateChannels(h *Handler, channels ...[4]byte) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	for _, c := range channels {
+		h.state.add(binary.BigEndian.Uint32(c[:]), time.Now())
+	}
+}
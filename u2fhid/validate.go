@@ -0,0 +1,72 @@
+package u2fhid
+
+import (
+	"fmt"
+)
+
+// MaxPayloadLen is the maximum payload length of a message, an init packet followed by 128 continuation packets.
+const MaxPayloadLen = initPacketDataLen + 128*continuationPacketDataLen
+
+// initNonceLen is the length of the nonce sent with CmdInit.
+const initNonceLen = 8
+
+// protocolError represents a malformed input, which must be reported to the host with a CmdError message
+// on channel.
+type protocolError struct {
+	code    Error
+	channel uint32
+	reason  string
+}
+
+// newProtocolError returns a protocolError with code for the channel pkt was sent on.
+func newProtocolError(code Error, pkt u2fPacket, format string, a ...interface{}) error {
+	return protocolError{
+		code:    code,
+		channel: pkt.Channel(),
+		reason:  fmt.Sprintf(format, a...),
+	}
+}
+
+// Error implements the error interface.
+func (p protocolError) Error() string {
+	return fmt.Sprintf("%s on channel 0x%X, %s", p.code, p.channel, p.reason)
+}
+
+// response returns the CmdError message reporting p to the host.
+func (p protocolError) response() [][]byte {
+	return generateError(p.code, channelPacket(p.channel))
+}
+
+// validate checks the framing of pkt against the state of its channel, returning a protocolError if pkt must
+// be rejected.
+func (h *Handler) validate(pkt u2fPacket) error {
+	if pkt.Channel() == 0 {
+		return newProtocolError(ErrInvalidCid, pkt, "channel 0 is reserved")
+	}
+
+	ip, isInit := pkt.(initPacket)
+	if !isInit {
+		if !h.state.accumulatingMsgs || h.state.accumulatingChannel != pkt.Channel() {
+			return newProtocolError(ErrInvalidSeq, pkt, "continuation packet for channel 0x%X, which was not seen before", pkt.Channel())
+		}
+
+		return nil
+	}
+
+	switch {
+	case ip.Cmd == CmdInit && ip.Channel() != BroadcastChannel && !h.state.allocated(ip.Channel()):
+		return newProtocolError(ErrInvalidCid, pkt, "found a cmdInit, but not on the broadcast channel nor on an allocated one")
+	case ip.Cmd != CmdInit && ip.Channel() == BroadcastChannel:
+		return newProtocolError(ErrInvalidCid, pkt, "found %s on the broadcast channel, only cmdInit is allowed", ip.Cmd)
+	case ip.Cmd != CmdInit && !h.state.allocated(ip.Channel()):
+		return newProtocolError(ErrInvalidCid, pkt, "found %s on channel 0x%X, which was not allocated", ip.Cmd, ip.Channel())
+	case ip.Cmd == CmdInit && ip.PayloadLength != initNonceLen:
+		return newProtocolError(ErrInvalidLen, pkt, "cmdInit nonce must be %d bytes, found %d", initNonceLen, ip.PayloadLength)
+	case int(ip.PayloadLength) > MaxPayloadLen:
+		return newProtocolError(ErrInvalidLen, pkt, "payload length %d exceeds the maximum of %d", ip.PayloadLength, MaxPayloadLen)
+	case ip.Cmd != CmdInit && h.state.accumulatingMsgs && h.state.accumulatingChannel == ip.Channel():
+		return newProtocolError(ErrInvalidSeq, pkt, "found an init packet while the request on the channel is incomplete")
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package u2fhid
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_validate(t *testing.T) {
+	channel := []byte{1, 2, 3, 4}
+
+	// requireError sends msgs to a new Handler, on which channel is allocated, and checks that the last one
+	// is answered with code on errChannel.
+	requireError := func(t *testing.T, code Error, errChannel []byte, msgs ...[]byte) {
+		h, err := NewHandler(&fakeToken{})
+		require.NoError(t, err)
+
+		allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+		for _, msg := range msgs {
+			_, err = h.Rx(zeroPad(msg), nil)
+			require.NoError(t, err)
+		}
+
+		sent := drain(t, h)
+		require.Len(t, sent, 1)
+		require.Equal(t, append(errChannel, uint8(CmdError), 0, 1, uint8(code)), sent[0][:8])
+
+		require.False(t, h.state.accumulatingMsgs)
+	}
+
+	// longPing returns the init packet of a CmdPing request spanning more than one packet.
+	longPing := func() []byte {
+		return append(append(channel, uint8(CmdPing), 0, 120), bytes.Repeat([]byte{1}, initPacketDataLen)...)
+	}
+
+	tests := []test{
+		{
+			"reserved channel",
+			func(t *testing.T) {
+				requireError(t, ErrInvalidCid, []byte{0, 0, 0, 0}, []byte{0, 0, 0, 0, uint8(CmdPing), 0, 1, 42})
+			},
+		},
+		{
+			"reserved channel while a transaction is in progress",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				_, err = h.Rx(zeroPad(longPing()), nil)
+				require.NoError(t, err)
+
+				_, err = h.Rx(zeroPad([]byte{0, 0, 0, 0, uint8(CmdPing), 0, 1, 42}), nil)
+				require.NoError(t, err)
+
+				sent := drain(t, h)
+				require.Len(t, sent, 1)
+				require.Equal(t, []byte{0, 0, 0, 0, uint8(CmdError), 0, 1, uint8(ErrInvalidCid)}, sent[0][:8])
+
+				// the transaction in progress is left alone
+				require.True(t, h.state.accumulatingMsgs)
+			},
+		},
+		{
+			"init not on the broadcast channel nor on an allocated one",
+			func(t *testing.T) {
+				unallocated := []byte{5, 6, 7, 8}
+				requireError(t, ErrInvalidCid, unallocated, append(unallocated, uint8(CmdInit), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8))
+			},
+		},
+		{
+			"other commands on a channel which wasn't allocated",
+			func(t *testing.T) {
+				unallocated := []byte{5, 6, 7, 8}
+				requireError(t, ErrInvalidCid, unallocated, append(unallocated, uint8(CmdPing), 0, 1, 42))
+			},
+		},
+		{
+			"other commands on the broadcast channel",
+			func(t *testing.T) {
+				broadcast := []byte{255, 255, 255, 255}
+				requireError(t, ErrInvalidCid, broadcast, append(broadcast, uint8(CmdPing), 0, 1, 42))
+			},
+		},
+		{
+			"init with a wrong nonce length",
+			func(t *testing.T) {
+				broadcast := []byte{255, 255, 255, 255}
+				requireError(t, ErrInvalidLen, broadcast, append(broadcast, uint8(CmdInit), 0, 4, 1, 2, 3, 4))
+			},
+		},
+		{
+			"payload too long",
+			func(t *testing.T) {
+				l := MaxPayloadLen + 1
+				requireError(t, ErrInvalidLen, channel, append(channel, uint8(CmdPing), uint8(l>>8), uint8(l)))
+			},
+		},
+		{
+			"continuation without init",
+			func(t *testing.T) {
+				requireError(t, ErrInvalidSeq, channel, append(channel, 0, 1, 2, 3))
+			},
+		},
+		{
+			"first continuation isn't sequence 0",
+			func(t *testing.T) {
+				requireError(t, ErrInvalidSeq, channel, longPing(), append(channel, 1, 1, 2, 3))
+			},
+		},
+		{
+			"repeated continuation",
+			func(t *testing.T) {
+				requireError(t, ErrInvalidSeq, channel, longPing(), append(channel, 0, 1, 2, 3), append(channel, 0, 1, 2, 3))
+			},
+		},
+		{
+			"init while the request is incomplete",
+			func(t *testing.T) {
+				requireError(t, ErrInvalidSeq, channel, longPing(), append(channel, uint8(CmdPing), 0, 1, 42))
+			},
+		},
+		{
+			"maximum payload length is accepted",
+			func(t *testing.T) {
+				h, err := NewHandler(&fakeToken{})
+				require.NoError(t, err)
+
+				allocateChannels(h, [4]byte{1, 2, 3, 4})
+
+				msg := append(channel, uint8(CmdPing), uint8(MaxPayloadLen>>8), uint8(MaxPayloadLen&0xff))
+				_, err = h.Rx(zeroPad(msg), nil)
+				require.NoError(t, err)
+
+				for seq := 0; seq < 128; seq++ {
+					_, err = h.Rx(zeroPad(append(channel, uint8(seq))), nil)
+					require.NoError(t, err)
+				}
+
+				sent := drain(t, h)
+				require.Len(t, sent, 129)
+				require.Equal(t, uint8(CmdPing), sent[0][4])
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
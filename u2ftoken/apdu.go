@@ -0,0 +1,98 @@
+package u2ftoken
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// apduHeaderLen is the length of the CLA, INS, P1 and P2 bytes which start every command APDU.
+	apduHeaderLen = 4
+
+	// shortMaxNe and extendedMaxNe are the maximum response lengths, encoded by a zero Le field.
+	shortMaxNe    = 256
+	extendedMaxNe = 65536
+)
+
+// parseAPDU parses b as an ISO 7816-4 command APDU, in any of its cases:
+//
+//	1:  header
+//	2S: header, Le (1 byte)
+//	3S: header, Lc (1 byte), data
+//	4S: header, Lc (1 byte), data, Le (1 byte)
+//	2E: header, 0, Le (2 bytes)
+//	3E: header, 0, Lc (2 bytes), data
+//	4E: header, 0, Lc (2 bytes), data, Le (2 bytes)
+//
+// A zero Le means the maximum response length for its encoding.
+// It returns errWrongLength if b isn't a well-formed command APDU.
+func parseAPDU(b []byte) (Request, error) {
+	if len(b) < apduHeaderLen {
+		return Request{}, fmt.Errorf("APDU is %d bytes long, shorter than its header, %w", len(b), errWrongLength)
+	}
+
+	req := Request{
+		Class:   b[0],
+		Command: command(b[1]),
+		Parameters: Params{
+			First:  b[2],
+			Second: b[3],
+		},
+	}
+
+	body := b[apduHeaderLen:]
+
+	switch {
+	case len(body) == 0: // case 1
+		return req, nil
+	case len(body) == 1: // case 2S
+		req.MaxResponseBytes = ne(int(body[0]), shortMaxNe)
+		return req, nil
+	case body[0] != 0: // cases 3S and 4S
+		lc := int(body[0])
+		body = body[1:]
+
+		switch len(body) {
+		case lc:
+		case lc + 1:
+			req.MaxResponseBytes = ne(int(body[lc]), shortMaxNe)
+		default:
+			return Request{}, fmt.Errorf("short APDU with Lc %d has %d bytes of body, %w", lc, len(body), errWrongLength)
+		}
+
+		req.Data = body[:lc]
+		return req, nil
+	case len(body) < 3:
+		return Request{}, fmt.Errorf("extended APDU body is %d bytes long, %w", len(body), errWrongLength)
+	case len(body) == 3: // case 2E
+		req.MaxResponseBytes = ne(int(binary.BigEndian.Uint16(body[1:])), extendedMaxNe)
+		return req, nil
+	default: // cases 3E and 4E
+		lc := int(binary.BigEndian.Uint16(body[1:3]))
+		body = body[3:]
+
+		if lc == 0 {
+			return Request{}, fmt.Errorf("extended APDU with data has zero Lc, %w", errWrongLength)
+		}
+
+		switch len(body) {
+		case lc:
+		case lc + 2:
+			req.MaxResponseBytes = ne(int(binary.BigEndian.Uint16(body[lc:])), extendedMaxNe)
+		default:
+			return Request{}, fmt.Errorf("extended APDU with Lc %d has %d bytes of body, %w", lc, len(body), errWrongLength)
+		}
+
+		req.Data = body[:lc]
+		return req, nil
+	}
+}
+
+// ne returns the maximum response length encoded by le, max if le is zero.
+func ne(le, max int) int {
+	if le == 0 {
+		return max
+	}
+
+	return le
+}
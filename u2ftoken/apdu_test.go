@@ -0,0 +1,89 @@
+package u2ftoken
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseAPDU(t *testing.T) {
+	header := []byte{0, uint8(Authenticate), 3, 4}
+	data := bytes.Repeat([]byte{42}, 300)
+
+	apdu := func(b ...[]byte) []byte {
+		ret := append([]byte{}, header...)
+		for _, bb := range b {
+			ret = append(ret, bb...)
+		}
+
+		return ret
+	}
+
+	tests := []struct {
+		name     string
+		apdu     []byte
+		data     []byte
+		ne       int
+		wrongLen bool
+	}{
+		{"case 1", apdu(), nil, 0, false},
+		{"case 2S", apdu([]byte{10}), nil, 10, false},
+		{"case 2S, zero Le", apdu([]byte{0}), nil, shortMaxNe, false},
+		{"case 3S", apdu([]byte{3}, data[:3]), data[:3], 0, false},
+		{"case 4S", apdu([]byte{3}, data[:3], []byte{7}), data[:3], 7, false},
+		{"case 4S, zero Le", apdu([]byte{255}, data[:255], []byte{0}), data[:255], shortMaxNe, false},
+		{"case 2E", apdu([]byte{0, 1, 0}), nil, 256, false},
+		{"case 2E, zero Le", apdu([]byte{0, 0, 0}), nil, extendedMaxNe, false},
+		{"case 3E", apdu([]byte{0, 1, 44}, data), data, 0, false},
+		{"case 4E", apdu([]byte{0, 1, 44}, data, []byte{1, 0}), data, 256, false},
+		{"case 4E, zero Le", apdu([]byte{0, 0, 64}, data[:64], []byte{0, 0}), data[:64], extendedMaxNe, false},
+		{"empty", []byte{}, nil, 0, true},
+		{"truncated header", header[:3], nil, 0, true},
+		{"truncated short data", apdu([]byte{10}, data[:5]), nil, 0, true},
+		{"short data too long", apdu([]byte{3}, data[:5]), nil, 0, true},
+		{"truncated extended length", apdu([]byte{0, 1}), nil, 0, true},
+		{"truncated extended data", apdu([]byte{0, 1, 44}, data[:100]), nil, 0, true},
+		{"extended data too long", apdu([]byte{0, 0, 10}, data[:13]), nil, 0, true},
+		{"extended data with zero Lc", apdu([]byte{0, 0, 0}, data[:2]), nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseAPDU(tt.apdu)
+			if tt.wrongLen {
+				require.True(t, errors.Is(err, errWrongLength))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, Authenticate, req.Command)
+			require.Equal(t, Params{First: 3, Second: 4}, req.Parameters)
+			require.Equal(t, tt.data, req.Data)
+			require.Equal(t, tt.ne, req.MaxResponseBytes)
+		})
+	}
+}
+
+func TestToken_HandleMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		want errorCode
+	}{
+		{"nil request", nil, errConditionNotSatisfied},
+		{"truncated request", []byte{0, uint8(Register)}, errWrongLength},
+		{"truncated data", []byte{0, uint8(Register), 0, 0, 0, 0, 64, 1, 2, 3}, errWrongLength},
+		{"class not supported", []byte{0x80, uint8(Version), 0, 0}, errClaNotSupported},
+		{"instruction not supported", []byte{0, 0x42, 0, 0}, errInsNotSupported},
+		{"interindustry instruction not supported", []byte{0, 0xa4, 0, 0}, errInsNotSupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := tt.want.Bytes()
+			require.Equal(t, code[:], (&Token{}).HandleMessage(tt.req))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package u2ftoken
+
+import "sync"
+
+// swBytesRemaining is the first byte of the status word telling the host that more response data is available,
+// to be fetched with GetResponse. The second byte holds the amount of bytes remaining, zero meaning 256 or more.
+const swBytesRemaining = 0x61
+
+// responseChain holds, for each channel, the response data which didn't fit in the length requested by the host,
+// so that it can be fetched with GetResponse.
+type responseChain struct {
+	lock       sync.Mutex
+	remainders map[uint32][]byte
+}
+
+// drop discards the remainder of channel, if any.
+func (r *responseChain) drop(channel uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.remainders, channel)
+}
+
+// ReleaseChannel implements the transport.ChannelReleaser interface, discarding the response left to be fetched on
+// channel.
+func (t *Token) ReleaseChannel(channel uint32) {
+	t.chain.drop(channel)
+}
+
+// next returns the response to send on channel: up to ne bytes of data followed by a status word.
+// If data doesn't fit, the rest is kept for the next call with the remainder of channel, and the status word tells
+// the host how much is left. Otherwise the status word signals success.
+// A zero ne, sent by hosts which don't encode Le at all, doesn't limit the response length.
+func (r *responseChain) next(channel uint32, data []byte, ne int) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if ne == 0 || len(data) <= ne {
+		delete(r.remainders, channel)
+		return Response{Data: data, StatusCode: noError.Bytes()}.Bytes()
+	}
+
+	if r.remainders == nil {
+		r.remainders = map[uint32][]byte{}
+	}
+
+	rest := data[ne:]
+	r.remainders[channel] = rest
+
+	left := uint8(0)
+	if len(rest) < 256 {
+		left = uint8(len(rest))
+	}
+
+	return Response{Data: data[:ne], StatusCode: [2]byte{swBytesRemaining, left}}.Bytes()
+}
+
+// remainder returns the remainder of channel, and false if there's none.
+func (r *responseChain) remainder(channel uint32) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rest, ok := r.remainders[channel]
+	return rest, ok
+}
+
+// handleGetResponse handles GetResponse requests, sending the next part of the response chained on channel.
+func (t *Token) handleGetResponse(channel uint32, req Request) []byte {
+	rest, ok := t.chain.remainder(channel)
+	if !ok {
+		return errorResponse(errConditionNotSatisfied).Bytes()
+	}
+
+	return t.chain.next(channel, rest, req.MaxResponseBytes)
+}
@@ -0,0 +1,111 @@
+package u2ftoken
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/gsora/fidati/transport"
+
+	"github.com/stretchr/testify/require"
+)
+
+type test struct {
+	name string
+	f    func(*testing.T)
+}
+
+func Test_responseChain(t *testing.T) {
+	data := bytes.Repeat([]byte{42}, 600)
+	ok := noError.Bytes()
+
+	tests := []test{
+		{
+			"response fits",
+			func(t *testing.T) {
+				var r responseChain
+
+				require.Equal(t, append(data[:10:10], ok[:]...), r.next(1, data[:10], 10))
+				require.Equal(t, append(data[:10:10], ok[:]...), r.next(1, data[:10], 0))
+
+				_, pending := r.remainder(1)
+				require.False(t, pending)
+			},
+		},
+		{
+			"response is chained",
+			func(t *testing.T) {
+				var r responseChain
+
+				// 600 bytes: 256, 256 and the last 88
+				require.Equal(t, append(data[:256:256], swBytesRemaining, 0), r.next(1, data, 256))
+
+				rest, pending := r.remainder(1)
+				require.True(t, pending)
+				require.Len(t, rest, 344)
+
+				require.Equal(t, append(data[:256:256], swBytesRemaining, 88), r.next(1, rest, 256))
+
+				rest, _ = r.remainder(1)
+				require.Equal(t, append(data[:88:88], ok[:]...), r.next(1, rest, 256))
+
+				_, pending = r.remainder(1)
+				require.False(t, pending)
+			},
+		},
+		{
+			"remainders are per channel",
+			func(t *testing.T) {
+				var r responseChain
+
+				r.next(1, data[:20], 10)
+				r.next(2, data[:30], 10)
+
+				r.drop(1)
+
+				_, pending := r.remainder(1)
+				require.False(t, pending)
+
+				rest, pending := r.remainder(2)
+				require.True(t, pending)
+				require.Len(t, rest, 20)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
+
+func TestToken_handleGetResponse(t *testing.T) {
+	tk := &Token{}
+	version := []byte{0, uint8(Version), 0, 0, 4}
+	getResponse := []byte{0, uint8(GetResponse), 0, 0, 0}
+
+	notSatisfied := errConditionNotSatisfied.Bytes()
+	require.Equal(t, notSatisfied[:], tk.HandleMessage(getResponse))
+
+	require.Equal(t, []byte{'U', '2', 'F', '_', swBytesRemaining, 2}, tk.HandleMessage(version))
+	require.Equal(t, []byte{'V', '2', 0x90, 0x00}, tk.HandleMessage(getResponse))
+	require.Equal(t, notSatisfied[:], tk.HandleMessage(getResponse))
+
+	// other commands discard the remainder
+	require.Equal(t, []byte{'U', '2', 'F', '_', swBytesRemaining, 2}, tk.HandleMessage(version))
+	require.Equal(t, append([]byte("U2F_V2"), 0x90, 0x00), tk.HandleMessage([]byte{0, uint8(Version), 0, 0}))
+	require.Equal(t, notSatisfied[:], tk.HandleMessage(getResponse))
+}
+
+func TestToken_ReleaseChannel(t *testing.T) {
+	tk := &Token{}
+	version := []byte{0, uint8(Version), 0, 0, 4}
+	getResponse := []byte{0, uint8(GetResponse), 0, 0, 0}
+
+	ctx := transport.WithChannel(context.Background(), 1)
+	require.Equal(t, []byte{'U', '2', 'F', '_', swBytesRemaining, 2}, tk.HandleMessageContext(ctx, version))
+
+	tk.ReleaseChannel(1)
+
+	notSatisfied := errConditionNotSatisfied.Bytes()
+	require.Equal(t, notSatisfied[:], tk.HandleMessageContext(ctx, getResponse))
+}
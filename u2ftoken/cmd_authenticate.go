@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"time"
 
 	"github.com/gsora/fidati/internal/flog"
 )
@@ -12,9 +13,14 @@ const (
 	// we expect no less than minimumLen bytes when parsing an Authenticate request.
 	minimumLen = 32 + 32 + 1 // control byte + challenge param + app param + key handle len
 
+	// Authenticate control bytes.
 	controlCheckOnly                      = 0x07
 	controlEnforceUserPresenceAndSign     = 0x03
 	controlDontEnforceUserPresenceAndSign = 0x08
+
+	// userPresenceTimeout is the amount of time the user has to confirm presence after a request,
+	// and the amount of time a confirmation stays valid.
+	userPresenceTimeout = 10 * time.Second
 )
 
 func (t *Token) handleAuthenticate(req Request) (Response, error) {
@@ -44,38 +50,31 @@ func (t *Token) handleAuthenticate(req Request) (Response, error) {
 	flog.Logger.Println("requesting appID:", hex.EncodeToString(appID))
 	flog.Logger.Println("requesting keyHandle:", hex.EncodeToString(keyHandle))
 
-	// check that appID derives the same keyHandle we received
-	nonce := t.keyring.NonceFromKeyHandle(keyHandle)
-	if nonce == nil {
-		flog.Logger.Println("cannot obtain nonce from provided key handle")
-		return Response{}, errWrongData
-	}
-
-	_, derivedKeyHandle, err := t.keyring.Register(appID, nonce)
-	if err != nil {
-		flog.Logger.Println("cannot register key:", err)
+	// check that appID derives the same keyHandle we received: foreign key handles are rejected whatever the
+	// control byte is, so that hosts can tell which one of their key handles belongs to us
+	if !t.keyring.KeyHandleValid(appID, keyHandle) {
+		flog.Logger.Println("key handle wasn't generated by us for this appID")
 		return Response{}, errWrongData
 	}
 
-	flog.Logger.Println("generated keyhandle from appID:", hex.EncodeToString(derivedKeyHandle))
+	userPresence := false
 
-	if !bytes.Equal(derivedKeyHandle, keyHandle) {
-		flog.Logger.Println("derived key handle and provided key handle don't match")
-		return Response{}, errWrongData
-	}
-
-	userPresence := t.keyring.Counter.UserPresence()
-
-	// we only handle those two cases because the last one basically means
-	// "authenticate, thanks"
 	switch controlByte {
 	case controlCheckOnly:
+		// the key handle is ours, but nothing must be signed
 		return Response{}, errConditionNotSatisfied
 	case controlEnforceUserPresenceAndSign:
-		if !userPresence {
+		// hosts retry the request until the user confirms presence
+		if !t.presence.Present() {
 			flog.Logger.Println("control byte asked to enforce user presence, but it wasn't present")
 			return Response{}, errConditionNotSatisfied
 		}
+
+		userPresence = true
+	case controlDontEnforceUserPresenceAndSign:
+	default:
+		flog.Logger.Printf("unknown control byte %#x", controlByte)
+		return Response{}, errWrongData
 	}
 
 	userPresenceByte := byte(0)
@@ -0,0 +1,105 @@
+package u2ftoken
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
+	"github.com/stretchr/testify/require"
+)
+
+type testCounter struct {
+	i uint32
+}
+
+func (t *testCounter) Increment(_ []byte, _ []byte, _ []byte) (uint32, error) {
+	t.i++
+	return t.i, nil
+}
+
+// newTestToken returns a Token backed by the repository attestation certificate and key, whose user is always
+// present.
+func newTestToken(t *testing.T) *Token {
+	cert, err := ioutil.ReadFile("../certs/attestation_certificate.pem")
+	require.NoError(t, err)
+
+	key, err := ioutil.ReadFile("../certs/ecdsa_privkey.pem")
+	require.NoError(t, err)
+
+	present := presence.Func(func(_ context.Context) error {
+		return nil
+	})
+
+	tk, err := New(keyring.New([]byte("key"), &testCounter{}), present, cert, key)
+	require.NoError(t, err)
+
+	return tk
+}
+
+func TestToken_handleAuthenticate(t *testing.T) {
+	tk := newTestToken(t)
+
+	challenge := sha256.Sum256([]byte("challenge"))
+	application := sha256.Sum256([]byte("https://example.com"))
+	other := sha256.Sum256([]byte("https://example.org"))
+
+	_, keyHandle, err := tk.keyring.Register(application[:], nil)
+	require.NoError(t, err)
+
+	request := func(control uint8, app []byte) Request {
+		data := append(append([]byte{}, challenge[:]...), app...)
+		data = append(data, uint8(len(keyHandle)))
+
+		return Request{
+			Command:    Authenticate,
+			Parameters: Params{First: control},
+			Data:       append(data, keyHandle...),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		control uint8
+		app     []byte
+		err     error
+	}{
+		{"check-only, own key handle", controlCheckOnly, application[:], errConditionNotSatisfied},
+		{"check-only, foreign key handle", controlCheckOnly, other[:], errWrongData},
+		{"enforce presence, foreign key handle", controlEnforceUserPresenceAndSign, other[:], errWrongData},
+		{"don't enforce presence", controlDontEnforceUserPresenceAndSign, application[:], nil},
+		{"don't enforce presence, foreign key handle", controlDontEnforceUserPresenceAndSign, other[:], errWrongData},
+		{"unknown control byte", 0x42, application[:], errWrongData},
+		{"unknown control byte, foreign key handle", 0x42, other[:], errWrongData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tk.handleAuthenticate(request(tt.control, tt.app))
+			if tt.err != nil {
+				require.Equal(t, tt.err, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, uint8(0), resp.Data[0], "user presence byte")
+		})
+	}
+
+	t.Run("enforce presence", func(t *testing.T) {
+		// the first request starts waiting for the user
+		_, err := tk.handleAuthenticate(request(controlEnforceUserPresenceAndSign, application[:]))
+		require.Equal(t, errConditionNotSatisfied, err)
+
+		var resp Response
+		require.Eventually(t, func() bool {
+			resp, err = tk.handleAuthenticate(request(controlEnforceUserPresenceAndSign, application[:]))
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+
+		require.Equal(t, uint8(1), resp.Data[0])
+	})
+}
@@ -22,7 +22,7 @@ func (t *Token) handleRegister(req Request) (Response, error) {
 		return Response{}, errWrongLength
 	}
 
-	if !t.keyring.Counter.UserPresence() {
+	if !t.presence.Present() {
 		flog.Logger.Println("user presence during registration is required")
 		return Response{}, errConditionNotSatisfied
 	}
@@ -11,16 +11,26 @@ func _() {
 	_ = x[Register-1]
 	_ = x[Authenticate-2]
 	_ = x[Version-3]
+	_ = x[GetResponse-192]
 }
 
-const _command_name = "RegisterAuthenticateVersion"
+const (
+	_command_name_0 = "RegisterAuthenticateVersion"
+	_command_name_1 = "GetResponse"
+)
 
-var _command_index = [...]uint8{0, 8, 20, 27}
+var (
+	_command_index_0 = [...]uint8{0, 8, 20, 27}
+)
 
 func (i command) String() string {
-	i -= 1
-	if i >= command(len(_command_index)-1) {
-		return "command(" + strconv.FormatInt(int64(i+1), 10) + ")"
+	switch {
+	case 1 <= i && i <= 3:
+		i -= 1
+		return _command_name_0[_command_index_0[i]:_command_index_0[i+1]]
+	case i == 192:
+		return _command_name_1
+	default:
+		return "command(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _command_name[_command_index[i]:_command_index[i+1]]
 }
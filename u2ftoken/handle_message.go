@@ -1,9 +1,11 @@
 package u2ftoken
 
 import (
+	"context"
 	"errors"
 
 	"github.com/gsora/fidati/internal/flog"
+	"github.com/gsora/fidati/transport"
 )
 
 // a ready-made instance of the errConditionNotSatisfied error.
@@ -11,9 +13,23 @@ var notSatisfied = errorResponse(errConditionNotSatisfied).Bytes()
 
 // HandleMessage handles a message, and returns a response byte slice.
 func (t *Token) HandleMessage(data []byte) []byte {
+	return t.HandleMessageContext(context.Background(), data)
+}
+
+// HandleMessageContext is like HandleMessage, but responses are chained per the transport channel carried by ctx.
+// Messages handled without a channel share the same response chain.
+func (t *Token) HandleMessageContext(ctx context.Context, data []byte) []byte {
+	channel, _ := transport.ChannelFromContext(ctx)
+
 	req, err := t.ParseRequest(data)
 	if err != nil {
 		flog.Logger.Printf("cannot parse request, %s", err)
+
+		var code errorCode
+		if errors.As(err, &code) {
+			return errorResponse(code).Bytes()
+		}
+
 		return notSatisfied
 	}
 
@@ -22,6 +38,13 @@ func (t *Token) HandleMessage(data []byte) []byte {
 
 	flog.Logger.Printf("request: %+v", req)
 
+	if req.Command == GetResponse {
+		return t.handleGetResponse(channel, req)
+	}
+
+	// any command other than GetResponse discards the response left to be fetched
+	t.chain.drop(channel)
+
 	switch req.Command {
 	case Version:
 		resp, handleErr = t.handleVersion(req)
@@ -30,7 +53,13 @@ func (t *Token) HandleMessage(data []byte) []byte {
 	case Authenticate:
 		resp, handleErr = t.handleAuthenticate(req)
 	default:
-		return notSatisfied
+		ch, handled := t.commandMappings[req.Command]
+		if !handled {
+			flog.Logger.Println("unknown instruction:", req.Command)
+			return errorResponse(errInsNotSupported).Bytes()
+		}
+
+		resp = ch(req)
 	}
 
 	if handleErr != nil {
@@ -47,7 +76,7 @@ func (t *Token) HandleMessage(data []byte) []byte {
 
 	flog.Logger.Println("response len: ", len(resp.Bytes()))
 
-	respBytes, err := buildResponse(req, resp)
+	respBytes, err := t.buildResponse(channel, req, resp)
 	if err != nil {
 		flog.Logger.Println("cannot build response:", err)
 		return notSatisfied
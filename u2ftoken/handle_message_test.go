@@ -0,0 +1,85 @@
+package u2ftoken
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken_AddMapping(t *testing.T) {
+	echo := func(req Request) Response {
+		return Response{Data: req.Data, StatusCode: noError.Bytes()}
+	}
+
+	tests := []test{
+		{
+			"vendor command is handled",
+			func(t *testing.T) {
+				tk := newTestToken(t)
+				require.NoError(t, tk.AddMapping(VendorCommandFirst, echo))
+
+				resp := tk.HandleMessage([]byte{0, VendorCommandFirst, 0, 0, 3, 1, 2, 3})
+				require.Equal(t, []byte{1, 2, 3, 0x90, 0x00}, resp)
+			},
+		},
+		{
+			"vendor status codes are sent as is",
+			func(t *testing.T) {
+				tk := newTestToken(t)
+				require.NoError(t, tk.AddMapping(VendorCommandLast, func(_ Request) Response {
+					return Response{StatusCode: [2]byte{0x6a, 0x82}}
+				}))
+
+				require.Equal(t, []byte{0x6a, 0x82}, tk.HandleMessage([]byte{0, VendorCommandLast, 0, 0}))
+			},
+		},
+		{
+			"vendor responses are chained",
+			func(t *testing.T) {
+				tk := newTestToken(t)
+				require.NoError(t, tk.AddMapping(0x50, func(_ Request) Response {
+					return Response{Data: bytes.Repeat([]byte{42}, 300), StatusCode: noError.Bytes()}
+				}))
+
+				resp := tk.HandleMessage([]byte{0, 0x50, 0, 0, 0})
+				require.Len(t, resp, 256+2)
+				require.Equal(t, []byte{swBytesRemaining, 44}, resp[256:])
+			},
+		},
+		{
+			"unmapped vendor command",
+			func(t *testing.T) {
+				code := errInsNotSupported.Bytes()
+				require.Equal(t, code[:], newTestToken(t).HandleMessage([]byte{0, 0x50, 0, 0}))
+			},
+		},
+		{
+			"mapping already exists",
+			func(t *testing.T) {
+				tk := newTestToken(t)
+				require.NoError(t, tk.AddMapping(0x50, echo))
+				require.Error(t, tk.AddMapping(0x50, echo))
+			},
+		},
+		{
+			"command outside the vendor range",
+			func(t *testing.T) {
+				tk := newTestToken(t)
+				require.Error(t, tk.AddMapping(VendorCommandFirst-1, echo))
+				require.Error(t, tk.AddMapping(VendorCommandLast+1, echo))
+				require.Error(t, tk.AddMapping(Register, echo))
+			},
+		},
+		{
+			"nil handler",
+			func(t *testing.T) {
+				require.Error(t, newTestToken(t).AddMapping(0x50, nil))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, tt.f)
+	}
+}
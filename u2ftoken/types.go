@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/gsora/fidati/attestation"
 	"github.com/gsora/fidati/keyring"
+	"github.com/gsora/fidati/presence"
 )
 
 // command represents a U2F standard command.
@@ -26,8 +28,28 @@ const (
 
 	// Version returns the standard "U2F_V2" version string.
 	Version
+
+	// GetResponse returns the next part of a response which didn't fit the length requested by the host.
+	GetResponse command = 0xc0
 )
 
+const (
+	// VendorCommandFirst is the first instruction byte available to vendor-specific commands.
+	VendorCommandFirst = 0x40
+
+	// VendorCommandLast is the last instruction byte available to vendor-specific commands.
+	VendorCommandLast = 0xbf
+)
+
+// isVendorCommand returns true if c is in the vendor-specific instruction range.
+func (c command) isVendorCommand() bool {
+	return c >= VendorCommandFirst && c <= VendorCommandLast
+}
+
+// CommandHandler handles a vendor-specific request, and returns the response to send to the host.
+// The response status code is sent as is, so it must be set even when the request succeeds.
+type CommandHandler func(Request) Response
+
 const (
 	// The command completed successfully without error.
 	noError errorCode = 0x9000
@@ -80,9 +102,10 @@ type Params struct {
 
 // Request represents a standard APDU request.
 type Request struct {
+	Class            uint8
 	Command          command
 	Parameters       Params
-	MaxResponseBytes uint16
+	MaxResponseBytes int
 	Data             []byte
 }
 
@@ -104,14 +127,25 @@ func (r Response) Bytes() []byte {
 // It handles request parsing and composition, key storage orchestration.
 type Token struct {
 	keyring                *keyring.Keyring
+	presence               *presence.Poller
 	attestationCertificate []byte
 	attestationPrivkey     *ecdsa.PrivateKey
+
+	// response data left to be fetched with GetResponse
+	chain responseChain
+
+	// vendor-specific commands handlers
+	commandMappings map[command]CommandHandler
 }
 
-// New returns a new Token instance with k as Keyring.
+// New returns a new Token instance with k as Keyring, confirming user presence with p.
 // attCert must be a PEM-encoded certificate, while attPrivKey must be a X.509-encoded
 // ECDSA private key.
-func New(k *keyring.Keyring, attCert, attPrivKey []byte) (*Token, error) {
+func New(k *keyring.Keyring, p presence.Provider, attCert, attPrivKey []byte) (*Token, error) {
+	if p == nil {
+		return nil, fmt.Errorf("presence provider is nil")
+	}
+
 	cert, _, err := attestation.ParseCertificate(attCert)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse attestation certificate, %w", err)
@@ -124,56 +158,63 @@ func New(k *keyring.Keyring, attCert, attPrivKey []byte) (*Token, error) {
 
 	return &Token{
 		keyring:                k,
+		presence:               presence.NewPoller(p, userPresenceTimeout),
 		attestationCertificate: cert,
 		attestationPrivkey:     key,
+		commandMappings:        make(map[command]CommandHandler),
 	}, nil
 }
 
-// ParseRequest parses req as a U2F request.
-// It returns a Request instance filled with the appropriate data from req, and an error.
-func (t *Token) ParseRequest(req []byte) (Request, error) {
-	var ret Request
-
-	if req == nil {
-		return Request{}, fmt.Errorf("request bytes are nil")
+// AddMapping adds a new CommandHandler mapping for a given instruction.
+// Returns error if there's already a mapping for command, or if it is not defined
+// between VendorCommandFirst and VendorCommandLast.
+// Responses returned by ch are chained like the standard ones, if longer than what the host asked for.
+func (t *Token) AddMapping(command command, ch CommandHandler) error {
+	if _, mappingExists := t.commandMappings[command]; mappingExists {
+		return errors.New("command mapping already exists")
 	}
 
-	if req[0] != 0 {
-		return Request{}, fmt.Errorf("first byte of request must be zero")
+	if !command.isVendorCommand() {
+		return errors.New("command must be between VendorCommandFirst and VendorCommandLast")
 	}
 
-	ret.Command = command(req[1])
-	ret.Parameters = Params{
-		First:  req[2],
-		Second: req[3],
+	if ch == nil {
+		return errors.New("command handler is nil")
 	}
 
-	if req[4] != 0 {
-		return Request{}, fmt.Errorf("fifth byte is not zero, must always be")
-	}
+	t.commandMappings[command] = ch
 
-	dataLen := binary.BigEndian.Uint16(req[5:7])
+	return nil
+}
 
-	if dataLen != 0 {
-		ret.Data = req[7 : dataLen+7] // first 6 bytes are header tags, minus one for array indexing reasons :-)
+// ParseRequest parses req as a U2F request, encoded as a short or extended length APDU.
+// It returns a Request instance filled with the appropriate data from req, and an error.
+// Malformed APDUs are reported with errWrongLength, class bytes other than zero with errClaNotSupported.
+func (t *Token) ParseRequest(req []byte) (Request, error) {
+	if req == nil {
+		return Request{}, fmt.Errorf("request bytes are nil")
 	}
 
-	// Ne initial offset = 6 (header bytes) + dataLen
-	// Ne end offset = len(req)
-
-	neBytes := req[(5 + dataLen):]
-
-	if len(neBytes) == 3 {
-		return Request{}, fmt.Errorf("Ne bytes are %d long while we were expecting 3 bytes", len(neBytes))
+	ret, err := parseAPDU(req)
+	if err != nil {
+		return Request{}, err
 	}
 
-	ret.MaxResponseBytes = binary.BigEndian.Uint16(neBytes)
+	if ret.Class != 0 {
+		return Request{}, fmt.Errorf("first byte of request must be zero, found %#x, %w", ret.Class, errClaNotSupported)
+	}
 
 	return ret, nil
 }
 
-// buildResponse returns a byte slice containing APDU bytes to appropriately respond to the associated Request.
-func buildResponse(_ Request, resp Response) ([]byte, error) {
-	return resp.Bytes(), nil
+// buildResponse returns a byte slice containing APDU bytes to appropriately respond to the associated Request,
+// received on channel.
+// Successful responses longer than the length requested by the host are chained, their remainder can be fetched
+// with GetResponse.
+func (t *Token) buildResponse(channel uint32, req Request, resp Response) ([]byte, error) {
+	if resp.StatusCode != noError.Bytes() {
+		return resp.Bytes(), nil
+	}
 
+	return t.chain.next(channel, resp.Data, req.MaxResponseBytes), nil
 }